@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// archiveManifestName is the entry listing every file in a folder archive
+	// with its checksums. It is written last, once they are known.
+	archiveManifestName = "MANIFEST.json"
+
+	// archiveBufferSize is the largest object prefetched into memory. Larger
+	// objects are only opened ahead of time and streamed in their turn.
+	archiveBufferSize = 8 << 20
+)
+
+type archiveFormat struct {
+	extension   string
+	contentType string
+	newWriter   func(w io.Writer) archiveWriter
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip":    {".zip", "application/zip", newZipArchive},
+	"tar.gz": {".tar.gz", "application/gzip", newTarGzArchive},
+	"tgz":    {".tar.gz", "application/gzip", newTarGzArchive},
+}
+
+// archiveWriter writes the entries of an archive one after the other. Close
+// completes the archive; an archive that is not closed is left truncated.
+type archiveWriter interface {
+	create(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func newZipArchive(w io.Writer) archiveWriter {
+	return &zipArchive{zw: zip.NewWriter(w)}
+}
+
+func (a *zipArchive) create(name string, size int64, modified time.Time) (io.Writer, error) {
+	return a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarGzArchive(w io.Writer) archiveWriter {
+	gz := gzip.NewWriter(w)
+	return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (a *tarGzArchive) create(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     size,
+		ModTime:  modified,
+		Format:   tar.FormatPAX,
+	})
+	return a.tw, err
+}
+
+func (a *tarGzArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// archiveEntry is an object and its path inside the archive, relative to the
+// archived folder.
+type archiveEntry struct {
+	object string
+	path   string
+}
+
+type manifestEntry struct {
+	Path       string `json:"path"`
+	Object     string `json:"object"`
+	Size       int64  `json:"size"`
+	Generation int64  `json:"generation,omitempty"`
+	MD5        string `json:"md5"`
+	CRC32C     string `json:"crc32c"`
+	SHA256     string `json:"sha256"`
+}
+
+type fetchedObject struct {
+	info *ObjectInfo
+	body io.ReadCloser
+	err  error
+}
+
+func (f fetchedObject) close() {
+	if f.body != nil {
+		f.body.Close()
+	}
+}
+
+// DownloadArchive streams every object under a folder, optionally filtered by
+// include and exclude globs, as a zip or tar.gz archive.
+func DownloadArchive(c *gin.Context) {
+	folder, err := cleanPrefix(c.Query("folder"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	folder = strings.TrimSuffix(folder, "/")
+	if folder == "" {
+		respondError(c, newError(ErrInvalidArgument, "folder is required"))
+		return
+	}
+
+	formatName := strings.ToLower(c.DefaultQuery("format", "zip"))
+	format, ok := archiveFormats[formatName]
+	if !ok {
+		respondError(c, newError(ErrInvalidArgument, "unsupported archive format %q: use zip or tar.gz", formatName))
+		return
+	}
+
+	include, exclude := c.QueryArray("include"), c.QueryArray("exclude")
+	for _, pattern := range append(include[:len(include):len(include)], exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			respondError(c, newError(ErrInvalidArgument, "invalid pattern %q", pattern))
+			return
+		}
+	}
+
+	if err := authorize(c, OpList, folder+"/"); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	names, err := uploader.ListObjects(ctx, folder+"/")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	entries, err := archiveEntries(folder, names, include, exclude)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	objects := make([]string, len(entries))
+	for i, entry := range entries {
+		objects[i] = entry.object
+	}
+	if err := authorize(c, OpDownload, objects...); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", format.contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(folder) + format.extension}))
+	c.Status(http.StatusOK)
+
+	// Once streaming has started the status can no longer change, so a
+	// failure leaves the archive unterminated, which every extractor reports.
+	archive := format.newWriter(c.Writer)
+	manifest, err := writeArchive(ctx, archive, entries)
+	if err == nil {
+		err = writeManifest(archive, manifest)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		c.Error(err)
+	}
+}
+
+// archiveEntries selects the objects to archive. Patterns without a "/" match
+// the base name, so "*.bin" selects files in subfolders too. Objects whose
+// names would not extract inside the target directory, such as
+// "folder/../evil" written directly to the bucket, are left out.
+func archiveEntries(folder string, names, include, exclude []string) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, folder+"/")
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue
+		}
+		if _, err := cleanObjectName(rel); err != nil {
+			continue
+		}
+		if len(include) > 0 && !matchesGlob(include, rel) || matchesGlob(exclude, rel) {
+			continue
+		}
+		if rel == archiveManifestName {
+			return nil, newError(ErrConflict, "object %q clashes with the archive manifest", name)
+		}
+		entries = append(entries, archiveEntry{object: name, path: rel})
+	}
+	if len(entries) == 0 {
+		return nil, newError(ErrNotFound, "no objects to archive in folder %q", folder)
+	}
+	return entries, nil
+}
+
+func matchesGlob(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// writeArchive writes the entries in order while up to batchConcurrency
+// objects ahead of the writer are fetched.
+func writeArchive(ctx context.Context, archive archiveWriter, entries []archiveEntry) ([]manifestEntry, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	fetched := make([]chan fetchedObject, len(entries))
+	for i := range fetched {
+		fetched[i] = make(chan fetchedObject, 1)
+	}
+	window := make(chan struct{}, batchConcurrency)
+
+	var wg sync.WaitGroup
+	prefetching := make(chan struct{})
+	go func() {
+		defer close(prefetching)
+		for i, entry := range entries {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fetched[i] <- fetchObject(ctx, entry.object)
+			}()
+		}
+	}()
+
+	next := 0
+	defer func() {
+		cancel()
+		<-prefetching
+		wg.Wait()
+		for _, ch := range fetched[next:] {
+			select {
+			case f := <-ch:
+				f.close()
+			default:
+			}
+		}
+	}()
+
+	manifest := make([]manifestEntry, 0, len(entries))
+	for ; next < len(entries); next++ {
+		var f fetchedObject
+		select {
+		case f = <-fetched[next]:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		entry, err := writeArchiveEntry(archive, entries[next], f)
+		f.close()
+		<-window
+		if err != nil {
+			return nil, err
+		}
+		manifest = append(manifest, entry)
+	}
+	return manifest, nil
+}
+
+// fetchObject buffers a small object in memory, so the connection is freed
+// early, and only opens a large one.
+func fetchObject(ctx context.Context, objectname string) fetchedObject {
+	body, info, err := uploader.NewReader(ctx, objectname)
+	if err != nil {
+		return fetchedObject{err: err}
+	}
+	if info.Size > archiveBufferSize {
+		return fetchedObject{info: info, body: body}
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fetchedObject{err: err}
+	}
+	return fetchedObject{info: info, body: io.NopCloser(bytes.NewReader(data))}
+}
+
+func writeArchiveEntry(archive archiveWriter, entry archiveEntry, f fetchedObject) (manifestEntry, error) {
+	if f.err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to read object %q: %w", entry.object, f.err)
+	}
+
+	w, err := archive.create(entry.path, f.info.Size, f.info.Updated)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	var body io.Reader = f.body
+	if f.info.CRC32C != "" {
+		body = newChecksumReader(body, f.info.CRC32C)
+	}
+	hasher, sha := newObjectHasher(), sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hasher, sha), body)
+	if err != nil {
+		return manifestEntry{}, fmt.Errorf("failed to archive object %q: %w", entry.object, err)
+	}
+	if n != f.info.Size {
+		return manifestEntry{}, fmt.Errorf("failed to archive object %q: read %d of %d bytes", entry.object, n, f.info.Size)
+	}
+
+	return manifestEntry{
+		Path:       entry.path,
+		Object:     entry.object,
+		Size:       n,
+		Generation: f.info.Generation,
+		MD5:        base64.StdEncoding.EncodeToString(hasher.md5.Sum(nil)),
+		CRC32C:     encodeCRC32C(hasher.crc32c.Sum32()),
+		SHA256:     hex.EncodeToString(sha.Sum(nil)),
+	}, nil
+}
+
+func writeManifest(archive archiveWriter, manifest []manifestEntry) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := archive.create(archiveManifestName, int64(len(data)), time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,249 @@
+package handler_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	CRC32C string `json:"crc32c"`
+	SHA256 string `json:"sha256"`
+}
+
+func getArchive(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading archive failed: %v", err)
+	}
+	return res, body
+}
+
+func readZip(t *testing.T, body []byte) map[string][]byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open(%s) failed: %v", f.Name, err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	return files
+}
+
+func readTarGz(t *testing.T, body []byte) map[string][]byte {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("invalid gzip: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar: %v", err)
+		}
+		files[hdr.Name], _ = io.ReadAll(tr)
+	}
+	return files
+}
+
+func checkManifest(t *testing.T, files map[string][]byte) {
+	t.Helper()
+	var manifest []manifestEntry
+	if err := json.Unmarshal(files["MANIFEST.json"], &manifest); err != nil {
+		t.Fatalf("invalid manifest: %v", err)
+	}
+	if len(manifest) != len(files)-1 {
+		t.Fatalf("manifest lists %d files, archive has %d", len(manifest), len(files)-1)
+	}
+	for _, entry := range manifest {
+		data, ok := files[entry.Path]
+		if !ok {
+			t.Fatalf("manifest entry %s is not in the archive", entry.Path)
+		}
+		sum := sha256.Sum256(data)
+		if entry.SHA256 != hex.EncodeToString(sum[:]) || entry.Size != int64(len(data)) || entry.MD5 == "" || entry.CRC32C == "" {
+			t.Fatalf("manifest entry %+v does not match the archived file", entry)
+		}
+	}
+}
+
+func archiveNames(files map[string][]byte) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestDownloadArchive(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	objects := map[string]string{
+		"fw/v1/app.bin":        "application",
+		"fw/v1/boot.bin":       "bootloader",
+		"fw/v1/notes.txt":      "release notes",
+		"fw/v1/modem/fw.bin":   "modem",
+		"fw/v1/modem/debug.md": "debug",
+		"fw/v10/other.bin":     "other release",
+	}
+	for name, content := range objects {
+		if _, err := store.UploadBuffer(t.Context(), []byte(content), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	srv := newTestServer(t, store)
+
+	handler.ConfigureBatches(handler.BatchConfig{Concurrency: 2})
+	t.Cleanup(func() { handler.ConfigureBatches(handler.BatchConfig{Concurrency: 8}) })
+
+	tests := []struct {
+		name  string
+		query string
+		read  func(t *testing.T, body []byte) map[string][]byte
+		files string
+	}{
+		{"zip", "folder=fw/v1", readZip, "MANIFEST.json,app.bin,boot.bin,modem/debug.md,modem/fw.bin,notes.txt"},
+		{"tar.gz", "folder=fw/v1/&format=tar.gz", readTarGz, "MANIFEST.json,app.bin,boot.bin,modem/debug.md,modem/fw.bin,notes.txt"},
+		{"include", "folder=fw/v1&include=*.bin", readZip, "MANIFEST.json,app.bin,boot.bin,modem/fw.bin"},
+		{"include path", "folder=fw/v1&include=modem/*", readZip, "MANIFEST.json,modem/debug.md,modem/fw.bin"},
+		{"exclude", "folder=fw/v1&format=tgz&exclude=*.md&exclude=notes.txt", readTarGz, "MANIFEST.json,app.bin,boot.bin,modem/fw.bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := getArchive(t, srv.URL+"/download-archive?"+tt.query)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", res.StatusCode, body)
+			}
+			if !strings.Contains(res.Header.Get("Content-Disposition"), `filename=v1.`) {
+				t.Fatalf("unexpected Content-Disposition %q", res.Header.Get("Content-Disposition"))
+			}
+			files := tt.read(t, body)
+			if got := archiveNames(files); got != tt.files {
+				t.Fatalf("archive contains %s, want %s", got, tt.files)
+			}
+			checkManifest(t, files)
+			for path, data := range files {
+				if path != "MANIFEST.json" && string(data) != objects["fw/v1/"+path] {
+					t.Fatalf("%s contains %q", path, data)
+				}
+			}
+		})
+	}
+
+	failures := []struct {
+		query  string
+		status int
+	}{
+		{"format=zip", http.StatusBadRequest},
+		{"folder=fw/v1&format=rar", http.StatusBadRequest},
+		{"folder=fw/v1&include=[", http.StatusBadRequest},
+		{"folder=fw/v2", http.StatusNotFound},
+		{"folder=fw/v1&include=*.exe", http.StatusNotFound},
+	}
+	for _, f := range failures {
+		if res, body := getArchive(t, srv.URL+"/download-archive?"+f.query); res.StatusCode != f.status {
+			t.Fatalf("%s: expected %d, got %d: %s", f.query, f.status, res.StatusCode, body)
+		}
+	}
+}
+
+func TestDownloadArchiveUnsafeNames(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	for _, name := range []string{"fw/app.bin", "fw/../evil", "fw//etc/passwd", "fw/./boot.bin"} {
+		if _, err := store.UploadBuffer(t.Context(), []byte(name), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	srv := newTestServer(t, store)
+
+	for format, read := range map[string]func(t *testing.T, body []byte) map[string][]byte{"zip": readZip, "tar.gz": readTarGz} {
+		res, body := getArchive(t, srv.URL+"/download-archive?folder=fw&format="+format)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", format, res.StatusCode, body)
+		}
+		if got := archiveNames(read(t, body)); got != "MANIFEST.json,app.bin" {
+			t.Fatalf("%s: archive contains %s, want only the safe names", format, got)
+		}
+	}
+}
+
+func TestDownloadArchiveReadFailure(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	for _, name := range []string{"fw/a.bin", "fw/b.bin", "fw/c.bin"} {
+		if _, err := store.UploadBuffer(t.Context(), []byte(name), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	srv := newTestServer(t, store)
+
+	store.InjectFailure("NewRangeReader", io.ErrUnexpectedEOF, 1)
+
+	res, body := getArchive(t, srv.URL+"/download-archive?folder=fw")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected streaming to start, got %d", res.StatusCode)
+	}
+	if _, err := zip.NewReader(bytes.NewReader(body), int64(len(body))); err == nil {
+		t.Fatal("expected a failed read to leave the archive unterminated")
+	}
+}
+
+func TestDownloadArchiveAuthorization(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	for _, name := range []string{"fw/a.bin", "fw/private/b.bin"} {
+		if _, err := store.UploadBuffer(t.Context(), []byte(name), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	srv := newTestServer(t, store)
+	configureAuth(t, handler.AuthConfig{APIKeys: []handler.APIKey{
+		{Name: "reader", Hash: handler.HashAPIKey("reader-key"), Operations: []string{"list", "download"}, Folders: []string{"fw"}},
+		{Name: "public", Hash: handler.HashAPIKey("public-key"), Operations: []string{"list", "download"}, Folders: []string{"fw/a.bin"}},
+	}})
+
+	for key, status := range map[string]int{"reader-key": http.StatusOK, "public-key": http.StatusForbidden} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/download-archive?folder=fw", nil)
+		req.Header.Set("X-API-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s: expected %d, got %d", key, status, res.StatusCode)
+		}
+	}
+}
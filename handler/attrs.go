@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// metadataPrefix marks custom metadata in form fields and headers.
+	metadataPrefix = "x-meta-"
+
+	// maxMetadataSize is the GCS limit on the keys and values of custom
+	// metadata combined.
+	maxMetadataSize = 8 << 10
+)
+
+// ObjectAttrs are the attributes stored with an uploaded object. An empty
+// ContentType is detected from the object name and content.
+type ObjectAttrs struct {
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+}
+
+// AttrsUpdate changes the attributes of an object. Nil fields are left as
+// they are and an empty string clears the attribute. Metadata keys are merged
+// into the existing metadata; an empty, non-nil map removes all of it.
+type AttrsUpdate struct {
+	ContentType        *string           `json:"contentType"`
+	ContentEncoding    *string           `json:"contentEncoding"`
+	CacheControl       *string           `json:"cacheControl"`
+	ContentDisposition *string           `json:"contentDisposition"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+func (a *ObjectAttrs) validate() error {
+	if err := validateContentHeaders(a.ContentType, a.ContentEncoding, a.CacheControl, a.ContentDisposition); err != nil {
+		return err
+	}
+	metadata, err := cleanMetadata(a.Metadata)
+	if err != nil {
+		return err
+	}
+	a.Metadata = metadata
+	return nil
+}
+
+func (u *AttrsUpdate) validate() error {
+	if u.ContentType == nil && u.ContentEncoding == nil && u.CacheControl == nil && u.ContentDisposition == nil && u.Metadata == nil {
+		return newError(ErrInvalidArgument, "no attributes to update")
+	}
+	deref := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	if err := validateContentHeaders(deref(u.ContentType), deref(u.ContentEncoding), deref(u.CacheControl), deref(u.ContentDisposition)); err != nil {
+		return err
+	}
+	if u.Metadata == nil {
+		return nil
+	}
+	metadata, err := cleanMetadata(u.Metadata)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	u.Metadata = metadata
+	return nil
+}
+
+// validateContentHeaders rejects values that are not valid in the response
+// headers they are served as.
+func validateContentHeaders(contentType, contentEncoding, cacheControl, contentDisposition string) error {
+	for name, value := range map[string]string{
+		"contentType":        contentType,
+		"contentEncoding":    contentEncoding,
+		"cacheControl":       cacheControl,
+		"contentDisposition": contentDisposition,
+	} {
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			return newError(ErrInvalidArgument, "%s contains control characters", name)
+		}
+	}
+	if contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return newError(ErrInvalidArgument, "invalid contentType %q", contentType)
+		}
+	}
+	if contentDisposition != "" {
+		if _, _, err := mime.ParseMediaType(contentDisposition); err != nil {
+			return newError(ErrInvalidArgument, "invalid contentDisposition %q", contentDisposition)
+		}
+	}
+	return nil
+}
+
+// cleanMetadata lower-cases metadata keys, which are served as header names,
+// and enforces the GCS size limit.
+func cleanMetadata(metadata map[string]string) (map[string]string, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	clean := make(map[string]string, len(metadata))
+	size := 0
+	for k, v := range metadata {
+		key := strings.ToLower(strings.TrimSpace(k))
+		if key == "" || strings.ContainsFunc(key, func(r rune) bool { return !isTokenChar(r) }) {
+			return nil, newError(ErrInvalidArgument, "invalid metadata key %q", k)
+		}
+		if strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return nil, newError(ErrInvalidArgument, "metadata %q contains control characters", key)
+		}
+		if _, ok := clean[key]; ok {
+			return nil, newError(ErrInvalidArgument, "metadata key %q is given more than once", key)
+		}
+		clean[key] = v
+		size += len(key) + len(v)
+	}
+	if size > maxMetadataSize {
+		return nil, newError(ErrInvalidArgument, "metadata exceeds %d bytes", maxMetadataSize)
+	}
+	return clean, nil
+}
+
+func isTokenChar(r rune) bool {
+	return 'a' <= r && r <= 'z' || '0' <= r && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// formAttrs reads the attributes of a form upload from its fields, with
+// custom metadata in x-meta-* fields.
+func formAttrs(c *gin.Context) (ObjectAttrs, error) {
+	attrs := ObjectAttrs{
+		ContentType:        strings.TrimSpace(c.PostForm("contentType")),
+		ContentEncoding:    strings.TrimSpace(c.PostForm("contentEncoding")),
+		CacheControl:       strings.TrimSpace(c.PostForm("cacheControl")),
+		ContentDisposition: strings.TrimSpace(c.PostForm("contentDisposition")),
+		Metadata:           prefixedValues(c.Request.PostForm),
+	}
+	return attrs, attrs.validate()
+}
+
+// headerAttrs reads the attributes of a raw upload from its content headers,
+// with custom metadata in X-Meta-* headers.
+func headerAttrs(c *gin.Context) (ObjectAttrs, error) {
+	attrs := ObjectAttrs{
+		ContentType:        strings.TrimSpace(c.GetHeader("Content-Type")),
+		ContentEncoding:    strings.TrimSpace(c.GetHeader("Content-Encoding")),
+		CacheControl:       strings.TrimSpace(c.GetHeader("Cache-Control")),
+		ContentDisposition: strings.TrimSpace(c.GetHeader("Content-Disposition")),
+		Metadata:           prefixedValues(url.Values(c.Request.Header)),
+	}
+	return attrs, attrs.validate()
+}
+
+// tusAttrs reads the attributes of a resumable upload from its
+// Upload-Metadata, with custom metadata in x-meta-* keys. tus clients send
+// the content type as filetype.
+func tusAttrs(fields map[string]string) (ObjectAttrs, error) {
+	values := make(url.Values, len(fields))
+	for k, v := range fields {
+		values.Set(k, v)
+	}
+	attrs := ObjectAttrs{
+		ContentType:        strings.TrimSpace(fields["contentType"]),
+		ContentEncoding:    strings.TrimSpace(fields["contentEncoding"]),
+		CacheControl:       strings.TrimSpace(fields["cacheControl"]),
+		ContentDisposition: strings.TrimSpace(fields["contentDisposition"]),
+		Metadata:           prefixedValues(values),
+	}
+	if attrs.ContentType == "" {
+		attrs.ContentType = strings.TrimSpace(fields["filetype"])
+	}
+	return attrs, attrs.validate()
+}
+
+// sharedAttrs are the attributes of a form upload that apply to every object
+// written from it. Content headers describe a single file and are dropped.
+func sharedAttrs(attrs ObjectAttrs) ObjectAttrs {
+	return ObjectAttrs{CacheControl: attrs.CacheControl, Metadata: attrs.Metadata}
+}
+
+func prefixedValues(values url.Values) map[string]string {
+	var metadata map[string]string
+	for k, v := range values {
+		key, ok := cutPrefixFold(k, metadataPrefix)
+		if !ok || len(v) == 0 {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[key] = v[0]
+	}
+	return metadata
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// detectContentType fills in a missing content type from the extension of
+// the object name or, failing that, by sniffing the content. The returned
+// reader must be used in place of src. Encoded content is not sniffed.
+func detectContentType(objectname string, attrs *ObjectAttrs, src io.Reader) (io.Reader, error) {
+	if attrs.ContentType != "" {
+		return src, nil
+	}
+	if byExtension := mime.TypeByExtension(path.Ext(objectname)); byExtension != "" {
+		attrs.ContentType = byExtension
+		return src, nil
+	}
+	if attrs.ContentEncoding != "" && !strings.EqualFold(attrs.ContentEncoding, "identity") {
+		attrs.ContentType = "application/octet-stream"
+		return src, nil
+	}
+
+	buffered := bufio.NewReaderSize(src, sniffLen)
+	head, err := buffered.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	attrs.ContentType = http.DetectContentType(head)
+	return buffered, nil
+}
+
+func attrsStore() (AttrsStore, error) {
+	store, ok := uploader.(AttrsStore)
+	if !ok {
+		return nil, newError(ErrNotSupported, "the configured storage backend does not support object attributes")
+	}
+	return store, nil
+}
+
+func UpdateObjectAttrs(c *gin.Context) {
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := authorize(c, OpUpload, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	store, err := attrsStore()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var update AttrsUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		respondError(c, newError(ErrInvalidArgument, "invalid request body: %v", err))
+		return
+	}
+	if err := update.validate(); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	conds, err := requestConditions(ctx, c, objectname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	info, err := store.UpdateAttrs(ctx, objectname, update, conds)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("ETag", info.ETag())
+	c.JSON(http.StatusOK, ApiResponse{Message: "Object attributes updated", Data: info})
+}
@@ -0,0 +1,144 @@
+package handler_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func TestObjectAttrs(t *testing.T) {
+	stores := map[string]func(t *testing.T) handler.ObjectStore{
+		"memory":  func(t *testing.T) handler.ObjectStore { return handler.NewMemoryStore(testBucket) },
+		"fakegcs": func(t *testing.T) handler.ObjectStore { return newUploader(t, newFakeGCS(t)) },
+		"local":   func(t *testing.T) handler.ObjectStore { return newLocalStore(t, "http://localhost:8080") },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, newStore(t))
+
+			attrs := func(objectname string) map[string]interface{} {
+				t.Helper()
+				res, ar := doRequest(t, http.MethodGet, srv.URL+"/object-attrs?objectname="+objectname, nil, nil)
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("expected 200, got %d: %s", res.StatusCode, ar.Error)
+				}
+				return getDataMap(t, ar)
+			}
+
+			body, contentType := multipartBody(t, map[string]string{
+				"folder":             "fw",
+				"contentType":        "application/x-firmware",
+				"cacheControl":       "no-cache",
+				"contentDisposition": `attachment; filename="app.bin"`,
+				"x-meta-Build":       "42",
+			}, "app.bin", []byte("firmware"))
+			res, err := http.Post(srv.URL+"/upload-file", contentType, body)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if ar := parseResp(t, res); res.StatusCode != http.StatusCreated {
+				t.Fatalf("expected 201, got %d: %s", res.StatusCode, ar.Error)
+			}
+
+			res, _ = doGet(t, srv.URL+"/download-file?objectname=fw/app.bin", nil)
+			if res.Header.Get("Content-Disposition") != `attachment; filename="app.bin"` {
+				t.Fatalf("expected the stored Content-Disposition on a plain download, got %q", res.Header.Get("Content-Disposition"))
+			}
+
+			got := attrs("fw/app.bin")
+			if got["contentType"] != "application/x-firmware" || got["cacheControl"] != "no-cache" || got["contentDisposition"] != `attachment; filename="app.bin"` {
+				t.Fatalf("unexpected attributes %v", got)
+			}
+			if metadata, _ := got["metadata"].(map[string]interface{}); metadata["build"] != "42" {
+				t.Fatalf("expected build metadata, got %v", got["metadata"])
+			}
+
+			// Content types are detected from the extension, then the content.
+			for objectname, content := range map[string][]byte{"fw/manifest.json": []byte("{}"), "fw/logo": pngHeader} {
+				res, ar := doRequest(t, http.MethodPost, srv.URL+"/upload-buffer?objectname="+objectname, string(content), map[string]string{"X-Meta-Commit": "abc123"})
+				if res.StatusCode != http.StatusCreated {
+					t.Fatalf("expected 201, got %d: %s", res.StatusCode, ar.Error)
+				}
+			}
+			if got := attrs("fw/manifest.json"); got["contentType"] != "application/json" {
+				t.Fatalf("expected application/json, got %v", got["contentType"])
+			}
+			got = attrs("fw/logo")
+			if got["contentType"] != "image/png" {
+				t.Fatalf("expected image/png, got %v", got["contentType"])
+			}
+			if metadata, _ := got["metadata"].(map[string]interface{}); metadata["commit"] != "abc123" {
+				t.Fatalf("expected commit metadata, got %v", got["metadata"])
+			}
+
+			res, ar := doRequest(t, http.MethodPatch, srv.URL+"/object-attrs?objectname=fw/app.bin",
+				`{"contentType": "application/octet-stream", "cacheControl": "", "metadata": {"channel": "beta"}}`, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", res.StatusCode, ar.Error)
+			}
+			got = attrs("fw/app.bin")
+			if got["contentType"] != "application/octet-stream" || got["cacheControl"] != nil || got["metageneration"] != float64(2) {
+				t.Fatalf("unexpected attributes after update %v", got)
+			}
+			if metadata, _ := got["metadata"].(map[string]interface{}); metadata["build"] != "42" || metadata["channel"] != "beta" {
+				t.Fatalf("expected merged metadata, got %v", got["metadata"])
+			}
+
+			if res, _ := doRequest(t, http.MethodPatch, srv.URL+"/object-attrs?objectname=fw/app.bin", `{"metadata": {}}`, nil); res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200 clearing metadata, got %d", res.StatusCode)
+			}
+			if got := attrs("fw/app.bin"); got["metadata"] != nil {
+				t.Fatalf("expected metadata to be cleared, got %v", got["metadata"])
+			}
+
+			failures := []struct {
+				path   string
+				body   string
+				status int
+			}{
+				{"/object-attrs?objectname=fw/app.bin&ifMetagenerationMatch=1", `{"cacheControl": "no-store"}`, http.StatusPreconditionFailed},
+				{"/object-attrs?objectname=fw/missing.bin", `{"cacheControl": "no-store"}`, http.StatusNotFound},
+				{"/object-attrs?objectname=fw/app.bin", `{}`, http.StatusBadRequest},
+				{"/object-attrs?objectname=fw/app.bin", `{"contentType": "not a type"}`, http.StatusBadRequest},
+				{"/object-attrs?objectname=fw/app.bin", `{"cacheControl": "no-cache\r\nSet-Cookie: a=b"}`, http.StatusBadRequest},
+				{"/object-attrs?objectname=fw/app.bin", `{"metadata": {"bad key": "v"}}`, http.StatusBadRequest},
+			}
+			for _, f := range failures {
+				if res, ar := doRequest(t, http.MethodPatch, srv.URL+f.path, f.body, nil); res.StatusCode != f.status {
+					t.Fatalf("%s %s: expected %d, got %d: %s", f.path, f.body, f.status, res.StatusCode, ar.Error)
+				}
+			}
+			if res, _ := doRequest(t, http.MethodGet, srv.URL+"/object-attrs?objectname=fw/missing.bin", nil, nil); res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestUploadMetadataValidation(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	tests := map[string]map[string]string{
+		"invalid content type": {"Content-Type": "not a type"},
+		"metadata too large":   {"X-Meta-Notes": strings.Repeat("a", 8<<10)},
+	}
+	for name, headers := range tests {
+		res, _ := doRequest(t, http.MethodPost, srv.URL+"/upload-buffer?objectname=fw/app.bin", "data", headers)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, res.StatusCode)
+		}
+	}
+
+	body, contentType := multipartBody(t, map[string]string{"folder": "fw", "contentDisposition": "attachment; filename"}, "app.bin", []byte("data"))
+	res, err := http.Post(srv.URL+"/upload-file", contentType, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if parseResp(t, res); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid content disposition, got %d", res.StatusCode)
+	}
+}
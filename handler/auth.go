@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Operations a principal may be granted.
+const (
+	OpList     = "list"
+	OpUpload   = "upload"
+	OpDownload = "download"
+	OpDelete   = "delete"
+	OpSign     = "sign"
+)
+
+const principalKey = "principal"
+
+var (
+	operations = []string{OpList, OpUpload, OpDownload, OpDelete, OpSign}
+
+	// apiKeys maps the hex SHA-256 of each configured key to its principal.
+	// Authentication is disabled while it is empty and JWTs are not
+	// configured.
+	apiKeys map[string]*Principal
+)
+
+// Principal is the authenticated caller of a request. An empty Folders list
+// grants access to the whole bucket.
+type Principal struct {
+	Name       string
+	Operations []string
+	Folders    []string
+}
+
+func (p *Principal) allows(op string) bool {
+	return slices.Contains(p.Operations, op)
+}
+
+// allowsName reports whether name, an object name or a listing prefix, lies
+// within one of the principal's folders. A prefix for a whole folder must end
+// in "/", or it would also match sibling folders such as "public-secret".
+func (p *Principal) allowsName(name string) bool {
+	if len(p.Folders) == 0 {
+		return true
+	}
+	name = strings.TrimSpace(name)
+	for _, folder := range p.Folders {
+		if strings.HasPrefix(name, folder+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// scopePrefix adds the trailing "/" to a prefix that names one of the
+// principal's folders exactly.
+func (p *Principal) scopePrefix(prefix string) string {
+	for _, folder := range p.Folders {
+		if prefix == folder {
+			return folder + "/"
+		}
+	}
+	return prefix
+}
+
+// APIKey is a configured key. Only the hex SHA-256 of the key is stored.
+type APIKey struct {
+	Name       string   `json:"name"`
+	Hash       string   `json:"hash"`
+	Operations []string `json:"operations"`
+	Folders    []string `json:"folders"`
+}
+
+// AuthConfig lists the accepted API keys. APIKeysFile is a JSON array of
+// APIKey entries, added to APIKeys.
+type AuthConfig struct {
+	APIKeys     []APIKey
+	APIKeysFile string
+}
+
+func ConfigureAuth(cfg AuthConfig) error {
+	keys := cfg.APIKeys
+	if cfg.APIKeysFile != "" {
+		data, err := os.ReadFile(cfg.APIKeysFile)
+		if err != nil {
+			return err
+		}
+		var fileKeys []APIKey
+		if err := json.Unmarshal(data, &fileKeys); err != nil {
+			return fmt.Errorf("invalid API keys file %s: %w", cfg.APIKeysFile, err)
+		}
+		keys = append(slices.Clip(keys), fileKeys...)
+	}
+
+	principals := make(map[string]*Principal, len(keys))
+	for _, key := range keys {
+		principal, err := apiKeyPrincipal(key)
+		if err != nil {
+			return err
+		}
+		hash := strings.ToLower(key.Hash)
+		if _, ok := principals[hash]; ok {
+			return fmt.Errorf("API key %q is configured twice", key.Name)
+		}
+		principals[hash] = principal
+	}
+	apiKeys = principals
+	return nil
+}
+
+func apiKeyPrincipal(key APIKey) (*Principal, error) {
+	if key.Name == "" {
+		return nil, fmt.Errorf("API key without a name")
+	}
+	if hash, err := hex.DecodeString(key.Hash); err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("API key %q: hash must be a hex SHA-256 digest", key.Name)
+	}
+
+	principal := &Principal{Name: key.Name}
+	for _, op := range key.Operations {
+		if !slices.Contains(operations, op) {
+			return nil, fmt.Errorf("API key %q: unknown operation %q", key.Name, op)
+		}
+		principal.Operations = append(principal.Operations, op)
+	}
+	for _, folder := range key.Folders {
+		folder = strings.Trim(strings.TrimSpace(folder), "/")
+		if folder == "" {
+			return nil, fmt.Errorf("API key %q: folders must not be empty", key.Name)
+		}
+		principal.Folders = append(principal.Folders, folder)
+	}
+	return principal, nil
+}
+
+// HashAPIKey returns the digest stored in the configuration for key.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthEnabled reports whether API keys or JWTs are configured. Without
+// either, every route is open.
+func AuthEnabled() bool {
+	return len(apiKeys) > 0 || jwtVerifier != nil
+}
+
+// Authenticate identifies the caller by an "Authorization: Bearer" token or
+// the X-API-Key header. Handlers then check the caller's operations and
+// folders with authorize.
+func Authenticate(c *gin.Context) {
+	if !AuthEnabled() {
+		c.Next()
+		return
+	}
+
+	var principal *Principal
+	var err error
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		principal, err = bearerPrincipal(c, strings.TrimSpace(token))
+	} else {
+		principal, err = lookupAPIKey(c.GetHeader("X-API-Key"))
+	}
+	if err != nil {
+		abortError(c, err)
+		return
+	}
+
+	c.Set(principalKey, principal)
+	c.Next()
+}
+
+func bearerPrincipal(c *gin.Context, token string) (*Principal, error) {
+	if jwtVerifier == nil {
+		return nil, newError(ErrUnauthenticated, "bearer tokens are not accepted")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	principal, err := jwtVerifier.verify(ctx, token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return nil, err
+	}
+	return principal, nil
+}
+
+func lookupAPIKey(key string) (*Principal, error) {
+	if key == "" {
+		return nil, newError(ErrUnauthenticated, "missing API key or bearer token")
+	}
+	principal, ok := apiKeys[HashAPIKey(key)]
+	if !ok {
+		return nil, newError(ErrUnauthenticated, "invalid API key")
+	}
+	return principal, nil
+}
+
+// authorize checks that the caller may perform op on every name. It fails
+// closed when authentication is enabled but the route is not behind
+// Authenticate.
+func authorize(c *gin.Context, op string, names ...string) error {
+	value, ok := c.Get(principalKey)
+	if !ok {
+		if AuthEnabled() {
+			return newError(ErrUnauthenticated, "authentication required")
+		}
+		return nil
+	}
+
+	principal := value.(*Principal)
+	if !principal.allows(op) {
+		return newError(ErrPermissionDenied, "%q is not allowed to %s objects", principal.Name, op)
+	}
+	for _, name := range names {
+		if !principal.allowsName(name) {
+			return newError(ErrPermissionDenied, "%q has no access to %q", principal.Name, name)
+		}
+	}
+	return nil
+}
+
+// authorizePrefix checks that the caller may perform op on every object under
+// prefix and returns the prefix to list. For a caller restricted to folders,
+// a prefix naming one of them is narrowed to its contents.
+func authorizePrefix(c *gin.Context, op, prefix string) (string, error) {
+	if value, ok := c.Get(principalKey); ok {
+		prefix = value.(*Principal).scopePrefix(prefix)
+	}
+	return prefix, authorize(c, op, prefix)
+}
+
+func abortError(c *gin.Context, err error) {
+	respondError(c, err)
+	c.Abort()
+}
@@ -0,0 +1,168 @@
+package handler_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func configureAuth(t *testing.T, cfg handler.AuthConfig) {
+	t.Helper()
+	if err := handler.ConfigureAuth(cfg); err != nil {
+		t.Fatalf("ConfigureAuth failed: %v", err)
+	}
+	t.Cleanup(func() { handler.ConfigureAuth(handler.AuthConfig{}) })
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+
+	ctx := context.Background()
+	for _, name := range []string{"public/a.txt", "uploads/b.txt", "private/c.txt"} {
+		if _, err := store.UploadBuffer(ctx, []byte(name), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(keysFile, []byte(`[{"name": "admin", "hash": "`+handler.HashAPIKey("admin-key")+`",
+		"operations": ["list", "upload", "download", "delete", "sign"]}]`), 0o644)
+
+	configureAuth(t, handler.AuthConfig{
+		APIKeysFile: keysFile,
+		APIKeys: []handler.APIKey{
+			{Name: "reader", Hash: handler.HashAPIKey("reader-key"), Operations: []string{"list", "download"}, Folders: []string{"public"}},
+			{Name: "writer", Hash: strings.ToUpper(handler.HashAPIKey("writer-key")), Operations: []string{"upload", "delete", "download"}, Folders: []string{"/uploads/"}},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		status int
+		code   string
+	}{
+		{"missing key", http.MethodGet, "/list-files?folder=public", "", http.StatusUnauthorized, "UNAUTHENTICATED"},
+		{"unknown key", http.MethodGet, "/list-files?folder=public", "bogus", http.StatusUnauthorized, "UNAUTHENTICATED"},
+		{"list own folder", http.MethodGet, "/list-files?folder=public/", "reader-key", http.StatusOK, ""},
+		{"list bucket root", http.MethodGet, "/list-files", "reader-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"list similar prefix", http.MethodGet, "/list-files?folder=publicity", "reader-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"download own folder", http.MethodGet, "/download-file?objectname=public/a.txt", "reader-key", http.StatusOK, ""},
+		{"download other folder", http.MethodGet, "/download-file?objectname=private/c.txt", "reader-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"operation not granted", http.MethodDelete, "/delete-object?objectname=public/a.txt", "reader-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"upload own folder", http.MethodPost, "/upload-buffer?objectname=uploads/new.txt", "writer-key", http.StatusCreated, ""},
+		{"upload other folder", http.MethodPost, "/upload-buffer?objectname=public/new.txt", "writer-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"sign not granted", http.MethodGet, "/object-url?objectname=uploads/b.txt", "writer-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"copy into own folder", http.MethodPost, "/copy?source=uploads/b.txt&destination=uploads/d.txt", "writer-key", http.StatusOK, ""},
+		{"copy out of other folder", http.MethodPost, "/copy?source=private/c.txt&destination=uploads/c.txt", "writer-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"move needs delete on source", http.MethodPost, "/move?source=public/a.txt&destination=public/z.txt", "reader-key", http.StatusForbidden, "PERMISSION_DENIED"},
+		{"delete own folder", http.MethodDelete, "/delete-object?objectname=uploads/b.txt", "writer-key", http.StatusOK, ""},
+		{"admin anywhere", http.MethodDelete, "/delete-object?objectname=private/c.txt", "admin-key", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("data"))
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, res.StatusCode)
+			}
+			if tt.code == "" {
+				res.Body.Close()
+				return
+			}
+			if ar := parseResp(t, res); ar.Code != tt.code || ar.Error == "" {
+				t.Fatalf("expected code %s with an error, got %+v", tt.code, ar)
+			}
+		})
+	}
+
+	t.Run("batch delete checks every name", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/delete-batch", strings.NewReader(`{"names": ["uploads/new.txt", "public/a.txt"]}`))
+		req.Header.Set("X-API-Key", "writer-key")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected 403, got %d", res.StatusCode)
+		}
+		if _, _, err := store.NewReader(ctx, "uploads/new.txt"); err != nil {
+			t.Fatalf("nothing should have been deleted: %v", err)
+		}
+	})
+}
+
+func TestAPIKeySiblingFolder(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+
+	ctx := context.Background()
+	for _, name := range []string{"public/a.txt", "public-secret/s.txt"} {
+		if _, err := store.UploadBuffer(ctx, []byte(name), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	configureAuth(t, handler.AuthConfig{APIKeys: []handler.APIKey{
+		{Name: "public", Hash: handler.HashAPIKey("public-key"), Operations: []string{"list", "delete"}, Folders: []string{"public"}},
+	}})
+
+	do := func(method, path string, body any) (int, apiResp) {
+		t.Helper()
+		res, ar := doRequest(t, method, srv.URL+path, body, map[string]string{"X-API-Key": "public-key"})
+		return res.StatusCode, ar
+	}
+
+	status, ar := do(http.MethodGet, "/list-files?folder=public", nil)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, ar.Error)
+	}
+	if objects, _ := getDataMap(t, ar)["objects"].([]interface{}); len(objects) != 1 {
+		t.Fatalf("expected only the granted folder to be listed, got %v", ar.Data)
+	}
+
+	if status, _ := do(http.MethodPost, "/delete-batch", `{"prefix": "public"}`); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if _, ok := store.Object("public-secret/s.txt"); !ok {
+		t.Fatal("expected the sibling folder to be left alone")
+	}
+	if _, ok := store.Object("public/a.txt"); ok {
+		t.Fatal("expected the granted folder to be emptied")
+	}
+}
+
+func TestConfigureAuthErrors(t *testing.T) {
+	hash := handler.HashAPIKey("key")
+	tests := map[string][]handler.APIKey{
+		"missing name":      {{Hash: hash, Operations: []string{"list"}}},
+		"plain key as hash": {{Name: "a", Hash: "key", Operations: []string{"list"}}},
+		"unknown operation": {{Name: "a", Hash: hash, Operations: []string{"admin"}}},
+		"empty folder":      {{Name: "a", Hash: hash, Operations: []string{"list"}, Folders: []string{"/"}}},
+		"duplicate key":     {{Name: "a", Hash: hash}, {Name: "b", Hash: hash}},
+	}
+	for name, keys := range tests {
+		if err := handler.ConfigureAuth(handler.AuthConfig{APIKeys: keys}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if err := handler.ConfigureAuth(handler.AuthConfig{APIKeysFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Error("expected an error for a missing keys file")
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+)
+
+var batchConcurrency = 8
+
+type BatchConfig struct {
+	Concurrency int
+}
+
+func ConfigureBatches(cfg BatchConfig) {
+	if cfg.Concurrency > 0 {
+		batchConcurrency = cfg.Concurrency
+	}
+}
+
+// ObjectResult reports the outcome of one object in a batch operation.
+type ObjectResult struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination,omitempty"`
+	Generation  int64  `json:"generation,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+}
+
+func (r *ObjectResult) setError(err error) {
+	_, r.Code = errorStatus(err)
+	r.Error = err.Error()
+}
+
+// runBatch calls fn for every index in [0, n) on at most batchConcurrency
+// goroutines and waits for all of them.
+func runBatch(n int, fn func(i int)) {
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// batchStatus is 200 when every object succeeded and 207 otherwise.
+func batchStatus(results []ObjectResult) (int, int) {
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return http.StatusMultiStatus, failed
+	}
+	return http.StatusOK, failed
+}
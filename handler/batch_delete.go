@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchDeleteRequest selects objects either by name or by prefix, which
+// names a folder. Glob is matched with path.Match against the name relative
+// to that folder, and OlderThan is a duration such as "720h" compared with
+// the update time.
+type batchDeleteRequest struct {
+	Names     []string `json:"names"`
+	Prefix    string   `json:"prefix"`
+	Glob      string   `json:"glob"`
+	OlderThan string   `json:"olderThan"`
+	DryRun    bool     `json:"dryRun"`
+}
+
+func BatchDelete(c *gin.Context) {
+	var req batchDeleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, newError(ErrInvalidArgument, "invalid request body: %v", err))
+		return
+	}
+
+	if err := req.clean(); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var err error
+	if len(req.Names) > 0 {
+		err = authorize(c, OpDelete, req.Names...)
+	} else {
+		req.Prefix, err = authorizePrefix(c, OpDelete, req.Prefix)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
+	defer cancel()
+
+	targets, err := batchDeleteTargets(ctx, req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	results := make([]ObjectResult, len(targets))
+	for i, target := range targets {
+		results[i] = ObjectResult{Name: target.Name, Generation: target.Generation}
+	}
+
+	if req.DryRun {
+		c.JSON(http.StatusOK, ApiResponse{Message: fmt.Sprintf("%d objects would be deleted", len(results)), Data: results})
+		return
+	}
+
+	runBatch(len(targets), func(i int) {
+		// Objects found by listing are deleted only if they have not been
+		// overwritten since.
+		conds := Conditions{GenerationMatch: targets[i].Generation}
+		if err := uploader.DeleteObjectIf(ctx, targets[i].Name, conds); err != nil {
+			results[i].setError(err)
+		}
+	})
+
+	status, failed := batchStatus(results)
+	c.JSON(status, ApiResponse{
+		Message: fmt.Sprintf("%d of %d objects deleted", len(results)-failed, len(results)),
+		Data:    results,
+	})
+}
+
+// clean validates the names and the prefix, which is made to
+// end in "/" so that "logs" does not select "logs-old/".
+func (req *batchDeleteRequest) clean() error {
+	for i, name := range req.Names {
+		clean, err := cleanObjectName(name)
+		if err != nil {
+			return err
+		}
+		req.Names[i] = clean
+	}
+
+	prefix, err := cleanPrefix(req.Prefix)
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	req.Prefix = prefix
+	return nil
+}
+
+// batchDeleteTargets resolves a request that clean has validated.
+func batchDeleteTargets(ctx context.Context, req batchDeleteRequest) ([]*ObjectInfo, error) {
+	prefix := req.Prefix
+
+	if len(req.Names) > 0 {
+		if prefix != "" || req.Glob != "" || req.OlderThan != "" {
+			return nil, newError(ErrInvalidArgument, "names cannot be combined with prefix, glob or olderThan")
+		}
+
+		targets := make([]*ObjectInfo, 0, len(req.Names))
+		seen := make(map[string]bool)
+		for _, name := range req.Names {
+			if !seen[name] {
+				seen[name] = true
+				targets = append(targets, &ObjectInfo{Name: name})
+			}
+		}
+		return targets, nil
+	}
+
+	if prefix == "" {
+		return nil, newError(ErrInvalidArgument, "names or prefix is required")
+	}
+	if req.Glob != "" {
+		if _, err := path.Match(req.Glob, ""); err != nil {
+			return nil, newError(ErrInvalidArgument, "invalid glob %q", req.Glob)
+		}
+	}
+	var cutoff time.Time
+	if req.OlderThan != "" {
+		age, err := time.ParseDuration(req.OlderThan)
+		if err != nil || age <= 0 {
+			return nil, newError(ErrInvalidArgument, "olderThan must be a positive duration such as 720h")
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	var targets []*ObjectInfo
+	opts := ListOptions{Prefix: prefix, PageSize: maxListPageSize}
+	for {
+		page, err := uploader.ListObjectsPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range page.Objects {
+			if req.Glob != "" {
+				if matched, _ := path.Match(req.Glob, strings.TrimPrefix(info.Name, prefix)); !matched {
+					continue
+				}
+			}
+			if !cutoff.IsZero() && !info.Updated.Before(cutoff) {
+				continue
+			}
+			targets = append(targets, info)
+		}
+
+		if page.NextPageToken == "" {
+			return targets, nil
+		}
+		opts.PageToken = page.NextPageToken
+	}
+}
@@ -0,0 +1,133 @@
+package handler_test
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gcsuploader/handler"
+)
+
+func resultNames(t *testing.T, ar apiResp) []string {
+	t.Helper()
+	results, _ := ar.Data.([]interface{})
+	var names []string
+	for _, r := range results {
+		names = append(names, r.(map[string]interface{})["name"].(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBatchDelete(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			for _, objectname := range []string{"logs/a.log", "logs/b.log", "logs/c.txt", "logs/old/d.log", "keep/e.log"} {
+				if _, err := store.UploadBuffer(t.Context(), []byte(objectname), objectname, 0, nil); err != nil {
+					t.Fatalf("UploadBuffer failed: %v", err)
+				}
+			}
+			srv := newTestServer(t, store)
+			remaining := func() []string {
+				t.Helper()
+				names, err := store.ListObjects(t.Context(), "")
+				if err != nil {
+					t.Fatalf("ListObjects failed: %v", err)
+				}
+				return names
+			}
+
+			res, ar := doRequest(t, http.MethodPost, srv.URL+"/delete-batch", map[string]any{"prefix": "logs/", "glob": "*.log", "dryRun": true}, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("dry run: expected 200, got %d", res.StatusCode)
+			}
+			if got := strings.Join(resultNames(t, ar), ","); got != "logs/a.log,logs/b.log" {
+				t.Fatalf("dry run selected %q", got)
+			}
+			if n := len(remaining()); n != 5 {
+				t.Fatalf("dry run deleted objects, %d remain", n)
+			}
+
+			res, _ = doRequest(t, http.MethodPost, srv.URL+"/delete-batch", map[string]any{"prefix": "logs/", "glob": "*.log"}, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("prefix delete: expected 200, got %d", res.StatusCode)
+			}
+			if got := strings.Join(remaining(), ","); got != "keep/e.log,logs/c.txt,logs/old/d.log" {
+				t.Fatalf("after prefix delete %q remain", got)
+			}
+
+			res, ar = doRequest(t, http.MethodPost, srv.URL+"/delete-batch", map[string]any{"names": []string{"logs/c.txt", "logs/missing.txt"}}, nil)
+			if res.StatusCode != http.StatusMultiStatus {
+				t.Fatalf("names delete with a missing object: expected 207, got %d", res.StatusCode)
+			}
+			for _, r := range ar.Data.([]interface{}) {
+				result := r.(map[string]interface{})
+				if (result["code"] == "NOT_FOUND") != (result["name"] == "logs/missing.txt") {
+					t.Fatalf("unexpected result %v", result)
+				}
+			}
+
+			for _, body := range []map[string]any{
+				{},
+				{"names": []string{"a"}, "prefix": "logs/"},
+				{"prefix": "logs/", "glob": "["},
+				{"prefix": "logs/", "olderThan": "soon"},
+			} {
+				if res, _ := doRequest(t, http.MethodPost, srv.URL+"/delete-batch", body, nil); res.StatusCode != http.StatusBadRequest {
+					t.Fatalf("%v: expected 400, got %d", body, res.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchDeleteFolder(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	for _, objectname := range []string{"firmware/a.bin", "firmware/b.txt", "firmware-old/c.bin"} {
+		if _, err := store.UploadBuffer(t.Context(), []byte(objectname), objectname, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	srv := newTestServer(t, store)
+
+	for _, tt := range []struct {
+		body  map[string]any
+		names string
+	}{
+		{map[string]any{"prefix": "firmware", "glob": "*.bin", "dryRun": true}, "firmware/a.bin"},
+		{map[string]any{"prefix": "firmware", "dryRun": true}, "firmware/a.bin,firmware/b.txt"},
+	} {
+		res, ar := doRequest(t, http.MethodPost, srv.URL+"/delete-batch", tt.body, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %d: %s", tt.body, res.StatusCode, ar.Error)
+		}
+		if got := strings.Join(resultNames(t, ar), ","); got != tt.names {
+			t.Fatalf("%v: selected %q, want %q", tt.body, got, tt.names)
+		}
+	}
+}
+
+func TestBatchDeleteOlderThan(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	now := time.Now()
+
+	store.SetClock(func() time.Time { return now.Add(-48 * time.Hour) })
+	store.UploadBuffer(t.Context(), []byte("old"), "logs/old.log", 0, nil)
+	store.SetClock(func() time.Time { return now })
+	store.UploadBuffer(t.Context(), []byte("new"), "logs/new.log", 0, nil)
+
+	srv := newTestServer(t, store)
+	res, ar := doRequest(t, http.MethodPost, srv.URL+"/delete-batch", map[string]any{"prefix": "logs/", "olderThan": "24h"}, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if got := strings.Join(resultNames(t, ar), ","); got != "logs/old.log" {
+		t.Fatalf("deleted %q", got)
+	}
+	if _, ok := store.Object("logs/new.log"); !ok {
+		t.Fatal("recent object was deleted")
+	}
+}
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrCorruptObject marks a stored object whose content does not match
+	// its hashes when it is read back, which is the backend's fault rather
+	// than the caller's.
+	ErrCorruptObject = errors.New("corrupt object")
+)
+
+func encodeCRC32C(crc uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func decodeCRC32C(encoded string) (uint32, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(b) != 4 {
+		return 0, newError(ErrInvalidArgument, "invalid crc32c %q: expected base64 of 4 bytes", encoded)
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func decodeMD5(encoded string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(b) != md5.Size {
+		return nil, newError(ErrInvalidArgument, "invalid md5 %q: expected base64 of %d bytes", encoded, md5.Size)
+	}
+	return b, nil
+}
+
+// parseChecksums fills opts from an x-goog-hash style value
+// ("crc32c=<b64>,md5=<b64>") and explicit md5/crc32c values; explicit values
+// win over the hash header.
+func parseChecksums(opts *UploadOptions, googHash, md5Value, crc32cValue string) error {
+	for _, part := range strings.Split(googHash, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "md5":
+			if md5Value == "" {
+				md5Value = value
+			}
+		case "crc32c":
+			if crc32cValue == "" {
+				crc32cValue = value
+			}
+		}
+	}
+
+	if md5Value != "" {
+		sum, err := decodeMD5(md5Value)
+		if err != nil {
+			return err
+		}
+		opts.MD5 = sum
+	}
+	if crc32cValue != "" {
+		crc, err := decodeCRC32C(crc32cValue)
+		if err != nil {
+			return err
+		}
+		opts.CRC32C = crc
+		opts.SendCRC32C = true
+	}
+	return nil
+}
+
+func (opts UploadOptions) hasChecksums() bool {
+	return opts.MD5 != nil || opts.SendCRC32C
+}
+
+// objectHasher computes the hashes GCS keeps for an object while its content
+// is written, for backends that have to produce them themselves.
+type objectHasher struct {
+	md5    hash.Hash
+	crc32c hash.Hash32
+}
+
+func newObjectHasher() *objectHasher {
+	return &objectHasher{md5: md5.New(), crc32c: crc32.New(castagnoliTable)}
+}
+
+func (h *objectHasher) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	h.crc32c.Write(p)
+	return len(p), nil
+}
+
+func (h *objectHasher) verify(opts UploadOptions) error {
+	if opts.MD5 != nil && !bytes.Equal(opts.MD5, h.md5.Sum(nil)) {
+		return fmt.Errorf("%w: md5 %s does not match provided %s", ErrChecksumMismatch,
+			base64.StdEncoding.EncodeToString(h.md5.Sum(nil)), base64.StdEncoding.EncodeToString(opts.MD5))
+	}
+	if opts.SendCRC32C && opts.CRC32C != h.crc32c.Sum32() {
+		return fmt.Errorf("%w: crc32c %s does not match provided %s", ErrChecksumMismatch,
+			encodeCRC32C(h.crc32c.Sum32()), encodeCRC32C(opts.CRC32C))
+	}
+	return nil
+}
+
+// sums returns the MD5 and the encoded CRC32C of everything written.
+func (h *objectHasher) sums() ([]byte, string) {
+	return h.md5.Sum(nil), encodeCRC32C(h.crc32c.Sum32())
+}
+
+// checksumReader verifies the CRC32C of everything read through it against
+// want. It holds back the final byte until the check passes, so a corrupted
+// body is never handed on as a complete stream.
+type checksumReader struct {
+	r       io.Reader
+	want    string
+	crc     hash.Hash32
+	pending []byte
+	err     error
+}
+
+func newChecksumReader(r io.Reader, want string) *checksumReader {
+	return &checksumReader{r: r, want: want, crc: crc32.New(castagnoliTable), pending: make([]byte, 0, 1)}
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := cr.r.Read(p)
+	cr.crc.Write(p[:n])
+
+	out := 0
+	if n > 0 {
+		last := p[n-1]
+		if len(cr.pending) > 0 {
+			copy(p[1:n], p[:n-1])
+			p[0] = cr.pending[0]
+			out = n
+		} else {
+			out = n - 1
+		}
+		cr.pending = append(cr.pending[:0], last)
+	}
+
+	if err == io.EOF {
+		if got := encodeCRC32C(cr.crc.Sum32()); got != cr.want {
+			cr.err = withKind(ErrCorruptObject, fmt.Errorf("%w: crc32c %s does not match expected %s", ErrChecksumMismatch, got, cr.want))
+			return out, cr.err
+		}
+		if len(cr.pending) > 0 {
+			if out == len(p) {
+				return out, nil
+			}
+			p[out] = cr.pending[0]
+			out++
+			cr.pending = cr.pending[:0]
+		}
+		cr.err = io.EOF
+		return out, io.EOF
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return out, err
+}
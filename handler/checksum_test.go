@@ -0,0 +1,175 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func md5Base64(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func crc32cBase64(data []byte) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// corruptStore serves every object with its first byte flipped while still
+// reporting the original hashes, like a bit flip in transit.
+type corruptStore struct {
+	*handler.MemoryStore
+}
+
+func (s corruptStore) NewReader(ctx context.Context, objectname string) (io.ReadCloser, *handler.ObjectInfo, error) {
+	return s.NewRangeReader(ctx, objectname, 0, -1)
+}
+
+func (s corruptStore) NewRangeReader(ctx context.Context, objectname string, offset, length int64) (io.ReadCloser, *handler.ObjectInfo, error) {
+	r, info, err := s.MemoryStore.NewRangeReader(ctx, objectname, offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	return io.NopCloser(bytes.NewReader(data)), info, nil
+}
+
+func TestUploadChecksums(t *testing.T) {
+	content := []byte("firmware payload")
+
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, newStore(t))
+
+			upload := func(objectname string, headers map[string]string) *http.Response {
+				req, _ := http.NewRequest(http.MethodPost, srv.URL+"/upload-buffer?objectname="+objectname, bytes.NewReader(content))
+				for k, v := range headers {
+					req.Header.Set(k, v)
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				return res
+			}
+
+			res := upload("fw/good.bin", map[string]string{
+				"Content-MD5": md5Base64(content),
+				"X-Goog-Hash": "crc32c=" + crc32cBase64(content),
+			})
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("expected 201, got %d", res.StatusCode)
+			}
+			data := getDataMap(t, parseResp(t, res))
+			if data["md5"] != md5Base64(content) || data["crc32c"] != crc32cBase64(content) {
+				t.Fatalf("expected hashes in response, got %v", data)
+			}
+
+			res = upload("fw/bad-md5.bin", map[string]string{"Content-MD5": md5Base64([]byte("other"))})
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400 for md5 mismatch, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+
+			res = upload("fw/bad-crc.bin", map[string]string{"X-Goog-Hash": "crc32c=" + crc32cBase64([]byte("other"))})
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400 for crc32c mismatch, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+
+			res = upload("fw/malformed.bin", map[string]string{"Content-MD5": "not-base64"})
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400 for malformed md5, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+
+			res, err := http.Get(srv.URL + "/list-files?folder=fw/")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if files := getDataMap(t, parseResp(t, res))["objects"].([]interface{}); len(files) != 1 {
+				t.Fatalf("expected only the verified upload to be stored, got %v", files)
+			}
+
+			body, contentType := multipartBody(t, map[string]string{"folder": "fw", "crc32c": crc32cBase64([]byte("other"))}, "form.bin", content)
+			res, err = http.Post(srv.URL+"/upload-file", contentType, body)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400 for form crc32c mismatch, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestDownloadChecksums(t *testing.T) {
+	content := []byte("firmware payload")
+	store := handler.NewMemoryStore(testBucket)
+	if _, err := store.UploadBuffer(context.Background(), content, "fw/image.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+
+	srv := newTestServer(t, store)
+	res, err := http.Get(srv.URL + "/download-file?objectname=fw/image.bin")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	res.Body.Close()
+	want := "crc32c=" + crc32cBase64(content) + ",md5=" + md5Base64(content)
+	if res.Header.Get("X-Goog-Hash") != want {
+		t.Fatalf("expected X-Goog-Hash %q, got %q", want, res.Header.Get("X-Goog-Hash"))
+	}
+
+	root := newDownloadRoot(t)
+	res, err = http.Get(srv.URL + "/download-file?objectname=fw/image.bin&destination=.")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	data := getDataMap(t, parseResp(t, res))
+	if data["crc32c"] != crc32cBase64(content) {
+		t.Fatalf("expected crc32c in response, got %v", data)
+	}
+
+	corrupt := newTestServer(t, corruptStore{store})
+
+	res, err = http.Get(corrupt.URL + "/download-file?objectname=fw/image.bin")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil {
+		t.Fatal("expected a truncated body for corrupted content")
+	}
+
+	os.Remove(filepath.Join(root, "image.bin"))
+	res, err = http.Get(corrupt.URL + "/download-file?objectname=fw/image.bin&destination=.")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 for corrupted download, got %d", res.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(root, "image.bin")); !os.IsNotExist(err) {
+		t.Fatalf("expected corrupted file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Conditions are generation preconditions on a write or delete. Zero fields
+// are unset. At most one of GenerationMatch, GenerationNotMatch and
+// DoesNotExist may be set.
+type Conditions struct {
+	GenerationMatch     int64
+	GenerationNotMatch  int64
+	DoesNotExist        bool
+	MetagenerationMatch int64
+}
+
+func (c Conditions) isZero() bool {
+	return c == Conditions{}
+}
+
+func (c Conditions) storageConditions() storage.Conditions {
+	return storage.Conditions{
+		GenerationMatch:     c.GenerationMatch,
+		GenerationNotMatch:  c.GenerationNotMatch,
+		DoesNotExist:        c.DoesNotExist,
+		MetagenerationMatch: c.MetagenerationMatch,
+	}
+}
+
+// check evaluates the conditions against the live object, which is nil when
+// the object does not exist.
+func (c Conditions) check(objectname string, current *ObjectInfo) error {
+	switch {
+	case c.DoesNotExist && current != nil:
+	case c.GenerationMatch != 0 && (current == nil || current.Generation != c.GenerationMatch):
+	case c.GenerationNotMatch != 0 && current != nil && current.Generation == c.GenerationNotMatch:
+	case c.MetagenerationMatch != 0 && (current == nil || current.Metageneration != c.MetagenerationMatch):
+	default:
+		return nil
+	}
+	return newError(ErrPreconditionFailed, "precondition failed for object %q", objectname)
+}
+
+// requestConditions reads If-Match and If-None-Match (a generation, as
+// returned in ETag, or "*") and the ifGenerationMatch and
+// ifMetagenerationMatch query parameters. If-Match: * is pinned to the live
+// generation, so a write racing with another one still fails.
+func requestConditions(ctx context.Context, c *gin.Context, objectname string) (Conditions, error) {
+	var conds Conditions
+	var mustExist bool
+	generationConditions := 0
+
+	if value := strings.TrimSpace(c.GetHeader("If-Match")); value != "" {
+		if value == "*" {
+			mustExist = true
+		} else {
+			generation, err := parseGenerationTag(value)
+			if err != nil {
+				return conds, err
+			}
+			conds.GenerationMatch = generation
+			generationConditions++
+		}
+	}
+
+	if value := strings.TrimSpace(c.GetHeader("If-None-Match")); value != "" {
+		if value == "*" {
+			conds.DoesNotExist = true
+		} else {
+			generation, err := parseGenerationTag(value)
+			if err != nil {
+				return conds, err
+			}
+			conds.GenerationNotMatch = generation
+		}
+		generationConditions++
+	}
+
+	if value := c.Query("ifGenerationMatch"); value != "" {
+		generation, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || generation < 0 {
+			return conds, newError(ErrInvalidArgument, "ifGenerationMatch must be a non-negative integer")
+		}
+		// As in the GCS API, a generation of 0 matches only a missing object.
+		if generation == 0 {
+			conds.DoesNotExist = true
+		} else {
+			conds.GenerationMatch = generation
+		}
+		generationConditions++
+	}
+
+	if value := c.Query("ifMetagenerationMatch"); value != "" {
+		metageneration, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || metageneration <= 0 {
+			return conds, newError(ErrInvalidArgument, "ifMetagenerationMatch must be a positive integer")
+		}
+		conds.MetagenerationMatch = metageneration
+	}
+
+	if generationConditions > 1 || (mustExist && conds.DoesNotExist) {
+		return conds, newError(ErrInvalidArgument, "only one generation precondition may be given")
+	}
+
+	if mustExist && conds.GenerationMatch == 0 {
+		info, err := uploader.StatObject(ctx, objectname)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return conds, newError(ErrPreconditionFailed, "precondition failed for object %q", objectname)
+			}
+			return conds, err
+		}
+		conds.GenerationMatch = info.Generation
+	}
+	return conds, nil
+}
+
+func parseGenerationTag(value string) (int64, error) {
+	generation, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || generation <= 0 {
+		return 0, newError(ErrInvalidArgument, "invalid generation precondition %q", value)
+	}
+	return generation, nil
+}
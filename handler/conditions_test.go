@@ -0,0 +1,91 @@
+package handler_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestPreconditions(t *testing.T) {
+	const objectname = "fw/release.bin"
+
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, newStore(t))
+
+			do := func(method, path string, headers map[string]string, body []byte) *http.Response {
+				t.Helper()
+				req, _ := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+				for k, v := range headers {
+					req.Header.Set(k, v)
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				res.Body.Close()
+				return res
+			}
+			upload := func(query string, headers map[string]string) int {
+				t.Helper()
+				return do(http.MethodPost, "/upload-buffer?objectname="+objectname+query, headers, []byte("payload")).StatusCode
+			}
+			etag := func() string {
+				t.Helper()
+				return do(http.MethodGet, "/download-file?objectname="+objectname, nil, nil).Header.Get("ETag")
+			}
+
+			if status := upload("", map[string]string{"If-Match": "*"}); status != http.StatusPreconditionFailed {
+				t.Fatalf("If-Match * on a missing object: expected 412, got %d", status)
+			}
+			if status := upload("", map[string]string{"If-None-Match": "*"}); status != http.StatusCreated {
+				t.Fatalf("If-None-Match * on a missing object: expected 201, got %d", status)
+			}
+			if status := upload("", map[string]string{"If-None-Match": "*"}); status != http.StatusPreconditionFailed {
+				t.Fatalf("If-None-Match * on an existing object: expected 412, got %d", status)
+			}
+			if status := upload("&ifGenerationMatch=0", nil); status != http.StatusPreconditionFailed {
+				t.Fatalf("ifGenerationMatch=0 on an existing object: expected 412, got %d", status)
+			}
+
+			stale := etag()
+			if status := upload("", map[string]string{"If-Match": stale}); status != http.StatusCreated {
+				t.Fatalf("If-Match with the current generation: expected 201, got %d", status)
+			}
+			if status := upload("", map[string]string{"If-Match": stale}); status != http.StatusPreconditionFailed {
+				t.Fatalf("If-Match with a stale generation: expected 412, got %d", status)
+			}
+			if status := upload("", map[string]string{"If-Match": "*"}); status != http.StatusCreated {
+				t.Fatalf("If-Match * on an existing object: expected 201, got %d", status)
+			}
+			if status := upload("&ifMetagenerationMatch=1", nil); status != http.StatusCreated {
+				t.Fatalf("ifMetagenerationMatch=1: expected 201, got %d", status)
+			}
+			if status := upload("&ifMetagenerationMatch=5", nil); status != http.StatusPreconditionFailed {
+				t.Fatalf("ifMetagenerationMatch=5: expected 412, got %d", status)
+			}
+
+			if status := upload("", map[string]string{"If-Match": "abc"}); status != http.StatusBadRequest {
+				t.Fatalf("malformed If-Match: expected 400, got %d", status)
+			}
+			if status := upload("&ifGenerationMatch=1", map[string]string{"If-Match": etag()}); status != http.StatusBadRequest {
+				t.Fatalf("conflicting preconditions: expected 400, got %d", status)
+			}
+
+			body, contentType := multipartBody(t, map[string]string{"folder": "fw"}, "release.bin", []byte("payload"))
+			res := do(http.MethodPost, "/upload-file", map[string]string{"Content-Type": contentType, "If-None-Match": "*"}, body.Bytes())
+			if res.StatusCode != http.StatusPreconditionFailed {
+				t.Fatalf("upload-file If-None-Match * on an existing object: expected 412, got %d", res.StatusCode)
+			}
+
+			res = do(http.MethodDelete, "/delete-object?objectname="+objectname, map[string]string{"If-Match": stale}, nil)
+			if res.StatusCode != http.StatusPreconditionFailed {
+				t.Fatalf("delete with a stale generation: expected 412, got %d", res.StatusCode)
+			}
+			res = do(http.MethodDelete, "/delete-object?objectname="+objectname, map[string]string{"If-Match": etag()}, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("delete with the current generation: expected 200, got %d", res.StatusCode)
+			}
+		})
+	}
+}
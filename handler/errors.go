@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	ErrNotFound             = errors.New("not found")
+	ErrPreconditionFailed   = errors.New("precondition failed")
+	ErrUnauthenticated      = errors.New("unauthenticated")
+	ErrPermissionDenied     = errors.New("permission denied")
+	ErrInvalidArgument      = errors.New("invalid argument")
+	ErrTimeout              = errors.New("timeout")
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+	ErrTooLarge             = errors.New("too large")
+	ErrConflict             = errors.New("conflict")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrNotSupported         = errors.New("not supported")
+	ErrAborted              = errors.New("aborted")
+)
+
+// errorCodes maps each error kind to its HTTP status and the code reported
+// in ApiResponse. The first match wins.
+var errorCodes = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{ErrNotFound, http.StatusNotFound, "NOT_FOUND"},
+	{ErrPreconditionFailed, http.StatusPreconditionFailed, "PRECONDITION_FAILED"},
+	{ErrUnauthenticated, http.StatusUnauthorized, "UNAUTHENTICATED"},
+	{ErrPermissionDenied, http.StatusForbidden, "PERMISSION_DENIED"},
+	{ErrInvalidArgument, http.StatusBadRequest, "INVALID_ARGUMENT"},
+	{ErrCorruptObject, http.StatusBadGateway, "CHECKSUM_MISMATCH"},
+	{ErrChecksumMismatch, http.StatusBadRequest, "CHECKSUM_MISMATCH"},
+	{ErrTimeout, http.StatusGatewayTimeout, "TIMEOUT"},
+	{ErrQuotaExceeded, http.StatusTooManyRequests, "QUOTA_EXCEEDED"},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge, "TOO_LARGE"},
+	{ErrConflict, http.StatusConflict, "CONFLICT"},
+	{ErrAborted, http.StatusConflict, "ABORTED"},
+	{ErrUnsupportedMediaType, http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE"},
+	{errUnsatisfiableRange, http.StatusRequestedRangeNotSatisfiable, "RANGE_NOT_SATISFIABLE"},
+	{ErrNotSupported, http.StatusNotImplemented, "NOT_SUPPORTED"},
+}
+
+// kindError tags an error with one of the kinds above while keeping the
+// original message and the wrapped storage error reachable via errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+func newError(kind error, format string, args ...any) error {
+	return &kindError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// classifyError tags storage, googleapi and context errors with a kind.
+// Errors that already carry a kind, or that cannot be classified, are
+// returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.kind) {
+			return err
+		}
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return withKind(ErrNotFound, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return withKind(ErrTimeout, err)
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.Code {
+	case http.StatusBadRequest:
+		return withKind(ErrInvalidArgument, err)
+	case http.StatusUnauthorized:
+		return withKind(ErrPermissionDenied, err)
+	case http.StatusForbidden:
+		for _, item := range apiErr.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+				return withKind(ErrQuotaExceeded, err)
+			}
+		}
+		return withKind(ErrPermissionDenied, err)
+	case http.StatusNotFound:
+		return withKind(ErrNotFound, err)
+	case http.StatusRequestTimeout:
+		return withKind(ErrTimeout, err)
+	case http.StatusPreconditionFailed:
+		return withKind(ErrPreconditionFailed, err)
+	case http.StatusTooManyRequests:
+		return withKind(ErrQuotaExceeded, err)
+	}
+	return err
+}
+
+func errorStatus(err error) (int, string) {
+	err = classifyError(err)
+	for _, e := range errorCodes {
+		if errors.Is(err, e.kind) {
+			return e.status, e.code
+		}
+	}
+	return http.StatusInternalServerError, "INTERNAL"
+}
+
+func respondError(c *gin.Context, err error) {
+	status, code := errorStatus(err)
+	c.JSON(status, ApiResponse{Error: err.Error(), Code: code})
+}
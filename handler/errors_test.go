@@ -0,0 +1,101 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gcsuploader/handler"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+func TestNotFoundErrors(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+
+			if err := store.DeleteObject(t.Context(), "missing/object.bin"); !errors.Is(err, handler.ErrNotFound) {
+				t.Fatalf("DeleteObject error = %v, want ErrNotFound", err)
+			}
+			if _, _, err := store.NewReader(t.Context(), "missing/object.bin"); !errors.Is(err, handler.ErrNotFound) {
+				t.Fatalf("NewReader error = %v, want ErrNotFound", err)
+			}
+
+			srv := newTestServer(t, store)
+
+			req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/delete-object?objectname=missing/object.bin", nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404 for delete, got %d", res.StatusCode)
+			}
+			if ar := parseResp(t, res); ar.Code != "NOT_FOUND" {
+				t.Fatalf("expected NOT_FOUND code, got %q", ar.Code)
+			}
+
+			newDownloadRoot(t)
+			for _, query := range []string{"", "&destination=."} {
+				res, err = http.Get(srv.URL + "/download-file?objectname=missing/object.bin" + query)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				if res.StatusCode != http.StatusNotFound {
+					t.Fatalf("expected 404 for download%s, got %d", query, res.StatusCode)
+				}
+				if ar := parseResp(t, res); ar.Code != "NOT_FOUND" {
+					t.Fatalf("expected NOT_FOUND code, got %q", ar.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"object not exist", storage.ErrObjectNotExist, http.StatusNotFound, "NOT_FOUND"},
+		{"bucket not exist", storage.ErrBucketNotExist, http.StatusNotFound, "NOT_FOUND"},
+		{"googleapi 404", &googleapi.Error{Code: http.StatusNotFound}, http.StatusNotFound, "NOT_FOUND"},
+		{"precondition", &googleapi.Error{Code: http.StatusPreconditionFailed}, http.StatusPreconditionFailed, "PRECONDITION_FAILED"},
+		{"forbidden", &googleapi.Error{Code: http.StatusForbidden}, http.StatusForbidden, "PERMISSION_DENIED"},
+		{"unauthorized", &googleapi.Error{Code: http.StatusUnauthorized}, http.StatusForbidden, "PERMISSION_DENIED"},
+		{"bad request", &googleapi.Error{Code: http.StatusBadRequest}, http.StatusBadRequest, "INVALID_ARGUMENT"},
+		{"rate limited", &googleapi.Error{Code: http.StatusTooManyRequests}, http.StatusTooManyRequests, "QUOTA_EXCEEDED"},
+		{"quota reason", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, http.StatusTooManyRequests, "QUOTA_EXCEEDED"},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, "TIMEOUT"},
+		{"typed", handler.ErrPreconditionFailed, http.StatusPreconditionFailed, "PRECONDITION_FAILED"},
+		{"checksum", handler.ErrChecksumMismatch, http.StatusBadRequest, "CHECKSUM_MISMATCH"},
+		{"corrupt object", fmt.Errorf("%w: %w", handler.ErrCorruptObject, handler.ErrChecksumMismatch), http.StatusBadGateway, "CHECKSUM_MISMATCH"},
+		{"unknown", errors.New("backend unavailable"), http.StatusInternalServerError, "INTERNAL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := handler.NewMemoryStore(testBucket)
+			srv := newTestServer(t, store)
+			store.InjectFailure("DeleteObject", tt.err, 1)
+
+			req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/delete-object?objectname=any.bin", nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, res.StatusCode)
+			}
+			if ar := parseResp(t, res); ar.Code != tt.code {
+				t.Fatalf("expected code %q, got %q", tt.code, ar.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	extractMaxEntries         = 10000
+	extractMaxEntrySize int64 = 1 << 30
+	extractMaxTotalSize int64 = 10 << 30
+)
+
+// ExtractConfig limits what an archive uploaded in extract mode may expand
+// to. Sizes are of the extracted content, not of the compressed archive.
+type ExtractConfig struct {
+	MaxEntries   int
+	MaxEntrySize int64
+	MaxTotalSize int64
+}
+
+func ConfigureExtraction(cfg ExtractConfig) {
+	if cfg.MaxEntries > 0 {
+		extractMaxEntries = cfg.MaxEntries
+	}
+	if cfg.MaxEntrySize > 0 {
+		extractMaxEntrySize = cfg.MaxEntrySize
+	}
+	if cfg.MaxTotalSize > 0 {
+		extractMaxTotalSize = cfg.MaxTotalSize
+	}
+}
+
+// extractEntry is one file or directory read from an uploaded archive. Its
+// content can only be opened until the next entry is read.
+type extractEntry struct {
+	name    string
+	size    int64
+	dir     bool
+	regular bool
+	open    func() (io.ReadCloser, error)
+}
+
+// archiveReader yields the entries of an archive in order and returns io.EOF
+// after the last one.
+type archiveReader interface {
+	next() (*extractEntry, error)
+}
+
+type zipReader struct {
+	files []*zip.File
+}
+
+func (r *zipReader) next() (*extractEntry, error) {
+	if len(r.files) == 0 {
+		return nil, io.EOF
+	}
+	f := r.files[0]
+	r.files = r.files[1:]
+	mode := f.Mode()
+	return &extractEntry{
+		name:    f.Name,
+		size:    int64(f.UncompressedSize64),
+		dir:     mode.IsDir() || strings.HasSuffix(f.Name, "/"),
+		regular: mode.IsRegular(),
+		open:    f.Open,
+	}, nil
+}
+
+type tarReader struct {
+	tr *tar.Reader
+}
+
+func (r *tarReader) next() (*extractEntry, error) {
+	for {
+		hdr, err := r.tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		mode := hdr.FileInfo().Mode()
+		return &extractEntry{
+			name:    hdr.Name,
+			size:    hdr.Size,
+			dir:     mode.IsDir(),
+			regular: mode.IsRegular(),
+			open:    func() (io.ReadCloser, error) { return io.NopCloser(r.tr), nil },
+		}, nil
+	}
+}
+
+// openArchive detects the format of an uploaded archive from its first bytes:
+// zip, gzip-compressed tar or plain tar. The closer, if any, must be closed
+// once extraction is done.
+func openArchive(src multipart.File, size int64) (archiveReader, io.Closer, error) {
+	head := make([]byte, 262)
+	n, err := src.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		zr, err := zip.NewReader(src, size)
+		if err != nil {
+			return nil, nil, newError(ErrInvalidArgument, "invalid zip archive: %v", err)
+		}
+		return &zipReader{files: zr.File}, nil, nil
+	case bytes.HasPrefix(head, []byte("\x1f\x8b")):
+		gz, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(src, 0, size)))
+		if err != nil {
+			return nil, nil, newError(ErrInvalidArgument, "invalid gzip archive: %v", err)
+		}
+		return &tarReader{tr: tar.NewReader(gz)}, gz, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return &tarReader{tr: tar.NewReader(io.NewSectionReader(src, 0, size))}, nil, nil
+	}
+	return nil, nil, newError(ErrUnsupportedMediaType, "unsupported archive format: upload a zip, tar or tar.gz file")
+}
+
+// extractArchive uploads every file in an archive under folder, one entry at
+// a time, and reports the outcome of each. The form's cache control and
+// custom metadata apply to every entry; the content type is detected per
+// entry. Preconditions of the request are checked against each entry's
+// object.
+func extractArchive(c *gin.Context, folder string, file *multipart.FileHeader, opts UploadOptions) {
+	src, err := file.Open()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer src.Close()
+
+	if opts.hasChecksums() {
+		if err := verifyArchive(src, opts); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+
+	entries, closer, err := openArchive(src, file.Size)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
+	defer cancel()
+
+	attrs := sharedAttrs(opts.Attrs)
+	results := []ObjectResult{}
+	seen := make(map[string]bool)
+	var total int64
+	var stopped error
+	for {
+		entry, err := entries.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stopped = newError(ErrInvalidArgument, "invalid archive: %v", err)
+			break
+		}
+		if entry.dir {
+			continue
+		}
+		if len(results) == extractMaxEntries {
+			stopped = newError(ErrTooLarge, "archive has more than %d entries", extractMaxEntries)
+			break
+		}
+
+		result := ObjectResult{Name: entry.name}
+		n, err := extractFile(ctx, c, folder, entry, attrs, extractMaxTotalSize-total, seen, &result)
+		total += n
+		if err != nil {
+			result.setError(err)
+		}
+		results = append(results, result)
+
+		if total > extractMaxTotalSize || err != nil && ctx.Err() != nil {
+			stopped = err
+			break
+		}
+	}
+	if stopped != nil && len(results) == 0 {
+		respondError(c, stopped)
+		return
+	}
+
+	status, failed := batchStatus(results)
+	message := fmt.Sprintf("%d of %d entries extracted", len(results)-failed, len(results))
+	if stopped != nil {
+		status = http.StatusMultiStatus
+		message += fmt.Sprintf("; extraction stopped: %v", stopped)
+	}
+	c.JSON(status, ApiResponse{Message: message, Data: results})
+}
+
+// extractFile uploads one archive entry, reading at most budget bytes of it,
+// and returns how many bytes it read. seen holds the objects named by earlier
+// entries, which a later one may not overwrite.
+func extractFile(ctx context.Context, c *gin.Context, folder string, entry *extractEntry, attrs ObjectAttrs, budget int64, seen map[string]bool, result *ObjectResult) (int64, error) {
+	if !entry.regular {
+		return 0, newError(ErrInvalidArgument, "entry %q is not a regular file", entry.name)
+	}
+	objectname, err := relativeObjectName(folder, entry.name)
+	if err != nil {
+		return 0, err
+	}
+	result.Destination = objectname
+	if seen[objectname] {
+		return 0, newError(ErrInvalidArgument, "%q appears more than once in the archive", objectname)
+	}
+	seen[objectname] = true
+
+	if err := authorize(c, OpUpload, objectname); err != nil {
+		return 0, err
+	}
+	conds, err := requestConditions(ctx, c, objectname)
+	if err != nil {
+		return 0, err
+	}
+	if entry.size > extractMaxEntrySize {
+		return 0, extractTooLarge(extractMaxEntrySize)
+	}
+	if entry.size > budget {
+		return entry.size, newError(ErrTooLarge, "archive expands to more than %d bytes", extractMaxTotalSize)
+	}
+
+	body, err := entry.open()
+	if err != nil {
+		return 0, newError(ErrInvalidArgument, "invalid archive entry %q: %v", entry.name, err)
+	}
+	defer body.Close()
+
+	limited := &extractLimitReader{r: body, entryMax: extractMaxEntrySize, totalMax: budget}
+	opts := UploadOptions{ChunkSize: uploadChunkSize, Attrs: attrs, Conditions: conds}
+	policy := policyFor(objectname)
+	reader, err := policy.checkUpload(objectname, entry.size, limited, &opts.Conditions)
+	if err == nil {
+		reader, err = detectContentType(objectname, &opts.Attrs, reader)
+	}
+	if err != nil {
+		return limited.read, err
+	}
+
+	info, err := uploader.UploadStream(ctx, reader, objectname, opts)
+	if err != nil {
+		return limited.read, policy.uploadError(objectname, err)
+	}
+	result.Generation = info.Generation
+	return limited.read, nil
+}
+
+func extractTooLarge(limit int64) error {
+	return newError(ErrTooLarge, "archive entries may expand to at most %d bytes", limit)
+}
+
+// extractLimitReader fails an entry as soon as it expands past the per-entry
+// limit or the remaining total, whatever size the archive declared for it.
+type extractLimitReader struct {
+	r        io.Reader
+	entryMax int64
+	totalMax int64
+	read     int64
+}
+
+func (l *extractLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.entryMax {
+		return 0, extractTooLarge(l.entryMax)
+	}
+	if l.read > l.totalMax {
+		return 0, newError(ErrTooLarge, "archive expands to more than %d bytes", extractMaxTotalSize)
+	}
+	return n, err
+}
+
+// verifyArchive checks the checksums given for the archive itself before
+// anything is extracted from it.
+func verifyArchive(src multipart.File, opts UploadOptions) error {
+	hasher := newObjectHasher()
+	if _, err := io.Copy(hasher, src); err != nil {
+		return err
+	}
+	if err := hasher.verify(opts); err != nil {
+		return err
+	}
+	_, err := src.Seek(0, io.SeekStart)
+	return err
+}
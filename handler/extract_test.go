@@ -0,0 +1,243 @@
+package handler_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+type archiveFile struct {
+	name    string
+	content string
+	link    bool
+}
+
+func buildZip(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		if f.link {
+			hdr.SetMode(0o777 | fs.ModeSymlink)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatalf("CreateHeader failed: %v", err)
+		}
+		w.Write([]byte(f.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func buildTarGz(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: 0o644, Size: int64(len(f.content))}
+		if strings.HasSuffix(f.name, "/") {
+			hdr = &tar.Header{Typeflag: tar.TypeDir, Name: f.name, Mode: 0o755}
+		}
+		if f.link {
+			hdr = &tar.Header{Typeflag: tar.TypeSymlink, Name: f.name, Linkname: f.content}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader failed: %v", err)
+		}
+		if !f.link {
+			tw.Write([]byte(f.content))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func extractUpload(t *testing.T, url string, fields map[string]string, filename string, archive []byte) (int, apiResp) {
+	t.Helper()
+	fields["mode"] = "extract"
+	body, contentType := multipartBody(t, fields, filename, archive)
+	res, err := http.Post(url+"/upload-file", contentType, body)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return res.StatusCode, parseResp(t, res)
+}
+
+func extractResults(t *testing.T, ar apiResp) map[string]map[string]interface{} {
+	t.Helper()
+	items, ok := ar.Data.([]interface{})
+	if !ok {
+		t.Fatalf("expected a result list, got %#v", ar.Data)
+	}
+	results := make(map[string]map[string]interface{})
+	for _, item := range items {
+		result := item.(map[string]interface{})
+		results[result["name"].(string)] = result
+	}
+	return results
+}
+
+func TestUploadFileExtract(t *testing.T) {
+	files := []archiveFile{
+		{name: "app.bin", content: "application"},
+		{name: "docs/"},
+		{name: "docs/notes.txt", content: "release notes"},
+		{name: `modem\fw.bin`, content: "modem"},
+		{name: "../escape.bin", content: "outside"},
+		{name: "/etc/passwd", content: "absolute"},
+		{name: "link", content: "/etc/passwd", link: true},
+	}
+	tests := map[string]struct {
+		filename string
+		archive  []byte
+	}{
+		"zip":    {"fw.zip", buildZip(t, files)},
+		"tar.gz": {"fw.tar.gz", buildTarGz(t, files[1:])},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := handler.NewMemoryStore(testBucket)
+			srv := newTestServer(t, store)
+
+			status, ar := extractUpload(t, srv.URL, map[string]string{"folder": "fw/v1", "cacheControl": "no-cache"}, tt.filename, tt.archive)
+			if status != http.StatusMultiStatus {
+				t.Fatalf("expected 207, got %d: %s", status, ar.Error)
+			}
+			results := extractResults(t, ar)
+			if _, ok := results["docs/"]; ok {
+				t.Fatal("expected directories to be skipped")
+			}
+			for _, entry := range []string{"../escape.bin", "/etc/passwd", "link"} {
+				if results[entry]["code"] != "INVALID_ARGUMENT" {
+					t.Fatalf("%s: expected INVALID_ARGUMENT, got %v", entry, results[entry])
+				}
+			}
+			for object, content := range map[string]string{"fw/v1/docs/notes.txt": "release notes", "fw/v1/modem/fw.bin": "modem"} {
+				obj, ok := store.Object(object)
+				if !ok || string(obj.Data) != content || obj.CacheControl != "no-cache" {
+					t.Fatalf("expected %s to be extracted, got %+v", object, obj)
+				}
+			}
+			if obj, _ := store.Object("fw/v1/docs/notes.txt"); obj.ContentType != "text/plain; charset=utf-8" {
+				t.Fatalf("expected a detected content type, got %q", obj.ContentType)
+			}
+			for _, object := range []string{"fw/escape.bin", "escape.bin", "fw/v1/etc/passwd", "fw/v1/link"} {
+				if _, ok := store.Object(object); ok {
+					t.Fatalf("expected %s not to be written", object)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadFileExtractLimits(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+	handler.ConfigureExtraction(handler.ExtractConfig{MaxEntrySize: 8, MaxTotalSize: 12})
+	t.Cleanup(func() {
+		handler.ConfigureExtraction(handler.ExtractConfig{MaxEntries: 10000, MaxEntrySize: 1 << 30, MaxTotalSize: 10 << 30})
+	})
+
+	archive := buildZip(t, []archiveFile{
+		{name: "a.bin", content: "aaaaaa"},
+		{name: "big.bin", content: "bigger than eight"},
+		{name: "b.bin", content: "bbbbbbb"},
+		{name: "c.bin", content: "cc"},
+	})
+	status, ar := extractUpload(t, srv.URL, map[string]string{"folder": "fw"}, "fw.zip", archive)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", status, ar.Error)
+	}
+	results := extractResults(t, ar)
+	if len(results) != 3 {
+		t.Fatalf("expected extraction to stop after the total limit, got %v", results)
+	}
+	if results["a.bin"]["error"] != nil || results["big.bin"]["code"] != "TOO_LARGE" || results["b.bin"]["code"] != "TOO_LARGE" {
+		t.Fatalf("unexpected results %v", results)
+	}
+
+	tarball := buildTarGz(t, []archiveFile{{name: "a.bin", content: "aaaaaaaaa"}})
+	status, ar = extractUpload(t, srv.URL, map[string]string{"folder": "fw"}, "fw.tgz", tarball)
+	if status != http.StatusMultiStatus || extractResults(t, ar)["a.bin"]["code"] != "TOO_LARGE" {
+		t.Fatalf("expected the tar entry to be too large, got %d: %v", status, ar.Data)
+	}
+
+	failures := []struct {
+		fields  map[string]string
+		archive []byte
+		status  int
+	}{
+		{map[string]string{"folder": "fw"}, []byte("not an archive"), http.StatusUnsupportedMediaType},
+		{map[string]string{"folder": "fw"}, []byte("PK\x03\x04truncated"), http.StatusBadRequest},
+		{map[string]string{"folder": "fw", "md5": "AAAAAAAAAAAAAAAAAAAAAA=="}, archive, http.StatusBadRequest},
+	}
+	for _, f := range failures {
+		if status, ar := extractUpload(t, srv.URL, f.fields, "fw.zip", f.archive); status != f.status {
+			t.Fatalf("%v: expected %d, got %d: %s", f.fields, f.status, status, ar.Error)
+		}
+	}
+
+	body, contentType := multipartBody(t, map[string]string{"folder": "fw", "mode": "unpack"}, "fw.zip", archive)
+	res, err := http.Post(srv.URL+"/upload-file", contentType, body)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if parseResp(t, res); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown mode, got %d", res.StatusCode)
+	}
+}
+
+func TestUploadFileExtractConditions(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	if _, err := store.UploadBuffer(t.Context(), []byte("original"), "fw/app.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	srv := newTestServer(t, store)
+
+	archive := buildZip(t, []archiveFile{
+		{name: "app.bin", content: "replaced"},
+		{name: "new.bin", content: "first"},
+		{name: "new.bin", content: "second"},
+		{name: `docs\notes.txt`, content: "first"},
+		{name: "docs/notes.txt", content: "second"},
+	})
+	body, contentType := multipartBody(t, map[string]string{"folder": "fw", "mode": "extract"}, "fw.zip", archive)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/upload-file", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("If-None-Match", "*")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	ar := parseResp(t, res)
+	if res.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", res.StatusCode, ar.Error)
+	}
+
+	var codes []string
+	for _, item := range ar.Data.([]interface{}) {
+		code, _ := item.(map[string]interface{})["code"].(string)
+		codes = append(codes, code)
+	}
+	if got := strings.Join(codes, ","); got != "PRECONDITION_FAILED,,INVALID_ARGUMENT,,INVALID_ARGUMENT" {
+		t.Fatalf("unexpected result codes %s", got)
+	}
+	for objectname, content := range map[string]string{"fw/app.bin": "original", "fw/new.bin": "first", "fw/docs/notes.txt": "first"} {
+		if obj, _ := store.Object(objectname); string(obj.Data) != content {
+			t.Fatalf("%s contains %q, want %q", objectname, obj.Data, content)
+		}
+	}
+}
@@ -2,11 +2,15 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,110 +18,397 @@ import (
 )
 
 var (
-	uploader       *GCSUploader
-	requestTimeout = 30 * time.Second
+	uploader        ObjectStore
+	requestTimeout  = 30 * time.Second
+	uploadTimeout   = 30 * time.Minute
+	maxUploadSize   int64
+	uploadChunkSize = 8 << 20
+
+	// downloadRoot is the only directory server-side downloads may write
+	// into. They are disabled while it is empty.
+	downloadRoot string
 )
 
+const (
+	defaultListPageSize = 1000
+	maxListPageSize     = 1000
+)
+
+type UploadConfig struct {
+	MaxSize   int64
+	ChunkSize int
+	Timeout   time.Duration
+}
+
+type DownloadConfig struct {
+	Root string
+}
+
 type ApiResponse struct {
 	Message string `json:"message,omitempty"`
 	Data    any    `json:"data,omitempty"`
 	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"`
 }
 
 func ConnectGCS(credentialPath, bucketName string) error {
-	creds, err := os.ReadFile(credentialPath)
-	if err != nil {
-		return err
+	return ConnectStore(StoreConfig{Backend: BackendGCS, CredentialsPath: credentialPath, BucketName: bucketName})
+}
+
+func ConfigureDownloads(cfg DownloadConfig) error {
+	downloadRoot = cfg.Root
+	if downloadRoot == "" {
+		return nil
 	}
+	return os.MkdirAll(downloadRoot, 0o755)
+}
 
-	uploader = NewGCSUploader(creds, bucketName)
-	if err := uploader.Init(); err != nil {
-		return err
+func ConfigureUploads(cfg UploadConfig) {
+	maxUploadSize = cfg.MaxSize
+	uploadChunkSize = cfg.ChunkSize
+	if cfg.Timeout > 0 {
+		uploadTimeout = cfg.Timeout
 	}
-	return nil
 }
 
 func UploadFile(c *gin.Context) {
-	folder := strings.TrimSpace(c.PostForm("folder"))
-
+	folder, err := cleanPrefix(c.PostForm("folder"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 	if folder == "" {
-		c.JSON(http.StatusBadRequest, ApiResponse{Error: "folder is required"})
+		respondError(c, newError(ErrInvalidArgument, "folder is required"))
 		return
 	}
 
 	file, err := c.FormFile("file")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ApiResponse{Error: "file is required"})
+		respondError(c, newError(ErrInvalidArgument, "file is required"))
 		return
 	}
+	files := c.Request.MultipartForm.File["file"]
+	multiple := len(files) > 1 || len(c.PostFormArray("paths")) > 0
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	for _, f := range files {
+		if maxUploadSize > 0 && f.Size > maxUploadSize {
+			respondError(c, newError(ErrTooLarge, "file %q exceeds maximum upload size of %d bytes", f.Filename, maxUploadSize))
+			return
+		}
+	}
+
+	opts := UploadOptions{ChunkSize: uploadChunkSize}
+	if err := parseChecksums(&opts, c.GetHeader("X-Goog-Hash"), c.PostForm("md5"), c.PostForm("crc32c")); err != nil {
+		respondError(c, err)
+		return
+	}
+	if multiple && opts.hasChecksums() {
+		respondError(c, newError(ErrInvalidArgument, "checksums can only be given when uploading a single file"))
+		return
+	}
+	if opts.Attrs, err = formAttrs(c); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	switch mode := c.DefaultPostForm("mode", "file"); mode {
+	case "file":
+	case "extract":
+		if multiple {
+			respondError(c, newError(ErrInvalidArgument, "extract mode takes a single archive"))
+			return
+		}
+		extractArchive(c, folder, file, opts)
+		return
+	default:
+		respondError(c, newError(ErrInvalidArgument, "unsupported upload mode %q: use file or extract", mode))
+		return
+	}
+
+	if multiple {
+		uploadFiles(c, folder, files, sharedAttrs(opts.Attrs))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
 	defer cancel()
 
-	objectname := path.Join(folder, filepath.Base(file.Filename))
+	objectname, err := uploadObjectName(folder, file.Filename)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := authorize(c, OpUpload, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
 
-	src, err := file.Open()
+	opts.Conditions, err = requestConditions(ctx, c, objectname)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
 		return
 	}
-	defer src.Close()
 
-	uploadSize, err := uploader.UploadFile(ctx, src, objectname, 0, nil)
+	info, err := uploadFormFile(ctx, file, objectname, opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	size := fmt.Sprintf("%d bytes", uploadSize)
-	c.JSON(http.StatusCreated, ApiResponse{Message: "File uploaded successfully", Data: map[string]string{"path": objectname, "size": size}})
+	c.JSON(http.StatusCreated, ApiResponse{Message: "File uploaded successfully", Data: uploadResponseData(objectname, info)})
+}
+
+// uploadFormFile writes one file of a form upload to objectname under the
+// folder's policy. It does not use the gin.Context, so files can be uploaded
+// concurrently.
+func uploadFormFile(ctx context.Context, file *multipart.FileHeader, objectname string, opts UploadOptions) (*ObjectInfo, error) {
+	src, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	policy := policyFor(objectname)
+	reader, err := policy.checkUpload(objectname, file.Size, src, &opts.Conditions)
+	if err == nil {
+		reader, err = detectContentType(objectname, &opts.Attrs, reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := uploader.UploadStream(ctx, reader, objectname, opts)
+	if err != nil {
+		return nil, policy.uploadError(objectname, err)
+	}
+	return info, nil
 }
 
 func DownloadFile(c *gin.Context) {
-	objectname := strings.TrimSpace(c.Query("objectname"))
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 	destination := strings.TrimSpace(c.Query("destination"))
 
-	if objectname == "" {
-		c.JSON(http.StatusBadRequest, ApiResponse{Error: "objectname is required"})
+	if err := authorize(c, OpDownload, objectname); err != nil {
+		respondError(c, err)
 		return
 	}
 
-	if destination == "" {
-		home, err := os.UserHomeDir()
+	src := liveObject(objectname)
+	if c.Query("generation") != "" {
+		if destination != "" {
+			respondError(c, newError(ErrInvalidArgument, "generation cannot be combined with destination"))
+			return
+		}
+
+		versioned, generation, err := generationRequest(c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, ApiResponse{Error: "Failed to get user home directory"})
+			respondError(c, err)
 			return
 		}
-		destination = filepath.Join(home, "Downloads")
+		src = objectGeneration(versioned, objectname, generation)
+	}
+
+	if destination != "" {
+		downloadToServer(c, objectname, destination)
+		return
+	}
+
+	serveObject(c, src)
+}
+
+// StatObject returns the attributes of an object as JSON without reading it.
+func StatObject(c *gin.Context) {
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := authorize(c, OpDownload, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	info, err := uploader.StatObject(ctx, objectname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("ETag", info.ETag())
+	c.JSON(http.StatusOK, ApiResponse{Message: "Object found", Data: info})
+}
+
+// HeadObject answers HEAD on the download route with the headers a download
+// of the live object would carry.
+func HeadObject(c *gin.Context) {
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if c.Query("generation") != "" || c.Query("destination") != "" {
+		respondError(c, newError(ErrInvalidArgument, "HEAD only describes the live object"))
+		return
+	}
+
+	if err := authorize(c, OpDownload, objectname); err != nil {
+		respondError(c, err)
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
 	defer cancel()
 
-	downloadSize, err := uploader.DownloadFile(ctx, objectname, destination)
+	info, err := uploader.StatObject(ctx, objectname)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
+		return
+	}
+
+	if notModified(c.Request, info) {
+		validatorHeaders(c, info)
+		c.Status(http.StatusNotModified)
 		return
 	}
 
-	size := fmt.Sprintf("%d bytes", downloadSize)
-	c.JSON(http.StatusOK, ApiResponse{Message: "File downloaded successfully", Data: map[string]string{"path": destination, "size": size}})
+	for k, v := range downloadHeaders(info) {
+		c.Header(k, v)
+	}
+	c.Header("Content-Type", contentType(info))
+	c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+func downloadToServer(c *gin.Context, objectname, destination string) {
+	if downloadRoot == "" {
+		respondError(c, newError(ErrNotSupported, "server-side downloads are disabled"))
+		return
+	}
+
+	// Destinations are relative to the download root. os.Root also keeps
+	// symlinks inside the root from leading out of it.
+	dir := filepath.Clean(filepath.FromSlash(destination))
+	if !filepath.IsLocal(dir) {
+		respondError(c, newError(ErrInvalidArgument, "destination %q must be a directory inside the download root", destination))
+		return
+	}
+
+	root, err := os.OpenRoot(downloadRoot)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer root.Close()
+
+	if stat, err := root.Stat(dir); err != nil || !stat.IsDir() {
+		respondError(c, newError(ErrInvalidArgument, "destination %q is not a directory inside the download root", destination))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	info, err := downloadInto(ctx, uploader, objectname, root, filepath.Join(dir, path.Base(objectname)))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	data := info.hashes()
+	data["path"] = filepath.ToSlash(dir)
+	data["size"] = fmt.Sprintf("%d bytes", info.Size)
+	c.JSON(http.StatusOK, ApiResponse{Message: "File downloaded successfully", Data: data})
+}
+
+func uploadResponseData(objectname string, info *ObjectInfo) map[string]string {
+	data := info.hashes()
+	data["path"] = objectname
+	data["size"] = fmt.Sprintf("%d bytes", info.Size)
+	return data
+}
+
+func contentType(info *ObjectInfo) string {
+	if info.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return info.ContentType
+}
+
+// downloadHeaders serves an object with its stored Content-Disposition, or
+// as an attachment named after the object.
+func downloadHeaders(info *ObjectInfo) map[string]string {
+	disposition := info.ContentDisposition
+	if disposition == "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(info.Name)})
+	}
+	headers := map[string]string{
+		"Content-Disposition": disposition,
+		"ETag":                info.ETag(),
+		"Accept-Ranges":       "bytes",
+	}
+	if !info.Updated.IsZero() {
+		headers["Last-Modified"] = info.Updated.UTC().Format(http.TimeFormat)
+	}
+	if info.ContentEncoding != "" {
+		headers["Content-Encoding"] = info.ContentEncoding
+	}
+	if info.CacheControl != "" {
+		headers["Cache-Control"] = info.CacheControl
+	}
+	if googHash := info.googHash(); googHash != "" {
+		headers["X-Goog-Hash"] = googHash
+	}
+	return headers
 }
 
 func ListFiles(c *gin.Context) {
-	folder := strings.TrimSpace(c.Query("folder"))
+	prefix, err := cleanPrefix(c.Query("folder"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	opts := ListOptions{
+		Prefix:    prefix,
+		Delimiter: c.Query("delimiter"),
+		PageToken: c.Query("pageToken"),
+		PageSize:  defaultListPageSize,
+	}
+
+	if value := c.Query("pageSize"); value != "" {
+		pageSize, err := strconv.Atoi(value)
+		if err != nil || pageSize <= 0 {
+			respondError(c, newError(ErrInvalidArgument, "pageSize must be a positive integer"))
+			return
+		}
+		opts.PageSize = min(pageSize, maxListPageSize)
+	}
+
+	if opts.Prefix, err = authorizePrefix(c, OpList, opts.Prefix); err != nil {
+		respondError(c, err)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
 	defer cancel()
 
-	files, err := uploader.ListObjects(ctx, folder)
+	page, err := uploader.ListObjectsPage(ctx, opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	if len(files) > 0 {
-		c.JSON(http.StatusOK, ApiResponse{Message: "Files found", Data: files})
+	if len(page.Objects) > 0 || len(page.Prefixes) > 0 {
+		c.JSON(http.StatusOK, ApiResponse{Message: "Files found", Data: page})
 		return
 	}
 
@@ -125,19 +416,29 @@ func ListFiles(c *gin.Context) {
 }
 
 func DeleteObject(c *gin.Context) {
-	objectname := strings.TrimSpace(c.Query("objectname"))
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
-	if objectname == "" {
-		c.JSON(http.StatusBadRequest, ApiResponse{Error: "objectname is required"})
+	if err := authorize(c, OpDelete, objectname); err != nil {
+		respondError(c, err)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
 	defer cancel()
 
-	err := uploader.DeleteObject(ctx, objectname)
+	conds, err := requestConditions(ctx, c, objectname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	err = uploader.DeleteObjectIf(ctx, objectname, conds)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
 		return
 	}
 
@@ -145,47 +446,137 @@ func DeleteObject(c *gin.Context) {
 }
 
 func UploadBuffer(c *gin.Context) {
-	objectname := strings.TrimSpace(c.Query("objectname"))
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
-	if objectname == "" {
-		c.JSON(http.StatusBadRequest, ApiResponse{Error: "objectname is required"})
+	if err := authorize(c, OpUpload, objectname); err != nil {
+		respondError(c, err)
 		return
 	}
 
-	data, err := c.GetRawData()
+	body := c.Request.Body
+	if maxUploadSize > 0 {
+		if c.Request.ContentLength > maxUploadSize {
+			respondError(c, newError(ErrTooLarge, "body exceeds maximum upload size of %d bytes", maxUploadSize))
+			return
+		}
+		body = http.MaxBytesReader(c.Writer, body, maxUploadSize)
+	}
+
+	opts := UploadOptions{ChunkSize: uploadChunkSize}
+	if err := parseChecksums(&opts, c.GetHeader("X-Goog-Hash"), c.GetHeader("Content-MD5"), ""); err != nil {
+		respondError(c, err)
+		return
+	}
+	attrs, err := headerAttrs(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
 		return
 	}
+	opts.Attrs = attrs
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
 	defer cancel()
 
-	uploadSize, err := uploader.UploadBuffer(ctx, data, objectname, 0, nil)
+	conds, err := requestConditions(ctx, c, objectname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	opts.Conditions = conds
+
+	policy := policyFor(objectname)
+	reader, err := policy.checkUpload(objectname, c.Request.ContentLength, body, &opts.Conditions)
+	if err == nil {
+		reader, err = detectContentType(objectname, &opts.Attrs, reader)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	info, err := uploader.UploadStream(ctx, reader, objectname, opts)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondError(c, newError(ErrTooLarge, "body exceeds maximum upload size of %d bytes", maxUploadSize))
+			return
+		}
+		respondError(c, policy.uploadError(objectname, err))
 		return
 	}
-	size := fmt.Sprintf("%d bytes", uploadSize)
-	c.JSON(http.StatusCreated, ApiResponse{Message: "Buffer uploaded successfully", Data: map[string]string{"path": objectname, "size": size}})
+	c.JSON(http.StatusCreated, ApiResponse{Message: "Buffer uploaded successfully", Data: uploadResponseData(objectname, info)})
 }
 
 func GetObjectUrl(c *gin.Context) {
-	objectname := strings.TrimSpace(c.Query("objectname"))
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	opts, err := signedURLRequest(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
-	if objectname == "" {
-		c.JSON(http.StatusBadRequest, ApiResponse{Error: "objectname is required"})
+	op := OpDownload
+	if opts.Method == http.MethodPut || opts.Method == http.MethodPost {
+		op = OpUpload
+	}
+	// A signed url hands the operation it signs to whoever holds it.
+	if err := authorize(c, OpSign, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, op, objectname); err != nil {
+		respondError(c, err)
 		return
 	}
+	// A signed upload never passes through the server, so its limits have
+	// to be part of the signature.
+	if op == OpUpload {
+		opts.MaxSize = maxUploadSize
+		if err := policyFor(objectname).checkSignedURL(objectname, &opts); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
 	defer cancel()
 
-	url, err := uploader.GetObjectUrl(ctx, objectname)
+	url, err := uploader.SignedURL(ctx, objectname, opts)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{Message: "Object url", Data: map[string]any{
+		"url":     url,
+		"method":  opts.Method,
+		"expires": time.Now().Add(opts.Expiry).UTC().Format(time.RFC3339),
+		"headers": opts.requiredHeaders(),
+	}})
+}
+
+func ServeLocalObject(c *gin.Context) {
+	local, ok := uploader.(*LocalStore)
+	if !ok {
+		respondError(c, newError(ErrNotFound, "local object urls are not enabled"))
+		return
+	}
+
+	objectname := c.Query("objectname")
+	filename, err := local.OpenSigned(objectname, c.Query("expires"), c.Query("signature"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{Error: err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, ApiResponse{Message: "Object url", Data: map[string]string{"url": url}})
+	c.FileAttachment(filename, path.Base(objectname))
 }
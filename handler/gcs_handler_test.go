@@ -3,12 +3,12 @@ package handler_test
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -23,23 +23,104 @@ type apiResp struct {
 	Message string      `json:"message,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
 }
 
-func newTestServer(t *testing.T) *httptest.Server {
+func newTestServer(t *testing.T, store handler.ObjectStore) *httptest.Server {
 	t.Helper()
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
+	r.Use(handler.Authenticate)
 
 	r.POST("/upload-buffer", handler.UploadBuffer)
 	r.POST("/upload-file", handler.UploadFile)
 	r.GET("/list-files", handler.ListFiles)
 	r.GET("/download-file", handler.DownloadFile)
+	r.HEAD("/download-file", handler.HeadObject)
+	r.GET("/stat", handler.StatObject)
+	r.GET("/download-archive", handler.DownloadArchive)
 	r.DELETE("/delete-object", handler.DeleteObject)
+	r.POST("/delete-batch", handler.BatchDelete)
+	r.GET("/object-url", handler.GetObjectUrl)
+	r.POST("/post-policy", handler.GetPostPolicy)
+	r.POST("/copy", handler.CopyObject)
+	r.POST("/move", handler.MoveObject)
+	r.GET("/object-attrs", handler.StatObject)
+	r.PATCH("/object-attrs", handler.UpdateObjectAttrs)
+	r.GET("/versions", handler.ListVersions)
+	r.POST("/versions/restore", handler.RestoreVersion)
+	r.DELETE("/versions", handler.DeleteVersion)
 
-	if err := handler.ConnectGCS("/home/akash/Downloads/gcsuploader/config/credentials.json", "dmtfota"); err != nil {
-		t.Fatalf("ConnectGCS failed: %v", err)
+	handler.SetObjectStore(store)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newDownloadRoot sandboxes server-side downloads in a temporary directory.
+func newDownloadRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := handler.ConfigureDownloads(handler.DownloadConfig{Root: root}); err != nil {
+		t.Fatalf("ConfigureDownloads failed: %v", err)
+	}
+	t.Cleanup(func() { handler.ConfigureDownloads(handler.DownloadConfig{}) })
+	return root
+}
+
+func testStores() map[string]func(t *testing.T) handler.ObjectStore {
+	return map[string]func(t *testing.T) handler.ObjectStore{
+		"memory": func(t *testing.T) handler.ObjectStore {
+			return handler.NewMemoryStore(testBucket)
+		},
+		"local": func(t *testing.T) handler.ObjectStore {
+			return newLocalStore(t, "http://localhost:8080")
+		},
+		"fakegcs": func(t *testing.T) handler.ObjectStore {
+			return newUploader(t, newFakeGCS(t))
+		},
+	}
+}
+
+// doRequest sends a request to a test server and parses the ApiResponse of a
+// JSON reply. A string body is sent as it is; any other non-nil body is sent
+// as JSON.
+func doRequest(t *testing.T, method, url string, body any, headers map[string]string) (*http.Response, apiResp) {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		payload, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("marshal failed: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
 	}
-	return httptest.NewServer(r)
+	if _, raw := body.(string); body != nil && !raw {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		res.Body.Close()
+		return res, apiResp{}
+	}
+	return res, parseResp(t, res)
 }
 
 func parseResp(t *testing.T, res *http.Response) apiResp {
@@ -63,13 +144,37 @@ func getDataMap(t *testing.T, ar apiResp) map[string]interface{} {
 	return m
 }
 
+func multipartBody(t *testing.T, fields map[string]string, filename string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if filename != "" {
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatalf("CreateFormFile failed: %v", err)
+		}
+		fw.Write(content)
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
 func TestAPIIntegration(t *testing.T) {
-	srv := newTestServer(t)
-	defer srv.Close()
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestServer(t, newStore(t))
+			testAPI(t, srv)
+		})
+	}
+}
 
+func testAPI(t *testing.T, srv *httptest.Server) {
 	client := &http.Client{Timeout: 30 * time.Second}
 
-	folder := fmt.Sprintf("api-test/%d", time.Now().UnixNano())
+	folder := "api-test/release"
 	object1 := folder + "/buf.txt"
 	object2 := folder + "/file.txt"
 
@@ -86,29 +191,23 @@ func TestAPIIntegration(t *testing.T) {
 		if ar.Error != "" {
 			t.Fatalf("unexpected error: %s", ar.Error)
 		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "Buffer uploaded successfully") {
+		if !strings.Contains(ar.Message, "Buffer uploaded successfully") {
 			t.Fatalf("unexpected message: %q", ar.Message)
 		}
 		data := getDataMap(t, ar)
 		if data["path"] != object1 {
 			t.Fatalf("expected path %q, got %v", object1, data["path"])
 		}
-		if _, ok := data["size"].(string); !ok {
-			t.Fatalf("expected size string, got %#v", data["size"])
+		if data["size"] != "12 bytes" {
+			t.Fatalf("expected size 12 bytes, got %#v", data["size"])
 		}
 	})
 
 	t.Run("UploadFile", func(t *testing.T) {
-		tmpFile := filepath.Join(os.TempDir(), "api_upload.txt")
-		if err := os.WriteFile(tmpFile, []byte("file upload test"), 0644); err != nil {
-			t.Fatalf("write temp file failed: %v", err)
-		}
+		body, contentType := multipartBody(t, map[string]string{"folder": folder}, "nested/dir/file.txt", []byte("file upload test"))
 
-		expectedPath := path.Join(folder, filepath.Base(tmpFile))
-		object2 = expectedPath
-
-		req, _ := http.NewRequest("POST",
-			srv.URL+"/upload-file?filename="+tmpFile+"&folder="+folder, nil)
+		req, _ := http.NewRequest("POST", srv.URL+"/upload-file", body)
+		req.Header.Set("Content-Type", contentType)
 		res, err := client.Do(req)
 		if err != nil {
 			t.Fatalf("request failed: %v", err)
@@ -117,24 +216,42 @@ func TestAPIIntegration(t *testing.T) {
 			t.Fatalf("expected 201, got %d", res.StatusCode)
 		}
 		ar := parseResp(t, res)
-		if ar.Error != "" {
-			t.Fatalf("unexpected error: %s", ar.Error)
-		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "File uploaded successfully") {
+		if !strings.Contains(ar.Message, "File uploaded successfully") {
 			t.Fatalf("unexpected message: %q", ar.Message)
 		}
 		data := getDataMap(t, ar)
-		if data["path"] != expectedPath {
-			t.Fatalf("expected path %q, got %v", expectedPath, data["path"])
+		if data["path"] != object2 {
+			t.Fatalf("expected path %q, got %v", object2, data["path"])
 		}
 		if size, ok := data["size"].(string); !ok || !strings.HasSuffix(size, "bytes") {
 			t.Fatalf("expected size string ending with 'bytes', got %#v", data["size"])
 		}
 	})
 
+	t.Run("UploadFile_MissingFields", func(t *testing.T) {
+		body, contentType := multipartBody(t, nil, "file.txt", []byte("x"))
+		res, err := client.Post(srv.URL+"/upload-file", contentType, body)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 without folder, got %d", res.StatusCode)
+		}
+		res.Body.Close()
+
+		body, contentType = multipartBody(t, map[string]string{"folder": folder}, "", nil)
+		res, err = client.Post(srv.URL+"/upload-file", contentType, body)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 without file, got %d", res.StatusCode)
+		}
+		res.Body.Close()
+	})
+
 	t.Run("ListFiles_FilesFound", func(t *testing.T) {
-		req, _ := http.NewRequest("GET", srv.URL+"/list-files?folder="+folder, nil)
-		res, err := client.Do(req)
+		res, err := client.Get(srv.URL + "/list-files?folder=" + folder)
 		if err != nil {
 			t.Fatalf("request failed: %v", err)
 		}
@@ -142,22 +259,21 @@ func TestAPIIntegration(t *testing.T) {
 			t.Fatalf("expected 200, got %d", res.StatusCode)
 		}
 		ar := parseResp(t, res)
-		if ar.Error != "" {
-			t.Fatalf("unexpected error: %s", ar.Error)
-		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "Files found") {
+		if !strings.Contains(ar.Message, "Files found") {
 			t.Fatalf("unexpected message: %q", ar.Message)
 		}
-		files, ok := ar.Data.([]interface{})
-		if !ok || len(files) == 0 {
-			t.Fatalf("expected non-empty files list, got %#v", ar.Data)
+		files, ok := getDataMap(t, ar)["objects"].([]interface{})
+		if !ok || len(files) != 2 {
+			t.Fatalf("expected two files, got %#v", ar.Data)
 		}
 	})
 
 	t.Run("DownloadFile_WithDestination", func(t *testing.T) {
-		destDir := t.TempDir()
-		req, _ := http.NewRequest("GET", srv.URL+"/download-file?objectname="+object1+"&destination="+destDir, nil)
-		res, err := client.Do(req)
+		destDir := "downloads/release"
+		root := newDownloadRoot(t)
+		os.MkdirAll(filepath.Join(root, destDir), 0o755)
+
+		res, err := client.Get(srv.URL + "/download-file?objectname=" + object1 + "&destination=" + destDir)
 		if err != nil {
 			t.Fatalf("request failed: %v", err)
 		}
@@ -165,73 +281,76 @@ func TestAPIIntegration(t *testing.T) {
 			t.Fatalf("expected 200, got %d", res.StatusCode)
 		}
 		ar := parseResp(t, res)
-		if ar.Error != "" {
-			t.Fatalf("unexpected error: %s", ar.Error)
-		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "File downloaded successfully") {
+		if !strings.Contains(ar.Message, "File downloaded successfully") {
 			t.Fatalf("unexpected message: %q", ar.Message)
 		}
 		data := getDataMap(t, ar)
 		if data["path"] != destDir {
 			t.Fatalf("expected path %q, got %v", destDir, data["path"])
 		}
-		if _, ok := data["size"].(string); !ok {
-			t.Fatalf("expected size string, got %#v", data["size"])
-		}
-		expectedFile := filepath.Join(destDir, filepath.Base(object1))
-		if _, err := os.Stat(expectedFile); err != nil {
+		dataBytes, err := os.ReadFile(filepath.Join(root, destDir, filepath.Base(object1)))
+		if err != nil {
 			t.Fatalf("downloaded file missing: %v", err)
 		}
-		dataBytes, _ := os.ReadFile(expectedFile)
-		if !strings.Contains(string(dataBytes), "hello buffer") {
+		if string(dataBytes) != "hello buffer" {
 			t.Fatalf("unexpected file content: %s", string(dataBytes))
 		}
 	})
 
-	t.Run("ListFiles_NoFilesFound", func(t *testing.T) {
-		emptyFolder := fmt.Sprintf("api-test-empty/%d", time.Now().UnixNano())
-		req, _ := http.NewRequest("GET", srv.URL+"/list-files?folder="+emptyFolder, nil)
-		res, err := client.Do(req)
+	t.Run("DownloadFile_Stream", func(t *testing.T) {
+		res, err := client.Get(srv.URL + "/download-file?objectname=" + object1)
 		if err != nil {
 			t.Fatalf("request failed: %v", err)
 		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
 		if res.StatusCode != http.StatusOK {
-			t.Fatalf("expected 200, got %d", res.StatusCode)
+			t.Fatalf("expected 200, got %d: %s", res.StatusCode, body)
 		}
-		ar := parseResp(t, res)
-		if ar.Error != "" {
-			t.Fatalf("unexpected error: %s", ar.Error)
+		if string(body) != "hello buffer" {
+			t.Fatalf("unexpected body %q", body)
 		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "No files found") {
-			t.Fatalf("unexpected message: %q", ar.Message)
+		if res.Header.Get("Content-Length") != "12" {
+			t.Fatalf("unexpected Content-Length %q", res.Header.Get("Content-Length"))
+		}
+		if res.Header.Get("Content-Type") == "" {
+			t.Fatal("expected Content-Type header")
+		}
+		if cd := res.Header.Get("Content-Disposition"); cd != "attachment; filename=buf.txt" {
+			t.Fatalf("unexpected Content-Disposition %q", cd)
+		}
+		if res.Header.Get("ETag") == "" || res.Header.Get("Last-Modified") == "" {
+			t.Fatalf("expected ETag and Last-Modified, got %v", res.Header)
 		}
 	})
 
-	t.Run("DeleteObject1", func(t *testing.T) {
-		req, _ := http.NewRequest("DELETE", srv.URL+"/delete-object?objectname="+object1, nil)
-		res, err := client.Do(req)
+	t.Run("DownloadFile_StreamMissing", func(t *testing.T) {
+		res, err := client.Get(srv.URL + "/download-file?objectname=" + folder + "/missing.txt")
 		if err != nil {
 			t.Fatalf("request failed: %v", err)
 		}
-		if res.StatusCode != http.StatusOK {
-			t.Fatalf("expected 200, got %d", res.StatusCode)
+		if ar := parseResp(t, res); ar.Error == "" || res.StatusCode == http.StatusOK {
+			t.Fatalf("expected an error response, got %d", res.StatusCode)
 		}
-		ar := parseResp(t, res)
-		if ar.Error != "" {
-			t.Fatalf("unexpected error: %s", ar.Error)
+	})
+
+	t.Run("GetObjectUrl", func(t *testing.T) {
+		res, err := client.Get(srv.URL + "/object-url?objectname=" + object1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
 		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "File deleted successfully") {
-			t.Fatalf("unexpected message: %q", ar.Message)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", res.StatusCode)
 		}
-		data := getDataMap(t, ar)
-		if data["path"] != object1 {
-			t.Fatalf("expected path %q, got %v", object1, data["path"])
+		data := getDataMap(t, parseResp(t, res))
+		if u, _ := data["url"].(string); !strings.Contains(u, "buf.txt") {
+			t.Fatalf("unexpected url %#v", data["url"])
 		}
 	})
 
-	t.Run("DeleteObject2", func(t *testing.T) {
-		req, _ := http.NewRequest("DELETE", srv.URL+"/delete-object?objectname="+object2, nil)
-		res, err := client.Do(req)
+	t.Run("ListFiles_NoFilesFound", func(t *testing.T) {
+		res, err := client.Get(srv.URL + "/list-files?folder=api-test-empty/")
 		if err != nil {
 			t.Fatalf("request failed: %v", err)
 		}
@@ -239,15 +358,193 @@ func TestAPIIntegration(t *testing.T) {
 			t.Fatalf("expected 200, got %d", res.StatusCode)
 		}
 		ar := parseResp(t, res)
-		if ar.Error != "" {
-			t.Fatalf("unexpected error: %s", ar.Error)
-		}
-		if ar.Message == "" || !strings.Contains(ar.Message, "File deleted successfully") {
+		if !strings.Contains(ar.Message, "No files found") {
 			t.Fatalf("unexpected message: %q", ar.Message)
 		}
-		data := getDataMap(t, ar)
-		if data["path"] != object2 {
-			t.Fatalf("expected path %q, got %v", object2, data["path"])
-		}
 	})
+
+	for _, object := range []string{object1, object2} {
+		t.Run("DeleteObject "+object, func(t *testing.T) {
+			req, _ := http.NewRequest("DELETE", srv.URL+"/delete-object?objectname="+object, nil)
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+			ar := parseResp(t, res)
+			if !strings.Contains(ar.Message, "File deleted successfully") {
+				t.Fatalf("unexpected message: %q", ar.Message)
+			}
+			data := getDataMap(t, ar)
+			if data["path"] != object {
+				t.Fatalf("expected path %q, got %v", object, data["path"])
+			}
+		})
+	}
+}
+
+func TestAPIStoreFailures(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+
+	store.InjectFailure("ListObjects", errors.New("backend unavailable"), 1)
+
+	res, err := http.Get(srv.URL + "/list-files?folder=x")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", res.StatusCode)
+	}
+	if ar := parseResp(t, res); !strings.Contains(ar.Error, "backend unavailable") {
+		t.Fatalf("unexpected error: %q", ar.Error)
+	}
+}
+
+func TestListFilesPagination(t *testing.T) {
+	names := []string{"fw/a.bin", "fw/b.bin", "fw/beta/x.bin", "fw/beta/y.bin", "fw/c.bin", "fw/gamma/z.bin", "other/d.bin"}
+
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			for _, objectname := range names {
+				if _, err := store.UploadBuffer(t.Context(), []byte(objectname), objectname, 0, nil); err != nil {
+					t.Fatalf("UploadBuffer(%q) failed: %v", objectname, err)
+				}
+			}
+			srv := newTestServer(t, store)
+
+			list := func(query string) map[string]interface{} {
+				t.Helper()
+				res, err := http.Get(srv.URL + "/list-files?" + query)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("expected 200 for %q, got %d", query, res.StatusCode)
+				}
+				return getDataMap(t, parseResp(t, res))
+			}
+
+			var objects, prefixes []string
+			token := ""
+			for pages := 0; ; pages++ {
+				if pages > 5 {
+					t.Fatal("pagination did not terminate")
+				}
+				data := list("folder=fw/&delimiter=/&pageSize=2&pageToken=" + token)
+				for _, o := range data["objects"].([]interface{}) {
+					obj := o.(map[string]interface{})
+					objects = append(objects, obj["name"].(string))
+					if obj["size"].(float64) != float64(len(obj["name"].(string))) {
+						t.Fatalf("unexpected size in %v", obj)
+					}
+					if obj["contentType"] == nil || obj["updated"] == nil || obj["generation"] == nil {
+						t.Fatalf("missing attributes in %v", obj)
+					}
+					if name != "local" && (obj["md5"] == nil || obj["crc32c"] == nil) {
+						t.Fatalf("missing hashes in %v", obj)
+					}
+				}
+				if p, ok := data["prefixes"].([]interface{}); ok {
+					for _, prefix := range p {
+						prefixes = append(prefixes, prefix.(string))
+					}
+				}
+				next, _ := data["nextPageToken"].(string)
+				if next == "" {
+					break
+				}
+				token = next
+			}
+
+			if want := []string{"fw/a.bin", "fw/b.bin", "fw/c.bin"}; strings.Join(objects, ",") != strings.Join(want, ",") {
+				t.Fatalf("objects = %v, want %v", objects, want)
+			}
+			if want := []string{"fw/beta/", "fw/gamma/"}; strings.Join(prefixes, ",") != strings.Join(want, ",") {
+				t.Fatalf("prefixes = %v, want %v", prefixes, want)
+			}
+
+			data := list("folder=fw/")
+			if n := len(data["objects"].([]interface{})); n != 6 {
+				t.Fatalf("expected 6 objects without delimiter, got %d", n)
+			}
+
+			res, err := http.Get(srv.URL + "/list-files?folder=fw/&pageSize=0")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400 for invalid pageSize, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestStatObject(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			info, err := store.UploadStream(t.Context(), strings.NewReader("firmware"), "fw/app.bin", handler.UploadOptions{})
+			if err != nil {
+				t.Fatalf("UploadStream failed: %v", err)
+			}
+			srv := newTestServer(t, store)
+
+			res, err := http.Get(srv.URL + "/stat?objectname=fw/app.bin")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			ar := parseResp(t, res)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", res.StatusCode, ar.Error)
+			}
+			data := getDataMap(t, ar)
+			if data["name"] != "fw/app.bin" || data["size"] != float64(8) || data["contentType"] == nil || data["updated"] == nil {
+				t.Fatalf("unexpected attributes %v", data)
+			}
+			if res.Header.Get("ETag") != info.ETag() {
+				t.Fatalf("ETag = %q, want %q", res.Header.Get("ETag"), info.ETag())
+			}
+
+			res, err = http.Get(srv.URL + "/stat?objectname=fw/missing.bin")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if ar := parseResp(t, res); res.StatusCode != http.StatusNotFound || ar.Code != "NOT_FOUND" {
+				t.Fatalf("expected 404 NOT_FOUND, got %d %s", res.StatusCode, ar.Code)
+			}
+
+			head := func(objectname string, header http.Header) *http.Response {
+				t.Helper()
+				req, _ := http.NewRequest(http.MethodHead, srv.URL+"/download-file?objectname="+objectname, nil)
+				for k, v := range header {
+					req.Header[k] = v
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				res.Body.Close()
+				return res
+			}
+
+			res = head("fw/app.bin", nil)
+			if res.StatusCode != http.StatusOK || res.ContentLength != 8 {
+				t.Fatalf("expected 200 with length 8, got %d with length %d", res.StatusCode, res.ContentLength)
+			}
+			if res.Header.Get("ETag") != info.ETag() || res.Header.Get("Accept-Ranges") != "bytes" || res.Header.Get("Content-Type") == "" {
+				t.Fatalf("missing download headers: %v", res.Header)
+			}
+			if res := head("fw/app.bin", http.Header{"If-None-Match": {info.ETag()}}); res.StatusCode != http.StatusNotModified {
+				t.Fatalf("expected 304, got %d", res.StatusCode)
+			}
+			if res := head("fw/missing.bin", nil); res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404, got %d", res.StatusCode)
+			}
+		})
+	}
 }
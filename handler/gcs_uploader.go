@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path"
-	"path/filepath"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
@@ -20,15 +22,17 @@ import (
 type GCSUploader struct {
 	credentialsJSON []byte
 	bucket          string
+	clientOptions   []option.ClientOption
 
 	storageClient *storage.Client
 	bucketHandle  *storage.BucketHandle
 }
 
-func NewGCSUploader(credentialsJSON []byte, bucket string) *GCSUploader {
+func NewGCSUploader(credentialsJSON []byte, bucket string, opts ...option.ClientOption) *GCSUploader {
 	return &GCSUploader{
 		credentialsJSON: credentialsJSON,
 		bucket:          bucket,
+		clientOptions:   opts,
 
 		storageClient: nil,
 		bucketHandle:  nil,
@@ -36,9 +40,9 @@ func NewGCSUploader(credentialsJSON []byte, bucket string) *GCSUploader {
 }
 
 func (o *GCSUploader) Init() error {
-	clientopts := option.WithCredentialsJSON(o.credentialsJSON)
+	clientopts := append([]option.ClientOption{option.WithCredentialsJSON(o.credentialsJSON)}, o.clientOptions...)
 
-	client, err := storage.NewClient(context.Background(), clientopts)
+	client, err := storage.NewClient(context.Background(), clientopts...)
 	if err != nil {
 		log.Println("Storage new client:Err:", err)
 		return err
@@ -53,55 +57,139 @@ func (o *GCSUploader) Init() error {
 }
 
 func (o *GCSUploader) UploadFile(ctx context.Context, file io.Reader, objectname string, writerChunkSize int, progressf func(int64)) (int64, error) {
+	info, err := o.UploadStream(ctx, file, objectname, UploadOptions{ChunkSize: writerChunkSize, ProgressFunc: progressf})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (o *GCSUploader) UploadBuffer(ctx context.Context, filecontent []byte, objectname string, writerChunkSize int, progressf func(int64)) (int64, error) {
+	return o.UploadFile(ctx, bytes.NewReader(filecontent), objectname, writerChunkSize, progressf)
+}
+
+func (o *GCSUploader) UploadStream(ctx context.Context, file io.Reader, objectname string, opts UploadOptions) (*ObjectInfo, error) {
 	if o.bucketHandle == nil {
-		return 0, fmt.Errorf("bucket handle is not initialized")
+		return nil, fmt.Errorf("bucket handle is not initialized")
 	}
 
+	// Cancelling the writer's context is the only way to abandon an upload;
+	// closing it would commit whatever was copied so far.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	objectHandle := o.bucketHandle.Object(objectname)
+	if !opts.Conditions.isZero() {
+		objectHandle = objectHandle.If(opts.Conditions.storageConditions())
+	}
 
 	objectWriter := objectHandle.NewWriter(ctx)
 
-	objectWriter.ProgressFunc = progressf
-	objectWriter.ChunkSize = writerChunkSize
-
-	nbytescopied, err := io.Copy(objectWriter, file)
-	if err != nil {
+	objectWriter.ProgressFunc = opts.ProgressFunc
+	objectWriter.ChunkSize = opts.ChunkSize
+	objectWriter.MD5 = opts.MD5
+	objectWriter.CRC32C = opts.CRC32C
+	objectWriter.SendCRC32C = opts.SendCRC32C
+	objectWriter.ContentType = opts.Attrs.ContentType
+	objectWriter.ContentEncoding = opts.Attrs.ContentEncoding
+	objectWriter.CacheControl = opts.Attrs.CacheControl
+	objectWriter.ContentDisposition = opts.Attrs.ContentDisposition
+	objectWriter.Metadata = opts.Attrs.Metadata
+
+	if _, err := io.Copy(objectWriter, file); err != nil {
+		cancel()
 		objectWriter.Close()
-		return 0, fmt.Errorf("io.Copy: %w", err)
+		return nil, fmt.Errorf("io.Copy: %w", classifyError(checksumError(err, opts)))
 	}
 
 	closeErr := objectWriter.Close()
 	if closeErr != nil {
-		return 0, fmt.Errorf("object close failed with :%v", closeErr)
+		return nil, fmt.Errorf("object close failed with :%w", classifyError(checksumError(closeErr, opts)))
 	}
 
-	return nbytescopied, nil
+	return objectInfo(objectWriter.Attrs()), nil
 }
 
-func (o *GCSUploader) UploadBuffer(ctx context.Context, filecontent []byte, objectname string, writerChunkSize int, progressf func(int64)) (int64, error) {
-	if o.bucketHandle == nil {
-		return 0, fmt.Errorf("bucket handle is not initialized")
+// checksumError marks the 400 GCS returns when client-supplied hashes do not
+// match the uploaded bytes.
+func checksumError(err error, opts UploadOptions) error {
+	var apiErr *googleapi.Error
+	if opts.hasChecksums() && errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest {
+		return fmt.Errorf("%w: %w", ErrChecksumMismatch, err)
 	}
+	return err
+}
 
-	objectHandle := o.bucketHandle.Object(objectname)
-
-	objectWriter := objectHandle.NewWriter(ctx)
+func objectInfo(attrs *storage.ObjectAttrs) *ObjectInfo {
+	return &ObjectInfo{
+		Name:               attrs.Name,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		Updated:            attrs.Updated,
+		Deleted:            attrs.Deleted,
+		Generation:         attrs.Generation,
+		Metageneration:     attrs.Metageneration,
+		MD5:                attrs.MD5,
+		CRC32C:             encodeCRC32C(attrs.CRC32C),
+		Metadata:           attrs.Metadata,
+	}
+}
 
-	objectWriter.ProgressFunc = progressf
-	objectWriter.ChunkSize = writerChunkSize
+// StatObject returns the full attributes of the live generation without
+// reading its content.
+func (o *GCSUploader) StatObject(ctx context.Context, objectname string) (*ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
 
-	nbytescopied, err := io.Copy(objectWriter, bytes.NewReader(filecontent))
+	attrs, err := o.bucketHandle.Object(objectname).Attrs(ctx)
 	if err != nil {
-		objectWriter.Close()
-		return 0, fmt.Errorf("io.Copy: %w", err)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, newError(ErrNotFound, "object %q does not exist", objectname)
+		}
+		return nil, fmt.Errorf("failed to read attributes of object %q: %w", objectname, classifyError(err))
 	}
+	return objectInfo(attrs), nil
+}
 
-	closeErr := objectWriter.Close()
-	if closeErr != nil {
-		return 0, fmt.Errorf("object close failed with :%v", closeErr)
+// UpdateAttrs patches the attributes of the live generation in place, which
+// only bumps its metageneration.
+func (o *GCSUploader) UpdateAttrs(ctx context.Context, objectname string, update AttrsUpdate, conds Conditions) (*ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
 	}
 
-	return nbytescopied, nil
+	objectHandle := o.bucketHandle.Object(objectname)
+	if !conds.isZero() {
+		objectHandle = objectHandle.If(conds.storageConditions())
+	}
+
+	var toUpdate storage.ObjectAttrsToUpdate
+	if update.ContentType != nil {
+		toUpdate.ContentType = *update.ContentType
+	}
+	if update.ContentEncoding != nil {
+		toUpdate.ContentEncoding = *update.ContentEncoding
+	}
+	if update.CacheControl != nil {
+		toUpdate.CacheControl = *update.CacheControl
+	}
+	if update.ContentDisposition != nil {
+		toUpdate.ContentDisposition = *update.ContentDisposition
+	}
+	toUpdate.Metadata = update.Metadata
+
+	attrs, err := objectHandle.Update(ctx, toUpdate)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, newError(ErrNotFound, "object %q does not exist", objectname)
+		}
+		return nil, fmt.Errorf("failed to update object %q: %w", objectname, classifyError(err))
+	}
+	return objectInfo(attrs), nil
 }
 
 func (o *GCSUploader) DownloadFile(ctx context.Context, objectname string, destination string) (int64, error) {
@@ -109,28 +197,48 @@ func (o *GCSUploader) DownloadFile(ctx context.Context, objectname string, desti
 		return 0, fmt.Errorf("bucket handle is not initialized")
 	}
 
-	objectHandle := o.bucketHandle.Object(objectname)
-
-	objectReader, readererr := objectHandle.NewReader(ctx)
-	if readererr != nil {
-		return 0, readererr
+	info, err := downloadToFile(ctx, o, objectname, destination)
+	if err != nil {
+		return 0, err
 	}
-	defer objectReader.Close()
+	return info.Size, nil
+}
 
-	filename := filepath.Join(destination, path.Base(objectname))
+func (o *GCSUploader) NewReader(ctx context.Context, objectname string) (io.ReadCloser, *ObjectInfo, error) {
+	return o.NewRangeReader(ctx, objectname, 0, -1)
+}
 
-	outputfile, err := os.Create(filename)
-	if err != nil {
-		return 0, err
+func (o *GCSUploader) NewRangeReader(ctx context.Context, objectname string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, nil, fmt.Errorf("bucket handle is not initialized")
 	}
-	defer outputfile.Close()
 
-	nbytescopied, err := io.Copy(outputfile, objectReader)
+	return rangeReader(ctx, o.bucketHandle.Object(objectname), offset, length)
+}
+
+func rangeReader(ctx context.Context, handle *storage.ObjectHandle, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	objectReader, err := handle.ReadCompressed(true).NewRangeReader(ctx, offset, length)
 	if err != nil {
-		return 0, err
+		return nil, nil, classifyError(err)
 	}
 
-	return nbytescopied, nil
+	info := &ObjectInfo{
+		Name:            handle.ObjectName(),
+		Size:            objectReader.Attrs.Size,
+		ContentType:     objectReader.Attrs.ContentType,
+		ContentEncoding: objectReader.Attrs.ContentEncoding,
+		CacheControl:    objectReader.Attrs.CacheControl,
+		Updated:         objectReader.Attrs.LastModified,
+		Generation:      objectReader.Attrs.Generation,
+		Metageneration:  objectReader.Attrs.Metageneration,
+	}
+	if objectReader.Attrs.CRC32C != 0 {
+		info.CRC32C = encodeCRC32C(objectReader.Attrs.CRC32C)
+	}
+	if metadata := objectReader.Metadata(); len(metadata) > 0 {
+		info.Metadata = metadata
+	}
+	return objectReader, info, nil
 }
 
 func (o *GCSUploader) ListObjects(ctx context.Context, prefix string) ([]string, error) {
@@ -149,7 +257,7 @@ func (o *GCSUploader) ListObjects(ctx context.Context, prefix string) ([]string,
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("error listing objects: %w", err)
+			return nil, fmt.Errorf("error listing objects: %w", classifyError(err))
 		}
 
 		objectNames = append(objectNames, objAttrs.Name)
@@ -158,22 +266,111 @@ func (o *GCSUploader) ListObjects(ctx context.Context, prefix string) ([]string,
 	return objectNames, nil
 }
 
+func (o *GCSUploader) ListObjectsPage(ctx context.Context, opts ListOptions) (*ObjectPage, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
+
+	query := &storage.Query{Prefix: opts.Prefix, Delimiter: opts.Delimiter}
+	it := o.bucketHandle.Objects(ctx, query)
+
+	var attrs []*storage.ObjectAttrs
+	nextPageToken, err := iterator.NewPager(it, opts.PageSize, opts.PageToken).NextPage(&attrs)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", classifyError(err))
+	}
+
+	page := &ObjectPage{Objects: []*ObjectInfo{}, NextPageToken: nextPageToken}
+	for _, objAttrs := range attrs {
+		if objAttrs.Prefix != "" {
+			page.Prefixes = append(page.Prefixes, objAttrs.Prefix)
+			continue
+		}
+		page.Objects = append(page.Objects, objectInfo(objAttrs))
+	}
+	return page, nil
+}
+
 func (o *GCSUploader) DeleteObject(ctx context.Context, objectName string) error {
+	return o.DeleteObjectIf(ctx, objectName, Conditions{})
+}
+
+func (o *GCSUploader) DeleteObjectIf(ctx context.Context, objectName string, conds Conditions) error {
 	if o.bucketHandle == nil {
 		return fmt.Errorf("bucket handle is not initialized")
 	}
 
 	objectHandle := o.bucketHandle.Object(objectName)
+	if !conds.isZero() {
+		objectHandle = objectHandle.If(conds.storageConditions())
+	}
 	if err := objectHandle.Delete(ctx); err != nil {
 		if errors.Is(err, storage.ErrObjectNotExist) {
-			return fmt.Errorf("object %q does not exist", objectName)
+			return newError(ErrNotFound, "object %q does not exist", objectName)
 		}
-		return fmt.Errorf("failed to delete object %q: %w", objectName, err)
+		return fmt.Errorf("failed to delete object %q: %w", objectName, classifyError(err))
 	}
 
 	return nil
 }
 
+// CopyObject copies an object server side. The destination conditions apply
+// to the object being overwritten. Copier.Run repeats the rewrite call until
+// GCS reports it done, which large or cross-location copies need.
+func (o *GCSUploader) CopyObject(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
+
+	return o.copy(ctx, o.bucketHandle.Object(srcName), dstName, conds)
+}
+
+func (o *GCSUploader) copy(ctx context.Context, src *storage.ObjectHandle, dstName string, conds Conditions) (*ObjectInfo, error) {
+	dst := o.bucketHandle.Object(dstName)
+	if !conds.isZero() {
+		dst = dst.If(conds.storageConditions())
+	}
+
+	attrs, err := dst.CopierFrom(src).Run(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, newError(ErrNotFound, "object %q does not exist", src.ObjectName())
+		}
+		return nil, fmt.Errorf("failed to copy object %q to %q: %w", src.ObjectName(), dstName, classifyError(err))
+	}
+	return objectInfo(attrs), nil
+}
+
+// MoveObject copies the live generation of an object and then deletes that
+// generation, so a source overwritten mid-move is kept rather than lost.
+func (o *GCSUploader) MoveObject(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
+	if srcName == dstName {
+		return nil, newError(ErrInvalidArgument, "cannot move object %q onto itself", srcName)
+	}
+
+	src := o.bucketHandle.Object(srcName)
+	srcAttrs, err := src.Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, newError(ErrNotFound, "object %q does not exist", srcName)
+		}
+		return nil, fmt.Errorf("failed to move object %q: %w", srcName, classifyError(err))
+	}
+
+	info, err := o.copy(ctx, src.Generation(srcAttrs.Generation), dstName, conds)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := src.If(storage.Conditions{GenerationMatch: srcAttrs.Generation}).Delete(ctx); err != nil {
+		return info, fmt.Errorf("copied object %q to %q but failed to delete the source: %w", srcName, dstName, classifyError(err))
+	}
+	return info, nil
+}
+
 func (o *GCSUploader) GetObjectUrl(ctx context.Context, objectName string) (string, error) {
 	if o.bucketHandle == nil {
 		return "", fmt.Errorf("bucket handle is not initialized")
@@ -189,3 +386,149 @@ func (o *GCSUploader) GetObjectUrl(ctx context.Context, objectName string) (stri
 	}
 	return signedUrl, nil
 }
+
+func (o *GCSUploader) SignedURL(ctx context.Context, objectName string, opts SignedURLOptions) (string, error) {
+	if o.bucketHandle == nil {
+		return "", fmt.Errorf("bucket handle is not initialized")
+	}
+
+	query := url.Values{}
+	if opts.Generation != 0 {
+		query.Set("generation", strconv.FormatInt(opts.Generation, 10))
+	}
+	if opts.ResponseContentDisposition != "" {
+		query.Set("response-content-disposition", opts.ResponseContentDisposition)
+	}
+
+	var headers []string
+	for name, value := range opts.requiredHeaders() {
+		switch name {
+		case "Content-Type", "Content-MD5":
+		default:
+			headers = append(headers, strings.ToLower(name)+":"+value)
+		}
+	}
+
+	signedUrl, err := o.bucketHandle.SignedURL(objectName, &storage.SignedURLOptions{
+		Scheme:          storage.SigningSchemeV4,
+		Method:          opts.Method,
+		Expires:         time.Now().Add(opts.Expiry),
+		ContentType:     opts.ContentType,
+		MD5:             opts.ContentMD5,
+		Headers:         headers,
+		QueryParameters: query,
+	})
+	if err != nil {
+		return "", err
+	}
+	return signedUrl, nil
+}
+
+// SignedPostPolicy signs a V4 POST policy for a form upload into
+// opts.Folder. Without a filename the key uses GCS's ${filename} placeholder,
+// which is replaced with the name of the uploaded file.
+func (o *GCSUploader) SignedPostPolicy(ctx context.Context, opts PostPolicyOptions) (*PostPolicy, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
+
+	filename := opts.Filename
+	if filename == "" {
+		filename = "${filename}"
+	}
+
+	fields := &storage.PolicyV4Fields{}
+	conditions := []storage.PostPolicyV4Condition{
+		storage.ConditionContentLengthRange(uint64(opts.MinSize), uint64(opts.MaxSize)),
+	}
+	if prefix, ok := strings.CutSuffix(opts.ContentType, "*"); ok {
+		conditions = append(conditions, storage.ConditionStartsWith("$Content-Type", prefix))
+	} else {
+		fields.ContentType = opts.ContentType
+	}
+	// The library has no exact condition on other fields; generations never
+	// start with a zero, so this only admits 0.
+	if opts.DoesNotExist {
+		conditions = append(conditions, storage.ConditionStartsWith("$x-goog-if-generation-match", "0"))
+	}
+
+	policy, err := o.bucketHandle.GenerateSignedPostPolicyV4(opts.Folder+"/"+filename, &storage.PostPolicyV4Options{
+		Expires:    time.Now().Add(opts.Expiry),
+		Fields:     fields,
+		Conditions: conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.DoesNotExist {
+		policy.Fields["x-goog-if-generation-match"] = "0"
+	}
+	return &PostPolicy{URL: policy.URL, Fields: policy.Fields}, nil
+}
+
+func (o *GCSUploader) ListVersions(ctx context.Context, objectname string) ([]*ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
+
+	var versions []*ObjectInfo
+
+	query := &storage.Query{Prefix: objectname, Versions: true}
+	it := o.bucketHandle.Objects(ctx, query)
+
+	for {
+		objAttrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error listing versions: %w", classifyError(err))
+		}
+
+		if objAttrs.Name == objectname {
+			versions = append(versions, objectInfo(objAttrs))
+		}
+	}
+
+	return versions, nil
+}
+
+func (o *GCSUploader) NewGenerationRangeReader(ctx context.Context, objectname string, generation, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, nil, fmt.Errorf("bucket handle is not initialized")
+	}
+
+	return rangeReader(ctx, o.bucketHandle.Object(objectname).Generation(generation), offset, length)
+}
+
+func (o *GCSUploader) RestoreVersion(ctx context.Context, objectname string, generation int64, conds Conditions) (*ObjectInfo, error) {
+	if o.bucketHandle == nil {
+		return nil, fmt.Errorf("bucket handle is not initialized")
+	}
+
+	dst := o.bucketHandle.Object(objectname)
+	if !conds.isZero() {
+		dst = dst.If(conds.storageConditions())
+	}
+
+	src := o.bucketHandle.Object(objectname).Generation(generation)
+	attrs, err := dst.CopierFrom(src).Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore object %q generation %d: %w", objectname, generation, classifyError(err))
+	}
+	return objectInfo(attrs), nil
+}
+
+func (o *GCSUploader) DeleteVersion(ctx context.Context, objectname string, generation int64) error {
+	if o.bucketHandle == nil {
+		return fmt.Errorf("bucket handle is not initialized")
+	}
+
+	if err := o.bucketHandle.Object(objectname).Generation(generation).Delete(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return newError(ErrNotFound, "object %q generation %d does not exist", objectname, generation)
+		}
+		return fmt.Errorf("failed to delete object %q generation %d: %w", objectname, generation, classifyError(err))
+	}
+	return nil
+}
@@ -2,46 +2,42 @@ package handler_test
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 
 	"gcsuploader/handler"
-)
+	"gcsuploader/internal/fakegcs"
 
-var (
-	testBucket      = "dmtfota"
-	testCredentials = "/home/akash/Downloads/gcsuploader/config/credentials.json"
+	"google.golang.org/api/option"
 )
 
-func requireEnv(t *testing.T) {
-	if testBucket == "" || testCredentials == "" {
-		t.Skip("GCS_TEST_BUCKET and GCS_CREDENTIALS_FILE must be set for integration tests")
-	}
+const testBucket = "dmtfota"
+
+func newFakeGCS(t *testing.T) *fakegcs.Server {
+	t.Helper()
+	fake := fakegcs.New()
+	t.Cleanup(fake.Close)
+	return fake
 }
 
-func newUploader(t *testing.T) *handler.GCSUploader {
-	creds, err := os.ReadFile(testCredentials)
-	if err != nil {
-		t.Fatalf("failed to read credentials: %v", err)
-	}
-	uploader := handler.NewGCSUploader(creds, testBucket)
+func newUploader(t *testing.T, fake *fakegcs.Server) *handler.GCSUploader {
+	t.Helper()
+	uploader := handler.NewGCSUploader(fake.CredentialsJSON(), testBucket, option.WithEndpoint(fake.Endpoint()))
 	if err := uploader.Init(); err != nil {
 		t.Fatalf("Init failed: %v", err)
 	}
 	return uploader
 }
 
-func TestGCSUploaderIntegration(t *testing.T) {
-	requireEnv(t)
+func TestGCSUploader(t *testing.T) {
 	ctx := context.Background()
+	fake := newFakeGCS(t)
+	uploader := newUploader(t, fake)
 
-	uploader := newUploader(t)
-
-	prefix := fmt.Sprintf("test-integration/%d/", time.Now().UnixNano())
+	prefix := "test-integration/"
 	objectName := prefix + "hello.txt"
 
 	downloadDir := t.TempDir()
@@ -56,22 +52,21 @@ func TestGCSUploaderIntegration(t *testing.T) {
 		if int(n) != len(content) {
 			t.Fatalf("expected %d bytes copied, got %d", len(content), n)
 		}
+		obj, ok := fake.Object(testBucket, objectName)
+		if !ok || string(obj.Data) != string(content) {
+			t.Fatalf("object not stored in bucket: %#v", obj)
+		}
 	})
 
 	t.Run("ListObjects", func(t *testing.T) {
+		fake.PutObject(testBucket, "other/ignored.txt", []byte("x"))
+
 		objs, err := uploader.ListObjects(ctx, prefix)
 		if err != nil {
 			t.Fatalf("ListObjects failed: %v", err)
 		}
-		found := false
-		for _, obj := range objs {
-			if obj == objectName {
-				found = true
-				break
-			}
-		}
-		if !found {
-			t.Fatalf("expected object %q in list, got %v", objectName, objs)
+		if len(objs) != 1 || objs[0] != objectName {
+			t.Fatalf("expected [%q], got %v", objectName, objs)
 		}
 	})
 
@@ -88,7 +83,7 @@ func TestGCSUploaderIntegration(t *testing.T) {
 		if err != nil {
 			t.Fatalf("reading downloaded file failed: %v", err)
 		}
-		if !strings.Contains(string(data), "Hello, GCS!") {
+		if string(data) != "Hello, GCS!" {
 			t.Fatalf("unexpected file content: %s", string(data))
 		}
 	})
@@ -116,6 +111,28 @@ func TestGCSUploaderIntegration(t *testing.T) {
 		}
 	})
 
+	t.Run("UploadFileChunked", func(t *testing.T) {
+		content := strings.Repeat("chunked upload ", 40000)
+		n, err := uploader.UploadFile(ctx, strings.NewReader(content), prefix+"chunked.bin", 256*1024, nil)
+		if err != nil {
+			t.Fatalf("UploadFile failed: %v", err)
+		}
+		obj, ok := fake.Object(testBucket, prefix+"chunked.bin")
+		if !ok || int(n) != len(content) || string(obj.Data) != content {
+			t.Fatalf("chunked upload mismatch: wrote %d bytes", n)
+		}
+	})
+
+	t.Run("GetObjectUrl", func(t *testing.T) {
+		signed, err := uploader.GetObjectUrl(ctx, objectName)
+		if err != nil {
+			t.Fatalf("GetObjectUrl failed: %v", err)
+		}
+		if !strings.Contains(signed, "Signature=") || !strings.Contains(signed, "hello.txt") {
+			t.Fatalf("unexpected signed url: %s", signed)
+		}
+	})
+
 	t.Run("DeleteObject", func(t *testing.T) {
 		if err := uploader.DeleteObject(ctx, objectName); err != nil {
 			t.Fatalf("DeleteObject failed: %v", err)
@@ -131,4 +148,64 @@ func TestGCSUploaderIntegration(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("DeleteMissingObject", func(t *testing.T) {
+		err := uploader.DeleteObject(ctx, objectName)
+		if err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Fatalf("expected does not exist error, got %v", err)
+		}
+	})
+
+	t.Run("DownloadMissingObject", func(t *testing.T) {
+		_, err := uploader.DownloadFile(ctx, prefix+"missing.txt", downloadDir)
+		if err == nil {
+			t.Fatal("expected error downloading missing object")
+		}
+	})
+}
+
+func TestGCSUploaderNotInitialized(t *testing.T) {
+	uploader := handler.NewGCSUploader(nil, testBucket)
+	_, err := uploader.ListObjects(context.Background(), "")
+	if err == nil || !strings.Contains(err.Error(), "not initialized") {
+		t.Fatalf("expected not initialized error, got %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := handler.NewMemoryStore(testBucket)
+
+	if _, err := store.UploadBuffer(ctx, []byte("v1"), "a.txt", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	first, _ := store.Object("a.txt")
+	if _, err := store.UploadBuffer(ctx, []byte("v2"), "a.txt", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	second, _ := store.Object("a.txt")
+
+	if second.Generation <= first.Generation || string(second.Data) != "v2" {
+		t.Fatalf("expected a newer generation, got %d after %d", second.Generation, first.Generation)
+	}
+	if versions := store.NoncurrentVersions("a.txt"); len(versions) != 1 || string(versions[0].Data) != "v1" {
+		t.Fatalf("expected v1 to be noncurrent, got %#v", versions)
+	}
+
+	if err := store.SetMetadata("a.txt", map[string]string{"release": "1.0"}); err != nil {
+		t.Fatalf("SetMetadata failed: %v", err)
+	}
+	updated, _ := store.Object("a.txt")
+	if updated.Metageneration != 2 || updated.Metadata["release"] != "1.0" {
+		t.Fatalf("unexpected metadata update: %#v", updated)
+	}
+
+	boom := errors.New("boom")
+	store.InjectFailure("DeleteObject", boom, 1)
+	if err := store.DeleteObject(ctx, "a.txt"); !errors.Is(err, boom) {
+		t.Fatalf("expected injected failure, got %v", err)
+	}
+	if err := store.DeleteObject(ctx, "a.txt"); err != nil {
+		t.Fatalf("expected failure to be consumed, got %v", err)
+	}
 }
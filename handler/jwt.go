@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+const jwtLeeway = time.Minute
+
+var (
+	jwtVerifier *tokenVerifier
+
+	jwtAlgorithms = []jose.SignatureAlgorithm{
+		jose.RS256, jose.RS384, jose.RS512,
+		jose.PS256, jose.PS384, jose.PS512,
+		jose.ES256, jose.ES384, jose.ES512,
+		jose.EdDSA,
+	}
+)
+
+// JWTConfig enables bearer tokens signed by a key from the JWKS at JWKSFile
+// or JWKSURL. Fetched keys are reused for CacheTTL; a token signed with an
+// unknown key id triggers an early fetch, at most once per MinRefresh, so key
+// rotations are picked up.
+type JWTConfig struct {
+	JWKSFile   string
+	JWKSURL    string
+	Issuer     string
+	Audience   string
+	CacheTTL   time.Duration
+	MinRefresh time.Duration
+}
+
+// tokenClaims are the claims mapped onto a Principal: "scope" is a space
+// separated list of operations and "folders" the allowed folder prefixes.
+// Unlike API keys, tokens must always carry folders; ["*"] grants the whole
+// bucket.
+type tokenClaims struct {
+	Scope   string   `json:"scope"`
+	Folders []string `json:"folders"`
+}
+
+type tokenVerifier struct {
+	jwksFile   string
+	jwksURL    string
+	issuer     string
+	audience   string
+	cacheTTL   time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	// fetches shares one JWKS fetch between concurrent refreshes. It runs
+	// without mu held, so requests signed with cached keys are not blocked
+	// by a slow issuer.
+	fetches singleflight.Group
+
+	mu      sync.Mutex
+	keys    jose.JSONWebKeySet
+	checked time.Time
+}
+
+func ConfigureJWT(cfg JWTConfig) error {
+	if cfg.JWKSFile == "" && cfg.JWKSURL == "" {
+		jwtVerifier = nil
+		return nil
+	}
+	if cfg.JWKSFile != "" && cfg.JWKSURL != "" {
+		return fmt.Errorf("only one of a JWKS file or url may be configured")
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return fmt.Errorf("JWT issuer and audience are required")
+	}
+
+	v := &tokenVerifier{
+		jwksFile:   cfg.JWKSFile,
+		jwksURL:    cfg.JWKSURL,
+		issuer:     cfg.Issuer,
+		audience:   cfg.Audience,
+		cacheTTL:   cfg.CacheTTL,
+		minRefresh: cfg.MinRefresh,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.cacheTTL <= 0 {
+		v.cacheTTL = time.Hour
+	}
+	if v.minRefresh <= 0 {
+		v.minRefresh = time.Minute
+	}
+
+	// Load the keys now so that a bad configuration fails at startup.
+	if err := v.refresh(context.Background()); err != nil {
+		return err
+	}
+	jwtVerifier = v
+	return nil
+}
+
+// refresh fetches the JWKS and swaps it in. A failed fetch keeps the cached
+// keys but still counts as a check, so a failing issuer is not retried on
+// every request.
+func (v *tokenVerifier) refresh(ctx context.Context) error {
+	_, err, _ := v.fetches.Do("jwks", func() (any, error) {
+		// The fetch is shared, so one caller going away must not fail it.
+		keys, err := v.fetch(context.WithoutCancel(ctx))
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.checked = time.Now()
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+		return nil, nil
+	})
+	return err
+}
+
+func (v *tokenVerifier) fetch(ctx context.Context) (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	var data []byte
+	if v.jwksFile != "" {
+		var err error
+		if data, err = os.ReadFile(v.jwksFile); err != nil {
+			return keys, err
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+		if err != nil {
+			return keys, err
+		}
+		res, err := v.client.Do(req)
+		if err != nil {
+			return keys, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return keys, fmt.Errorf("fetching JWKS from %s: %s", v.jwksURL, res.Status)
+		}
+		if data, err = io.ReadAll(res.Body); err != nil {
+			return keys, err
+		}
+	}
+
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return keys, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	return keys, nil
+}
+
+// key returns the key with the given id, fetching the JWKS again when the
+// cache has expired or the id is unknown. The cached keys keep being used if
+// a fetch fails.
+func (v *tokenVerifier) key(ctx context.Context, kid string) (any, error) {
+	v.mu.Lock()
+	keys := v.keys.Key(kid)
+	since := time.Since(v.checked)
+	v.mu.Unlock()
+
+	if since > v.cacheTTL || (len(keys) == 0 && since > v.minRefresh) {
+		if err := v.refresh(ctx); err != nil {
+			log.Printf("Failed to refresh JWKS: %v", err)
+		}
+		v.mu.Lock()
+		keys = v.keys.Key(kid)
+		v.mu.Unlock()
+	}
+
+	if len(keys) == 0 {
+		return nil, newError(ErrUnauthenticated, "bearer token signed with unknown key %q", kid)
+	}
+	return keys[0].Key, nil
+}
+
+func (v *tokenVerifier) verify(ctx context.Context, raw string) (*Principal, error) {
+	token, err := jwt.ParseSigned(raw, jwtAlgorithms)
+	if err != nil {
+		return nil, newError(ErrUnauthenticated, "malformed bearer token")
+	}
+
+	key, err := v.key(ctx, token.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.Claims
+	var custom tokenClaims
+	if err := token.Claims(key, &claims, &custom); err != nil {
+		return nil, newError(ErrUnauthenticated, "invalid bearer token signature")
+	}
+	if claims.Expiry == nil {
+		return nil, newError(ErrUnauthenticated, "bearer token has no expiry")
+	}
+	expected := jwt.Expected{Issuer: v.issuer, AnyAudience: jwt.Audience{v.audience}, Time: time.Now()}
+	if err := claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return nil, newError(ErrUnauthenticated, "bearer token rejected: %v", err)
+	}
+
+	principal := &Principal{Name: claims.Subject}
+	for _, op := range strings.Fields(custom.Scope) {
+		if slices.Contains(operations, op) {
+			principal.Operations = append(principal.Operations, op)
+		}
+	}
+	// A token minted without thought for folders must not grant the whole
+	// bucket, so that takes an explicit "*".
+	if len(custom.Folders) == 0 {
+		return nil, newError(ErrUnauthenticated, `bearer token has no folders claim: list its folders, or "*" for the whole bucket`)
+	}
+	if slices.Equal(custom.Folders, []string{"*"}) {
+		return principal, nil
+	}
+	for _, folder := range custom.Folders {
+		clean, err := cleanPrefix(folder)
+		if err != nil || clean == "" || folder == "*" {
+			return nil, newError(ErrUnauthenticated, "bearer token has an invalid folder %q", folder)
+		}
+		principal.Folders = append(principal.Folders, strings.TrimSuffix(clean, "/"))
+	}
+	return principal, nil
+}
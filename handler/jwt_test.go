@@ -0,0 +1,227 @@
+package handler_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gcsuploader/handler"
+	"gcsuploader/internal/fakeoidc"
+)
+
+const testAudience = "gcs-uploader"
+
+func newOIDC(t *testing.T) *fakeoidc.Server {
+	t.Helper()
+	issuer := fakeoidc.New()
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func configureJWT(t *testing.T, cfg handler.JWTConfig) {
+	t.Helper()
+	if err := handler.ConfigureJWT(cfg); err != nil {
+		t.Fatalf("ConfigureJWT failed: %v", err)
+	}
+	t.Cleanup(func() { handler.ConfigureJWT(handler.JWTConfig{}) })
+}
+
+// issueToken signs a valid token for the reader and applies overrides; a nil
+// override removes the claim.
+func issueToken(issuer *fakeoidc.Server, overrides map[string]any) string {
+	claims := map[string]any{
+		"iss":     issuer.Issuer(),
+		"aud":     testAudience,
+		"sub":     "reader",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+		"scope":   "openid list download",
+		"folders": []string{"public"},
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return issuer.Token(claims)
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestJWTAuth(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+	for _, name := range []string{"public/a.txt", "private/b.txt"} {
+		if _, err := store.UploadBuffer(context.Background(), []byte(name), name, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+
+	issuer := newOIDC(t)
+	configureJWT(t, handler.JWTConfig{JWKSURL: issuer.JWKSURL(), Issuer: issuer.Issuer(), Audience: testAudience})
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"valid token", "/download-file?objectname=public/a.txt", issueToken(issuer, nil), http.StatusOK},
+		{"audience list", "/list-files?folder=public", issueToken(issuer, map[string]any{"aud": []string{"other", testAudience}}), http.StatusOK},
+		{"folder not granted", "/download-file?objectname=private/b.txt", issueToken(issuer, nil), http.StatusForbidden},
+		{"scope not granted", "/download-file?objectname=public/a.txt", issueToken(issuer, map[string]any{"scope": "list"}), http.StatusForbidden},
+		{"no folders claim", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": nil}), http.StatusUnauthorized},
+		{"no folders", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": []string{}}), http.StatusUnauthorized},
+		{"whole bucket", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": []string{"*"}}), http.StatusOK},
+		{"whole bucket among folders", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": []string{"public", "*"}}), http.StatusUnauthorized},
+		{"parent folder", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": []string{"public/../private"}}), http.StatusUnauthorized},
+		{"empty folder", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": []string{""}}), http.StatusUnauthorized},
+		{"root folder", "/download-file?objectname=private/b.txt", issueToken(issuer, map[string]any{"folders": []string{"public", "/"}}), http.StatusUnauthorized},
+		{"expired", "/list-files?folder=public", issueToken(issuer, map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		{"no expiry", "/list-files?folder=public", issueToken(issuer, map[string]any{"exp": nil}), http.StatusUnauthorized},
+		{"wrong issuer", "/list-files?folder=public", issueToken(issuer, map[string]any{"iss": "https://evil.example"}), http.StatusUnauthorized},
+		{"wrong audience", "/list-files?folder=public", issueToken(issuer, map[string]any{"aud": "other"}), http.StatusUnauthorized},
+		{"malformed", "/list-files?folder=public", "not-a-jwt", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, _ := doRequest(t, http.MethodGet, srv.URL+tt.path, nil, bearer(tt.token))
+			if res.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, res.StatusCode)
+			}
+			if tt.status == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("expected a WWW-Authenticate challenge")
+			}
+		})
+	}
+
+	if n := issuer.JWKSRequests(); n != 1 {
+		t.Fatalf("expected the JWKS to be fetched once and cached, got %d fetches", n)
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	issuer := newOIDC(t)
+	configureJWT(t, handler.JWTConfig{
+		JWKSURL:    issuer.JWKSURL(),
+		Issuer:     issuer.Issuer(),
+		Audience:   testAudience,
+		MinRefresh: time.Nanosecond,
+	})
+
+	oldToken := issueToken(issuer, nil)
+	if res, _ := doRequest(t, http.MethodGet, srv.URL+"/list-files?folder=public", nil, bearer(oldToken)); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 before rotation, got %d", res.StatusCode)
+	}
+
+	issuer.Rotate()
+	newToken := issueToken(issuer, nil)
+	if res, _ := doRequest(t, http.MethodGet, srv.URL+"/list-files?folder=public", nil, bearer(newToken)); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the rotated key to be fetched, got %d", res.StatusCode)
+	}
+	if n := issuer.JWKSRequests(); n != 2 {
+		t.Fatalf("expected 2 JWKS fetches, got %d", n)
+	}
+	if res, _ := doRequest(t, http.MethodGet, srv.URL+"/list-files?folder=public", nil, bearer(oldToken)); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the retired key to be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestJWTSlowRefresh(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	issuer := newOIDC(t)
+	configureJWT(t, handler.JWTConfig{
+		JWKSURL:    issuer.JWKSURL(),
+		Issuer:     issuer.Issuer(),
+		Audience:   testAudience,
+		MinRefresh: time.Nanosecond,
+	})
+	oldToken := issueToken(issuer, nil)
+
+	issuer.Rotate()
+	release := issuer.Hold()
+	t.Cleanup(release)
+
+	refreshed := make(chan int)
+	newToken := issueToken(issuer, nil)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/list-files?folder=public", nil)
+		req.Header.Set("Authorization", "Bearer "+newToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			refreshed <- 0
+			return
+		}
+		res.Body.Close()
+		refreshed <- res.StatusCode
+	}()
+	for issuer.JWKSRequests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The refresh is stalled, but tokens signed with a cached key still verify.
+	if res, _ := doRequest(t, http.MethodGet, srv.URL+"/list-files?folder=public", nil, bearer(oldToken)); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 while the JWKS refresh is in flight, got %d", res.StatusCode)
+	}
+
+	release()
+	if status := <-refreshed; status != http.StatusOK {
+		t.Fatalf("expected the rotated key to be fetched, got %d", status)
+	}
+}
+
+func TestJWTFromFileWithAPIKeys(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	issuer := newOIDC(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, issuer.JWKS(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	configureJWT(t, handler.JWTConfig{JWKSFile: jwksFile, Issuer: issuer.Issuer(), Audience: testAudience})
+	configureAuth(t, handler.AuthConfig{APIKeys: []handler.APIKey{
+		{Name: "lister", Hash: handler.HashAPIKey("list-key"), Operations: []string{"list"}},
+	}})
+
+	if res, _ := doRequest(t, http.MethodGet, srv.URL+"/list-files?folder=public", nil, bearer(issueToken(issuer, nil))); res.StatusCode != http.StatusOK {
+		t.Fatalf("bearer token: expected 200, got %d", res.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/list-files", nil)
+	req.Header.Set("X-API-Key", "list-key")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("API key: expected 200, got %d", res.StatusCode)
+	}
+}
+
+func TestConfigureJWTErrors(t *testing.T) {
+	issuer := newOIDC(t)
+	tests := map[string]handler.JWTConfig{
+		"file and url":     {JWKSFile: "jwks.json", JWKSURL: issuer.JWKSURL(), Issuer: issuer.Issuer(), Audience: testAudience},
+		"missing issuer":   {JWKSURL: issuer.JWKSURL(), Audience: testAudience},
+		"missing audience": {JWKSURL: issuer.JWKSURL(), Issuer: issuer.Issuer()},
+		"missing file":     {JWKSFile: filepath.Join(t.TempDir(), "jwks.json"), Issuer: issuer.Issuer(), Audience: testAudience},
+		"bad url":          {JWKSURL: issuer.Issuer() + "/missing", Issuer: issuer.Issuer(), Audience: testAudience},
+	}
+	for name, cfg := range tests {
+		if err := handler.ConfigureJWT(cfg); err == nil {
+			handler.ConfigureJWT(handler.JWTConfig{})
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
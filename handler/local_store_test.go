@@ -0,0 +1,285 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newLocalStore(t *testing.T, publicURL string) *handler.LocalStore {
+	t.Helper()
+	store := handler.NewLocalStore(t.TempDir(), []byte("test-signing-key"), publicURL)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	return store
+}
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store := newLocalStore(t, "http://localhost:8080")
+
+	objects := map[string]string{
+		"firmware/v1/app.bin":  "v1 image",
+		"firmware/v2/app.bin":  "v2 image",
+		"firmware-old/app.bin": "old image",
+		"readme.txt":           "hello",
+	}
+	for name, content := range objects {
+		n, err := store.UploadBuffer(ctx, []byte(content), name, 0, nil)
+		if err != nil {
+			t.Fatalf("UploadBuffer(%q) failed: %v", name, err)
+		}
+		if int(n) != len(content) {
+			t.Fatalf("expected %d bytes, got %d", len(content), n)
+		}
+	}
+
+	t.Run("ListObjects", func(t *testing.T) {
+		cases := map[string][]string{
+			"firmware/":   {"firmware/v1/app.bin", "firmware/v2/app.bin"},
+			"firmware":    {"firmware-old/app.bin", "firmware/v1/app.bin", "firmware/v2/app.bin"},
+			"firmware/v1": {"firmware/v1/app.bin"},
+			"missing/":    nil,
+		}
+		for prefix, want := range cases {
+			got, err := store.ListObjects(ctx, prefix)
+			if err != nil {
+				t.Fatalf("ListObjects(%q) failed: %v", prefix, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("ListObjects(%q) = %v, want %v", prefix, got, want)
+			}
+		}
+	})
+
+	t.Run("DownloadFile", func(t *testing.T) {
+		dest := t.TempDir()
+		n, err := store.DownloadFile(ctx, "firmware/v2/app.bin", dest)
+		if err != nil {
+			t.Fatalf("DownloadFile failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(dest, "app.bin"))
+		if err != nil {
+			t.Fatalf("reading downloaded file failed: %v", err)
+		}
+		if string(data) != "v2 image" || int(n) != len(data) {
+			t.Fatalf("unexpected download %q (%d bytes)", data, n)
+		}
+	})
+
+	t.Run("InvalidNames", func(t *testing.T) {
+		for _, name := range []string{"", "../escape", "a/../../b", "folder/", "/abs"} {
+			if _, err := store.UploadBuffer(ctx, []byte("x"), name, 0, nil); err == nil {
+				t.Fatalf("expected error for object name %q", name)
+			}
+		}
+	})
+
+	t.Run("DeleteObject", func(t *testing.T) {
+		if err := store.DeleteObject(ctx, "firmware/v1/app.bin"); err != nil {
+			t.Fatalf("DeleteObject failed: %v", err)
+		}
+		err := store.DeleteObject(ctx, "firmware/v1/app.bin")
+		if err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Fatalf("expected does not exist error, got %v", err)
+		}
+	})
+}
+
+func TestLocalStoreSignedURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/v1/gcs/local-object", handler.ServeLocalObject)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	store := newLocalStore(t, srv.URL)
+	handler.SetObjectStore(store)
+
+	if _, err := store.UploadBuffer(context.Background(), []byte("signed content"), "docs/a.txt", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+
+	signed, err := store.GetObjectUrl(context.Background(), "docs/a.txt")
+	if err != nil {
+		t.Fatalf("GetObjectUrl failed: %v", err)
+	}
+
+	res, err := http.Get(signed)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "signed content" {
+		t.Fatalf("expected signed content, got %d %q", res.StatusCode, body)
+	}
+
+	tampered, _ := url.Parse(signed)
+	q := tampered.Query()
+	q.Set("objectname", "docs/b.txt")
+	tampered.RawQuery = q.Encode()
+
+	res, err = http.Get(tampered.String())
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for tampered url, got %d", res.StatusCode)
+	}
+}
+
+func TestLocalStoreAttrs(t *testing.T) {
+	store := newLocalStore(t, "http://localhost:8080")
+	srv := newTestServer(t, store)
+
+	body, contentType := multipartBody(t, map[string]string{
+		"folder":             "fw",
+		"contentType":        "application/x-firmware",
+		"cacheControl":       "no-cache",
+		"contentDisposition": `inline; filename="image.bin"`,
+		"x-meta-build":       "42",
+	}, "app.bin", []byte("firmware"))
+	res, err := http.Post(srv.URL+"/upload-file", contentType, body)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if ar := parseResp(t, res); res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", res.StatusCode, ar.Error)
+	}
+
+	check := func(objectname string) {
+		t.Helper()
+		info, err := store.StatObject(t.Context(), objectname)
+		if err != nil {
+			t.Fatalf("StatObject(%q) failed: %v", objectname, err)
+		}
+		if info.ContentType != "application/x-firmware" || info.CacheControl != "no-cache" || info.Metadata["build"] != "42" {
+			t.Fatalf("expected %s to keep its attributes, got %+v", objectname, info)
+		}
+	}
+	check("fw/app.bin")
+
+	res, content := doGet(t, srv.URL+"/download-file?objectname=fw/app.bin", nil)
+	if res.Header.Get("Content-Disposition") != `inline; filename="image.bin"` || res.Header.Get("Cache-Control") != "no-cache" || string(content) != "firmware" {
+		t.Fatalf("expected the stored headers, got %v", res.Header)
+	}
+
+	if _, err := store.CopyObject(t.Context(), "fw/app.bin", "fw/copy.bin", handler.Conditions{}); err != nil {
+		t.Fatalf("CopyObject failed: %v", err)
+	}
+	check("fw/copy.bin")
+	if _, err := store.MoveObject(t.Context(), "fw/copy.bin", "fw/moved.bin", handler.Conditions{}); err != nil {
+		t.Fatalf("MoveObject failed: %v", err)
+	}
+	check("fw/moved.bin")
+
+	// An overwrite replaces the attributes, and a deleted object leaves none
+	// behind for the next one of the same name.
+	if _, err := store.UploadBuffer(t.Context(), []byte("plain"), "fw/app.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	if info, _ := store.StatObject(t.Context(), "fw/app.bin"); info.ContentType != "application/octet-stream" || info.Metadata != nil {
+		t.Fatalf("expected the attributes to be replaced, got %+v", info)
+	}
+	if err := store.DeleteObject(t.Context(), "fw/moved.bin"); err != nil {
+		t.Fatalf("DeleteObject failed: %v", err)
+	}
+	if _, err := store.UploadBuffer(t.Context(), []byte("plain"), "fw/moved.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	if info, _ := store.StatObject(t.Context(), "fw/moved.bin"); info.CacheControl != "" {
+		t.Fatalf("expected no attributes after delete, got %+v", info)
+	}
+
+	names, err := store.ListObjects(t.Context(), "")
+	if err != nil || !reflect.DeepEqual(names, []string{"fw/app.bin", "fw/moved.bin"}) {
+		t.Fatalf("expected the sidecars not to be listed, got %v %v", names, err)
+	}
+	if _, err := store.UploadBuffer(t.Context(), []byte("x"), ".gcsuploader-attrs/x.json", 0, nil); err == nil {
+		t.Fatal("expected the attributes directory to be rejected as an object name")
+	}
+}
+
+func TestLocalStoreGenerations(t *testing.T) {
+	ctx := context.Background()
+	store := newLocalStore(t, "http://localhost:8080")
+
+	// Every write, however quick, gets a generation the next one can be
+	// conditioned on, and a recreated object does not reuse an old one.
+	var generations []int64
+	write := func(conds handler.Conditions) {
+		t.Helper()
+		info, err := store.UploadStream(ctx, strings.NewReader("firmware"), "fw/app.bin", handler.UploadOptions{Conditions: conds})
+		if err != nil {
+			t.Fatalf("UploadStream failed: %v", err)
+		}
+		if n := len(generations); n > 0 && info.Generation <= generations[n-1] {
+			t.Fatalf("generation %d does not follow %d", info.Generation, generations[n-1])
+		}
+		if stat, err := store.StatObject(ctx, "fw/app.bin"); err != nil || stat.Generation != info.Generation {
+			t.Fatalf("expected StatObject to report generation %d, got %+v %v", info.Generation, stat, err)
+		}
+		generations = append(generations, info.Generation)
+	}
+
+	write(handler.Conditions{DoesNotExist: true})
+	for range 10 {
+		write(handler.Conditions{GenerationMatch: generations[len(generations)-1]})
+	}
+	if _, err := store.UploadStream(ctx, strings.NewReader("stale"), "fw/app.bin", handler.UploadOptions{Conditions: handler.Conditions{GenerationMatch: generations[0]}}); !errors.Is(err, handler.ErrPreconditionFailed) {
+		t.Fatalf("expected a stale generation to fail, got %v", err)
+	}
+	if err := store.DeleteObject(ctx, "fw/app.bin"); err != nil {
+		t.Fatalf("DeleteObject failed: %v", err)
+	}
+	write(handler.Conditions{DoesNotExist: true})
+}
+
+func TestLocalStoreChecksums(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store := handler.NewLocalStore(root, []byte("test-signing-key"), "http://localhost:8080")
+	if err := store.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	info, err := store.UploadStream(ctx, strings.NewReader("firmware"), "fw/app.bin", handler.UploadOptions{})
+	if err != nil {
+		t.Fatalf("UploadStream failed: %v", err)
+	}
+	stat, err := store.StatObject(ctx, "fw/app.bin")
+	if err != nil {
+		t.Fatalf("StatObject failed: %v", err)
+	}
+	if stat.CRC32C == "" || stat.CRC32C != info.CRC32C || !reflect.DeepEqual(stat.MD5, info.MD5) {
+		t.Fatalf("expected the hashes to be stored, got %+v and %+v", stat, info)
+	}
+
+	// Content changed behind the store's back, keeping the modification
+	// time, fails the download instead of being handed on.
+	filename := filepath.Join(root, "fw", "app.bin")
+	if err := os.WriteFile(filename, []byte("corruptd"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Chtimes(filename, stat.Updated, stat.Updated); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if _, err := store.DownloadFile(ctx, "fw/app.bin", t.TempDir()); !errors.Is(err, handler.ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,598 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BackendMemory = "memory"
+
+type MemoryObject struct {
+	Name               string
+	Data               []byte
+	Generation         int64
+	Metageneration     int64
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+	Created            time.Time
+	Updated            time.Time
+	Deleted            time.Time
+}
+
+type memoryFailure struct {
+	err   error
+	times int
+}
+
+type MemoryStore struct {
+	bucket string
+
+	mu             sync.Mutex
+	objects        map[string]*MemoryObject
+	noncurrent     map[string][]*MemoryObject
+	nextGeneration int64
+	failures       map[string]*memoryFailure
+	now            func() time.Time
+}
+
+var (
+	_ ObjectStore    = (*MemoryStore)(nil)
+	_ VersionedStore = (*MemoryStore)(nil)
+	_ AttrsStore     = (*MemoryStore)(nil)
+)
+
+func NewMemoryStore(bucket string) *MemoryStore {
+	return &MemoryStore{
+		bucket:         bucket,
+		objects:        make(map[string]*MemoryObject),
+		noncurrent:     make(map[string][]*MemoryObject),
+		nextGeneration: time.Now().UnixMicro(),
+		failures:       make(map[string]*memoryFailure),
+		now:            time.Now,
+	}
+}
+
+// InjectFailure makes the next times calls of op (an ObjectStore method name
+// such as "UploadFile") fail with err. A times value <= 0 fails every call
+// until ClearFailures is called.
+func (o *MemoryStore) InjectFailure(op string, err error, times int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failures[op] = &memoryFailure{err: err, times: times}
+}
+
+func (o *MemoryStore) ClearFailures() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failures = make(map[string]*memoryFailure)
+}
+
+func (o *MemoryStore) SetClock(now func() time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.now = now
+}
+
+func (o *MemoryStore) Object(name string) (MemoryObject, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	obj, ok := o.objects[name]
+	if !ok {
+		return MemoryObject{}, false
+	}
+	return obj.clone(), true
+}
+
+func (o *MemoryStore) NoncurrentVersions(name string) []MemoryObject {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var versions []MemoryObject
+	for _, obj := range o.noncurrent[name] {
+		versions = append(versions, obj.clone())
+	}
+	return versions
+}
+
+func (o *MemoryStore) SetMetadata(name string, metadata map[string]string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	obj, ok := o.objects[name]
+	if !ok {
+		return newError(ErrNotFound, "object %q does not exist", name)
+	}
+	obj.Metadata = maps.Clone(metadata)
+	obj.Metageneration++
+	obj.Updated = o.now()
+	return nil
+}
+
+func (o *MemoryStore) failure(op string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, ok := o.failures[op]
+	if !ok {
+		return nil
+	}
+	if f.times > 0 {
+		f.times--
+		if f.times == 0 {
+			delete(o.failures, op)
+		}
+	}
+	return f.err
+}
+
+func (o *MemoryStore) put(name string, data []byte, attrs ObjectAttrs, conds Conditions) (*ObjectInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var current *ObjectInfo
+	if prev, ok := o.objects[name]; ok {
+		current = prev.info()
+	}
+	if err := conds.check(name, current); err != nil {
+		return nil, err
+	}
+
+	now := o.now()
+	o.nextGeneration++
+	obj := &MemoryObject{
+		Name:               name,
+		Data:               data,
+		Generation:         o.nextGeneration,
+		Metageneration:     1,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		Metadata:           maps.Clone(attrs.Metadata),
+		Created:            now,
+		Updated:            now,
+	}
+
+	if prev, ok := o.objects[name]; ok {
+		o.archive(prev)
+	}
+	o.objects[name] = obj
+	return obj.info(), nil
+}
+
+func (o *MemoryStore) archive(obj *MemoryObject) {
+	obj.Deleted = o.now()
+	o.noncurrent[obj.Name] = append(o.noncurrent[obj.Name], obj)
+}
+
+func (o *MemoryStore) lookup(name string, generation int64) (*MemoryObject, bool) {
+	if obj, ok := o.objects[name]; ok && obj.Generation == generation {
+		return obj, true
+	}
+	for _, obj := range o.noncurrent[name] {
+		if obj.Generation == generation {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+func (o *MemoryStore) UploadFile(ctx context.Context, file io.Reader, objectname string, writerChunkSize int, progressf func(int64)) (int64, error) {
+	if err := o.failure("UploadFile"); err != nil {
+		return 0, err
+	}
+	info, err := o.upload(ctx, file, objectname, UploadOptions{ChunkSize: writerChunkSize, ProgressFunc: progressf})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (o *MemoryStore) UploadBuffer(ctx context.Context, filecontent []byte, objectname string, writerChunkSize int, progressf func(int64)) (int64, error) {
+	if err := o.failure("UploadBuffer"); err != nil {
+		return 0, err
+	}
+	info, err := o.upload(ctx, bytes.NewReader(filecontent), objectname, UploadOptions{ChunkSize: writerChunkSize, ProgressFunc: progressf})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (o *MemoryStore) UploadStream(ctx context.Context, file io.Reader, objectname string, opts UploadOptions) (*ObjectInfo, error) {
+	if err := o.failure("UploadStream"); err != nil {
+		return nil, err
+	}
+	return o.upload(ctx, file, objectname, opts)
+}
+
+func (o *MemoryStore) upload(ctx context.Context, file io.Reader, objectname string, opts UploadOptions) (*ObjectInfo, error) {
+	if objectname == "" {
+		return nil, newError(ErrInvalidArgument, "object name is empty")
+	}
+
+	var buf bytes.Buffer
+	hasher := newObjectHasher()
+	nbytescopied, err := io.Copy(io.MultiWriter(&buf, hasher), &contextReader{ctx: ctx, r: file})
+	if err != nil {
+		return nil, fmt.Errorf("io.Copy: %w", err)
+	}
+	if err := hasher.verify(opts); err != nil {
+		return nil, err
+	}
+
+	info, err := o.put(objectname, buf.Bytes(), opts.Attrs, opts.Conditions)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ProgressFunc != nil {
+		opts.ProgressFunc(nbytescopied)
+	}
+	return info, nil
+}
+
+func (o *MemoryStore) DownloadFile(ctx context.Context, objectname string, destination string) (int64, error) {
+	if err := o.failure("DownloadFile"); err != nil {
+		return 0, err
+	}
+
+	info, err := downloadToFile(ctx, o, objectname, destination)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (o *MemoryStore) NewReader(ctx context.Context, objectname string) (io.ReadCloser, *ObjectInfo, error) {
+	return o.NewRangeReader(ctx, objectname, 0, -1)
+}
+
+func (o *MemoryStore) NewRangeReader(ctx context.Context, objectname string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if err := o.failure("NewRangeReader"); err != nil {
+		return nil, nil, err
+	}
+
+	obj, ok := o.Object(objectname)
+	if !ok {
+		return nil, nil, newError(ErrNotFound, "object %q does not exist", objectname)
+	}
+
+	start, end := rangeBounds(int64(len(obj.Data)), offset, length)
+	return io.NopCloser(bytes.NewReader(obj.Data[start:end])), obj.info(), nil
+}
+
+func (o *MemoryStore) StatObject(ctx context.Context, objectname string) (*ObjectInfo, error) {
+	if err := o.failure("StatObject"); err != nil {
+		return nil, err
+	}
+
+	obj, ok := o.Object(objectname)
+	if !ok {
+		return nil, newError(ErrNotFound, "object %q does not exist", objectname)
+	}
+	return obj.info(), nil
+}
+
+func (o *MemoryStore) UpdateAttrs(ctx context.Context, objectname string, update AttrsUpdate, conds Conditions) (*ObjectInfo, error) {
+	if err := o.failure("UpdateAttrs"); err != nil {
+		return nil, fmt.Errorf("failed to update object %q: %w", objectname, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	obj, ok := o.objects[objectname]
+	if !ok {
+		return nil, newError(ErrNotFound, "object %q does not exist", objectname)
+	}
+	if err := conds.check(objectname, obj.info()); err != nil {
+		return nil, err
+	}
+
+	if update.ContentType != nil {
+		obj.ContentType = *update.ContentType
+	}
+	if update.ContentEncoding != nil {
+		obj.ContentEncoding = *update.ContentEncoding
+	}
+	if update.CacheControl != nil {
+		obj.CacheControl = *update.CacheControl
+	}
+	if update.ContentDisposition != nil {
+		obj.ContentDisposition = *update.ContentDisposition
+	}
+	switch {
+	case update.Metadata == nil:
+	case len(update.Metadata) == 0:
+		obj.Metadata = nil
+	default:
+		if obj.Metadata == nil {
+			obj.Metadata = make(map[string]string)
+		}
+		maps.Copy(obj.Metadata, update.Metadata)
+	}
+
+	obj.Metageneration++
+	obj.Updated = o.now()
+	return obj.info(), nil
+}
+
+func (o *MemoryStore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	if err := o.failure("ListObjects"); err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var objectNames []string
+	for name := range o.objects {
+		if strings.HasPrefix(name, prefix) {
+			objectNames = append(objectNames, name)
+		}
+	}
+	sort.Strings(objectNames)
+	return objectNames, nil
+}
+
+func (o *MemoryStore) ListObjectsPage(ctx context.Context, opts ListOptions) (*ObjectPage, error) {
+	if err := o.failure("ListObjects"); err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	names := make([]string, 0, len(o.objects))
+	for name := range o.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return listPage(names, opts, func(name string) (*ObjectInfo, error) {
+		return o.objects[name].info(), nil
+	})
+}
+
+func (o *MemoryStore) DeleteObject(ctx context.Context, objectName string) error {
+	return o.DeleteObjectIf(ctx, objectName, Conditions{})
+}
+
+func (o *MemoryStore) DeleteObjectIf(ctx context.Context, objectName string, conds Conditions) error {
+	if err := o.failure("DeleteObject"); err != nil {
+		return fmt.Errorf("failed to delete object %q: %w", objectName, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	obj, ok := o.objects[objectName]
+	if !ok {
+		return newError(ErrNotFound, "object %q does not exist", objectName)
+	}
+	if err := conds.check(objectName, obj.info()); err != nil {
+		return err
+	}
+	o.archive(obj)
+	delete(o.objects, objectName)
+	return nil
+}
+
+func (o *MemoryStore) CopyObject(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error) {
+	if err := o.failure("CopyObject"); err != nil {
+		return nil, fmt.Errorf("failed to copy object %q to %q: %w", srcName, dstName, err)
+	}
+
+	src, ok := o.Object(srcName)
+	if !ok {
+		return nil, newError(ErrNotFound, "object %q does not exist", srcName)
+	}
+	return o.put(dstName, src.Data, src.attrs(), conds)
+}
+
+func (o *MemoryStore) MoveObject(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error) {
+	if err := o.failure("MoveObject"); err != nil {
+		return nil, fmt.Errorf("failed to move object %q to %q: %w", srcName, dstName, err)
+	}
+	if srcName == dstName {
+		return nil, newError(ErrInvalidArgument, "cannot move object %q onto itself", srcName)
+	}
+
+	src, ok := o.Object(srcName)
+	if !ok {
+		return nil, newError(ErrNotFound, "object %q does not exist", srcName)
+	}
+	info, err := o.put(dstName, src.Data, src.attrs(), conds)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.DeleteObjectIf(ctx, srcName, Conditions{GenerationMatch: src.Generation}); err != nil {
+		return info, fmt.Errorf("copied object %q to %q but failed to delete the source: %w", srcName, dstName, err)
+	}
+	return info, nil
+}
+
+func (o *MemoryStore) GetObjectUrl(ctx context.Context, objectName string) (string, error) {
+	if err := o.failure("GetObjectUrl"); err != nil {
+		return "", err
+	}
+
+	obj, ok := o.Object(objectName)
+	if !ok {
+		return "", newError(ErrNotFound, "object %q does not exist", objectName)
+	}
+
+	u := url.URL{
+		Scheme:   "memory",
+		Host:     o.bucket,
+		Path:     "/" + objectName,
+		RawQuery: fmt.Sprintf("generation=%d", obj.Generation),
+	}
+	return u.String(), nil
+}
+
+func (o *MemoryStore) ListVersions(ctx context.Context, objectname string) ([]*ObjectInfo, error) {
+	if err := o.failure("ListVersions"); err != nil {
+		return nil, fmt.Errorf("error listing versions: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var versions []*ObjectInfo
+	for _, obj := range o.noncurrent[objectname] {
+		versions = append(versions, obj.info())
+	}
+	if obj, ok := o.objects[objectname]; ok {
+		versions = append(versions, obj.info())
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Generation < versions[j].Generation })
+	return versions, nil
+}
+
+func (o *MemoryStore) NewGenerationRangeReader(ctx context.Context, objectname string, generation, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if err := o.failure("NewGenerationRangeReader"); err != nil {
+		return nil, nil, err
+	}
+
+	o.mu.Lock()
+	obj, ok := o.lookup(objectname, generation)
+	if ok {
+		c := obj.clone()
+		obj = &c
+	}
+	o.mu.Unlock()
+	if !ok {
+		return nil, nil, newError(ErrNotFound, "object %q generation %d does not exist", objectname, generation)
+	}
+
+	start, end := rangeBounds(int64(len(obj.Data)), offset, length)
+	return io.NopCloser(bytes.NewReader(obj.Data[start:end])), obj.info(), nil
+}
+
+func (o *MemoryStore) SignedURL(ctx context.Context, objectName string, opts SignedURLOptions) (string, error) {
+	if err := o.failure("SignedURL"); err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("method", opts.Method)
+	query.Set("expires", strconv.FormatInt(o.now().Add(opts.Expiry).Unix(), 10))
+	if opts.Generation != 0 {
+		o.mu.Lock()
+		_, ok := o.lookup(objectName, opts.Generation)
+		o.mu.Unlock()
+		if !ok {
+			return "", newError(ErrNotFound, "object %q generation %d does not exist", objectName, opts.Generation)
+		}
+		query.Set("generation", strconv.FormatInt(opts.Generation, 10))
+	}
+	if opts.ResponseContentDisposition != "" {
+		query.Set("response-content-disposition", opts.ResponseContentDisposition)
+	}
+
+	u := url.URL{
+		Scheme:   "memory",
+		Host:     o.bucket,
+		Path:     "/" + objectName,
+		RawQuery: query.Encode(),
+	}
+	return u.String(), nil
+}
+
+func (o *MemoryStore) RestoreVersion(ctx context.Context, objectname string, generation int64, conds Conditions) (*ObjectInfo, error) {
+	if err := o.failure("RestoreVersion"); err != nil {
+		return nil, fmt.Errorf("failed to restore object %q: %w", objectname, err)
+	}
+
+	o.mu.Lock()
+	obj, ok := o.lookup(objectname, generation)
+	var restored MemoryObject
+	if ok {
+		restored = obj.clone()
+	}
+	o.mu.Unlock()
+	if !ok {
+		return nil, newError(ErrNotFound, "object %q generation %d does not exist", objectname, generation)
+	}
+
+	return o.put(objectname, restored.Data, restored.attrs(), conds)
+}
+
+func (o *MemoryStore) DeleteVersion(ctx context.Context, objectname string, generation int64) error {
+	if err := o.failure("DeleteVersion"); err != nil {
+		return fmt.Errorf("failed to delete object %q generation %d: %w", objectname, generation, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if obj, ok := o.objects[objectname]; ok && obj.Generation == generation {
+		delete(o.objects, objectname)
+		return nil
+	}
+	versions := o.noncurrent[objectname]
+	for i, obj := range versions {
+		if obj.Generation == generation {
+			o.noncurrent[objectname] = append(versions[:i:i], versions[i+1:]...)
+			return nil
+		}
+	}
+	return newError(ErrNotFound, "object %q generation %d does not exist", objectname, generation)
+}
+
+func (m *MemoryObject) info() *ObjectInfo {
+	sum := md5.Sum(m.Data)
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &ObjectInfo{
+		Name:               m.Name,
+		Size:               int64(len(m.Data)),
+		ContentType:        contentType,
+		ContentEncoding:    m.ContentEncoding,
+		CacheControl:       m.CacheControl,
+		ContentDisposition: m.ContentDisposition,
+		Updated:            m.Updated,
+		Deleted:            m.Deleted,
+		Generation:         m.Generation,
+		Metageneration:     m.Metageneration,
+		MD5:                sum[:],
+		CRC32C:             encodeCRC32C(crc32.Checksum(m.Data, castagnoliTable)),
+		Metadata:           maps.Clone(m.Metadata),
+	}
+}
+
+func (m *MemoryObject) attrs() ObjectAttrs {
+	return ObjectAttrs{
+		ContentType:        m.ContentType,
+		ContentEncoding:    m.ContentEncoding,
+		CacheControl:       m.CacheControl,
+		ContentDisposition: m.ContentDisposition,
+		Metadata:           m.Metadata,
+	}
+}
+
+func (m *MemoryObject) clone() MemoryObject {
+	c := *m
+	c.Data = bytes.Clone(m.Data)
+	c.Metadata = maps.Clone(m.Metadata)
+	return c
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"path"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxObjectNameLength is the GCS limit, in bytes of UTF-8.
+const maxObjectNameLength = 1024
+
+// reservedPrefixes are rejected by GCS.
+var reservedPrefixes = []string{".well-known/acme-challenge/"}
+
+// cleanObjectName validates an object name. Names are never rewritten, as
+// an upload, a download and a delete must all mean the same object: names
+// that are not in their canonical form, with surrounding spaces or empty or
+// "." segments, are rejected along with those that could escape their folder
+// when stored on a filesystem or that GCS does not accept.
+func cleanObjectName(name string) (string, error) {
+	clean, err := cleanPrefix(name)
+	if err != nil {
+		return "", err
+	}
+	if clean == "" || strings.HasSuffix(clean, "/") {
+		return "", newError(ErrInvalidArgument, "invalid object name %q: must name an object, not a folder", name)
+	}
+	return clean, nil
+}
+
+// cleanPrefix applies the rules of cleanObjectName to a folder or listing
+// prefix, which may be empty or end in "/".
+func cleanPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+
+	switch {
+	case !utf8.ValidString(prefix):
+		return "", newError(ErrInvalidArgument, "invalid object name %q: not valid UTF-8", prefix)
+	case strings.IndexFunc(prefix, unicode.IsControl) >= 0:
+		return "", newError(ErrInvalidArgument, "invalid object name %q: contains control characters", prefix)
+	case strings.TrimSpace(prefix) != prefix:
+		return "", newError(ErrInvalidArgument, "invalid object name %q: must not start or end with spaces", prefix)
+	case isAbsolutePath(prefix):
+		return "", newError(ErrInvalidArgument, "invalid object name %q: must be relative", prefix)
+	}
+
+	for _, segment := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		switch {
+		case segment == "":
+			return "", newError(ErrInvalidArgument, "invalid object name %q: must not contain empty segments", prefix)
+		case segment == ".":
+			return "", newError(ErrInvalidArgument, `invalid object name %q: must not contain "." segments`, prefix)
+		// Backslashes separate paths on Windows hosts.
+		case slices.Contains(strings.Split(segment, `\`), ".."):
+			return "", newError(ErrInvalidArgument, `invalid object name %q: must not contain ".."`, prefix)
+		}
+	}
+
+	if len(prefix) > maxObjectNameLength {
+		return "", newError(ErrInvalidArgument, "invalid object name: longer than %d bytes", maxObjectNameLength)
+	}
+	for _, reserved := range reservedPrefixes {
+		if strings.HasPrefix(prefix, reserved) {
+			return "", newError(ErrInvalidArgument, "invalid object name %q: %q is reserved", prefix, reserved)
+		}
+	}
+	return prefix, nil
+}
+
+func isAbsolutePath(name string) bool {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return true
+	}
+	// A drive letter such as C: or C:\.
+	return len(name) >= 2 && name[1] == ':' && ('a' <= name[0]|0x20 && name[0]|0x20 <= 'z')
+}
+
+// uploadObjectName joins a folder and the base name of a client supplied
+// filename, which browsers may send with a Windows path.
+func uploadObjectName(folder, filename string) (string, error) {
+	base := path.Base(strings.ReplaceAll(strings.TrimSpace(filename), `\`, "/"))
+	if base == "." || base == "/" {
+		return "", newError(ErrInvalidArgument, "invalid filename %q", filename)
+	}
+	return cleanObjectName(folder + "/" + base)
+}
+
+// objectNameParam reads and validates an object name query parameter.
+func objectNameParam(c *gin.Context, key string) (string, error) {
+	value := c.Query(key)
+	if strings.TrimSpace(value) == "" {
+		return "", newError(ErrInvalidArgument, "%s is required", key)
+	}
+	return cleanObjectName(value)
+}
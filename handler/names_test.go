@@ -0,0 +1,182 @@
+package handler_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func TestObjectNameValidation(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	tests := []struct {
+		name       string
+		objectname string
+		status     int
+		path       string
+	}{
+		{"plain", "fw/app.bin", http.StatusCreated, "fw/app.bin"},
+		{"longest allowed", strings.Repeat("a", 1024), http.StatusCreated, strings.Repeat("a", 1024)},
+		{"unicode", "fw/über.bin", http.StatusCreated, "fw/über.bin"},
+		{"empty", "   ", http.StatusBadRequest, ""},
+		{"dot", ".", http.StatusBadRequest, ""},
+		{"folder", "fw/", http.StatusBadRequest, ""},
+		{"surrounding spaces", " fw/app.bin ", http.StatusBadRequest, ""},
+		{"empty segment", "fw//app.bin", http.StatusBadRequest, ""},
+		{"dot segment", "fw/./app.bin", http.StatusBadRequest, ""},
+		{"parent", "..", http.StatusBadRequest, ""},
+		{"parent prefix", "../etc/passwd", http.StatusBadRequest, ""},
+		{"parent in middle", "fw/../../etc/passwd", http.StatusBadRequest, ""},
+		{"windows parent", `fw\..\..\boot.ini`, http.StatusBadRequest, ""},
+		{"absolute", "/etc/passwd", http.StatusBadRequest, ""},
+		{"absolute windows", `\Windows\win.ini`, http.StatusBadRequest, ""},
+		{"drive letter", `C:\boot.ini`, http.StatusBadRequest, ""},
+		{"nul", "fw/a\x00.bin", http.StatusBadRequest, ""},
+		{"newline", "fw/a\r\n.bin", http.StatusBadRequest, ""},
+		{"delete character", "fw/a\x7f.bin", http.StatusBadRequest, ""},
+		{"c1 control", "fw/a\u0085.bin", http.StatusBadRequest, ""},
+		{"invalid utf-8", "fw/\xff.bin", http.StatusBadRequest, ""},
+		{"too long", strings.Repeat("a", 1025), http.StatusBadRequest, ""},
+		{"reserved", ".well-known/acme-challenge/token", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Post(srv.URL+"/upload-buffer?objectname="+url.QueryEscape(tt.objectname), "application/octet-stream", strings.NewReader("data"))
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			ar := parseResp(t, res)
+			if res.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, res.StatusCode, ar.Error)
+			}
+			if tt.status == http.StatusBadRequest && ar.Code != "INVALID_ARGUMENT" {
+				t.Fatalf("expected INVALID_ARGUMENT, got %q", ar.Code)
+			}
+			if tt.path != "" && getDataMap(t, ar)["path"] != tt.path {
+				t.Fatalf("expected path %q, got %v", tt.path, getDataMap(t, ar)["path"])
+			}
+		})
+	}
+
+	for _, query := range []string{"/list-files?folder=../", "/download-file?objectname=/etc/passwd", "/download-file?objectname=fw/./app.bin", "/delete-object?objectname=fw//app.bin", "/copy?source=fw/app.bin&destination=../app.bin"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+query, nil)
+		switch {
+		case strings.HasPrefix(query, "/copy"):
+			req.Method = http.MethodPost
+		case strings.HasPrefix(query, "/delete-object"):
+			req.Method = http.MethodDelete
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, res.StatusCode)
+		}
+	}
+}
+
+func TestUploadFilenameValidation(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	tests := []struct {
+		name     string
+		folder   string
+		filename string
+		status   int
+		path     string
+	}{
+		{"plain", "fw", "app.bin", http.StatusCreated, "fw/app.bin"},
+		{"unix path", "fw", "../../etc/app.bin", http.StatusCreated, "fw/app.bin"},
+		{"windows path", "fw", `C:\Users\me\app.bin`, http.StatusCreated, "fw/app.bin"},
+		{"parent filename", "fw", "..", http.StatusBadRequest, ""},
+		{"parent folder", "fw/../..", "app.bin", http.StatusBadRequest, ""},
+		{"absolute folder", "/var/lib", "app.bin", http.StatusBadRequest, ""},
+		{"control character", "fw", "app\x01.bin", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, map[string]string{"folder": tt.folder}, tt.filename, []byte("data"))
+			res, err := http.Post(srv.URL+"/upload-file", contentType, body)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			ar := parseResp(t, res)
+			if res.StatusCode != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, res.StatusCode, ar.Error)
+			}
+			if tt.path != "" && getDataMap(t, ar)["path"] != tt.path {
+				t.Fatalf("expected path %q, got %v", tt.path, getDataMap(t, ar)["path"])
+			}
+		})
+	}
+}
+
+func TestDownloadDestinationSandbox(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	if _, err := store.UploadBuffer(t.Context(), []byte("data"), "fw/app.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	srv := newTestServer(t, store)
+
+	download := func(destination string) (int, apiResp) {
+		t.Helper()
+		res, err := http.Get(srv.URL + "/download-file?objectname=fw/app.bin&destination=" + url.QueryEscape(destination))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return res.StatusCode, parseResp(t, res)
+	}
+
+	if status, _ := download("."); status != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a download root, got %d", status)
+	}
+
+	root := newDownloadRoot(t)
+	outside := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "in", "sub"), 0o755)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	tests := []struct {
+		destination string
+		status      int
+		file        string
+	}{
+		{".", http.StatusOK, "app.bin"},
+		{"in/sub", http.StatusOK, "in/sub/app.bin"},
+		{"in/../in", http.StatusOK, "in/app.bin"},
+		{"..", http.StatusBadRequest, ""},
+		{"in/../../", http.StatusBadRequest, ""},
+		{outside, http.StatusBadRequest, ""},
+		{"missing", http.StatusBadRequest, ""},
+		{"escape", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		status, ar := download(tt.destination)
+		if status != tt.status {
+			t.Fatalf("%q: expected %d, got %d: %s", tt.destination, tt.status, status, ar.Error)
+		}
+		if tt.file == "" {
+			continue
+		}
+		if data, err := os.ReadFile(filepath.Join(root, tt.file)); err != nil || !bytes.Equal(data, []byte("data")) {
+			t.Fatalf("%q: expected %s to be written, got %q (%v)", tt.destination, tt.file, data, err)
+		}
+	}
+
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("expected nothing written outside the root, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+const (
+	BackendGCS   = "gcs"
+	BackendLocal = "local"
+)
+
+type ObjectStore interface {
+	UploadFile(ctx context.Context, file io.Reader, objectname string, writerChunkSize int, progressf func(int64)) (int64, error)
+	UploadBuffer(ctx context.Context, filecontent []byte, objectname string, writerChunkSize int, progressf func(int64)) (int64, error)
+	UploadStream(ctx context.Context, file io.Reader, objectname string, opts UploadOptions) (*ObjectInfo, error)
+	DownloadFile(ctx context.Context, objectname string, destination string) (int64, error)
+	NewReader(ctx context.Context, objectname string) (io.ReadCloser, *ObjectInfo, error)
+	NewRangeReader(ctx context.Context, objectname string, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+	StatObject(ctx context.Context, objectname string) (*ObjectInfo, error)
+	ListObjects(ctx context.Context, prefix string) ([]string, error)
+	ListObjectsPage(ctx context.Context, opts ListOptions) (*ObjectPage, error)
+	DeleteObject(ctx context.Context, objectName string) error
+	DeleteObjectIf(ctx context.Context, objectName string, conds Conditions) error
+	CopyObject(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error)
+	MoveObject(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error)
+	GetObjectUrl(ctx context.Context, objectName string) (string, error)
+	SignedURL(ctx context.Context, objectName string, opts SignedURLOptions) (string, error)
+}
+
+// VersionedStore is implemented by backends that keep noncurrent generations
+// of overwritten and deleted objects.
+type VersionedStore interface {
+	ListVersions(ctx context.Context, objectname string) ([]*ObjectInfo, error)
+	NewGenerationRangeReader(ctx context.Context, objectname string, generation, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+	RestoreVersion(ctx context.Context, objectname string, generation int64, conds Conditions) (*ObjectInfo, error)
+	DeleteVersion(ctx context.Context, objectname string, generation int64) error
+}
+
+// PostPolicySigner is implemented by backends that can issue POST policy
+// documents for uploads straight from a browser.
+type PostPolicySigner interface {
+	SignedPostPolicy(ctx context.Context, opts PostPolicyOptions) (*PostPolicy, error)
+}
+
+// AttrsStore is implemented by backends that keep content headers and custom
+// metadata with an object and can change them without rewriting it.
+type AttrsStore interface {
+	UpdateAttrs(ctx context.Context, objectname string, update AttrsUpdate, conds Conditions) (*ObjectInfo, error)
+}
+
+var (
+	_ ObjectStore      = (*GCSUploader)(nil)
+	_ VersionedStore   = (*GCSUploader)(nil)
+	_ PostPolicySigner = (*GCSUploader)(nil)
+	_ AttrsStore       = (*GCSUploader)(nil)
+)
+
+type UploadOptions struct {
+	ChunkSize    int
+	ProgressFunc func(int64)
+
+	MD5        []byte
+	CRC32C     uint32
+	SendCRC32C bool
+
+	Conditions Conditions
+
+	// Attrs are stored with the object by backends that support them.
+	Attrs ObjectAttrs
+}
+
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+	PageToken string
+	PageSize  int
+}
+
+type ObjectPage struct {
+	Objects       []*ObjectInfo `json:"objects"`
+	Prefixes      []string      `json:"prefixes,omitempty"`
+	NextPageToken string        `json:"nextPageToken,omitempty"`
+}
+
+type ObjectInfo struct {
+	Name               string            `json:"name"`
+	Size               int64             `json:"size"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	Updated            time.Time         `json:"updated,omitempty"`
+	Deleted            time.Time         `json:"deleted,omitzero"`
+	Generation         int64             `json:"generation,omitempty"`
+	Metageneration     int64             `json:"metageneration,omitempty"`
+	MD5                []byte            `json:"md5,omitempty"`
+	CRC32C             string            `json:"crc32c,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+func (info *ObjectInfo) hashes() map[string]string {
+	hashes := make(map[string]string)
+	if info.MD5 != nil {
+		hashes["md5"] = base64.StdEncoding.EncodeToString(info.MD5)
+	}
+	if info.CRC32C != "" {
+		hashes["crc32c"] = info.CRC32C
+	}
+	return hashes
+}
+
+func (info *ObjectInfo) googHash() string {
+	var parts []string
+	if info.CRC32C != "" {
+		parts = append(parts, "crc32c="+info.CRC32C)
+	}
+	if info.MD5 != nil {
+		parts = append(parts, "md5="+base64.StdEncoding.EncodeToString(info.MD5))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (info *ObjectInfo) ETag() string {
+	return fmt.Sprintf("%q", strconv.FormatInt(info.Generation, 10))
+}
+
+type StoreConfig struct {
+	Backend         string
+	CredentialsPath string
+	BucketName      string
+	Endpoint        string
+
+	LocalRoot       string
+	LocalSigningKey string
+	PublicURL       string
+}
+
+func NewObjectStore(cfg StoreConfig) (ObjectStore, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.Backend)) {
+	case "", BackendGCS:
+		creds, err := os.ReadFile(cfg.CredentialsPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var opts []option.ClientOption
+		if cfg.Endpoint != "" {
+			opts = append(opts, option.WithEndpoint(cfg.Endpoint))
+		}
+
+		gcs := NewGCSUploader(creds, cfg.BucketName, opts...)
+		if err := gcs.Init(); err != nil {
+			return nil, err
+		}
+		return gcs, nil
+	case BackendLocal:
+		local := NewLocalStore(cfg.LocalRoot, []byte(cfg.LocalSigningKey), cfg.PublicURL)
+		if err := local.Init(); err != nil {
+			return nil, err
+		}
+		return local, nil
+	case BackendMemory:
+		return NewMemoryStore(cfg.BucketName), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// downloadDir is where downloads are written: the host filesystem or an
+// os.Root that keeps them inside a sandbox.
+type downloadDir interface {
+	Create(name string) (*os.File, error)
+	Remove(name string) error
+}
+
+type hostDir struct{}
+
+func (hostDir) Create(name string) (*os.File, error) { return os.Create(name) }
+func (hostDir) Remove(name string) error             { return os.Remove(name) }
+
+// downloadToFile copies an object into the destination directory, verifying
+// its CRC32C when the backend reports one. A file that fails verification is
+// removed.
+func downloadToFile(ctx context.Context, store ObjectStore, objectname, destination string) (*ObjectInfo, error) {
+	return downloadInto(ctx, store, objectname, hostDir{}, filepath.Join(destination, path.Base(objectname)))
+}
+
+func downloadInto(ctx context.Context, store ObjectStore, objectname string, dir downloadDir, filename string) (*ObjectInfo, error) {
+	objectReader, info, err := store.NewReader(ctx, objectname)
+	if err != nil {
+		return nil, err
+	}
+	defer objectReader.Close()
+
+	var src io.Reader = objectReader
+	if info.CRC32C != "" {
+		src = newChecksumReader(objectReader, info.CRC32C)
+	}
+
+	outputfile, err := dir.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	nbytescopied, err := io.Copy(outputfile, src)
+	if closeErr := outputfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		dir.Remove(filename)
+		return nil, err
+	}
+
+	info.Size = nbytescopied
+	return info, nil
+}
+
+func ConnectStore(cfg StoreConfig) error {
+	store, err := NewObjectStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	SetObjectStore(store)
+	return nil
+}
+
+func SetObjectStore(store ObjectStore) {
+	uploader = store
+}
+
+var errInvalidPageToken = newError(ErrInvalidArgument, "invalid page token")
+
+// listPage pages through a sorted list of object names the way the GCS list
+// API does: names sharing a prefix up to the delimiter collapse into a single
+// entry, and the page token is the last entry returned.
+func listPage(names []string, opts ListOptions, stat func(name string) (*ObjectInfo, error)) (*ObjectPage, error) {
+	var after string
+	if opts.PageToken != "" {
+		decoded, err := base64.URLEncoding.DecodeString(opts.PageToken)
+		if err != nil {
+			return nil, errInvalidPageToken
+		}
+		after = string(decoded)
+	}
+
+	page := &ObjectPage{Objects: []*ObjectInfo{}}
+	count := 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, opts.Prefix) {
+			continue
+		}
+
+		entry := name
+		if opts.Delimiter != "" {
+			if i := strings.Index(name[len(opts.Prefix):], opts.Delimiter); i >= 0 {
+				entry = name[:len(opts.Prefix)+i+len(opts.Delimiter)]
+			}
+		}
+		if after != "" && entry <= after {
+			continue
+		}
+
+		if opts.PageSize > 0 && count == opts.PageSize {
+			page.NextPageToken = base64.URLEncoding.EncodeToString([]byte(after))
+			break
+		}
+
+		if entry != name {
+			page.Prefixes = append(page.Prefixes, entry)
+		} else {
+			info, err := stat(name)
+			if err != nil {
+				return nil, err
+			}
+			page.Objects = append(page.Objects, info)
+		}
+		count++
+		after = entry
+	}
+	return page, nil
+}
@@ -0,0 +1,29 @@
+package handler_test
+
+import (
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func TestNewObjectStoreUnknownBackend(t *testing.T) {
+	_, err := handler.NewObjectStore(handler.StoreConfig{Backend: "s3"})
+	if err == nil {
+		t.Fatal("expected error for unknown backend")
+	}
+	if !strings.Contains(err.Error(), "unknown storage backend") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNewObjectStoreMissingCredentials(t *testing.T) {
+	_, err := handler.NewObjectStore(handler.StoreConfig{
+		Backend:         handler.BackendGCS,
+		CredentialsPath: t.TempDir() + "/missing.json",
+		BucketName:      "bucket",
+	})
+	if err == nil {
+		t.Fatal("expected error for missing credentials file")
+	}
+}
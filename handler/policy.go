@@ -0,0 +1,387 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// sniffLen is how much of an upload http.DetectContentType looks at.
+const sniffLen = 512
+
+// folderPolicies are the configured upload policies, matched by folder.
+var folderPolicies []*FolderPolicy
+
+// FolderPolicy restricts uploads into Prefix and its subfolders. Zero fields
+// are unrestricted. AllowedTypes are media types such as "image/png" or
+// "image/*", checked against both the sniffed content and the extension.
+// Filenames are path.Match patterns for the base name.
+type FolderPolicy struct {
+	Prefix       string   `json:"prefix"`
+	MaxSize      int64    `json:"maxSize"`
+	AllowedTypes []string `json:"allowedTypes"`
+	Filenames    []string `json:"filenames"`
+	NoOverwrite  bool     `json:"noOverwrite"`
+}
+
+// PolicyConfig lists the folder policies. PoliciesFile is a JSON array of
+// FolderPolicy entries, added to Policies.
+type PolicyConfig struct {
+	Policies     []FolderPolicy
+	PoliciesFile string
+}
+
+func ConfigurePolicies(cfg PolicyConfig) error {
+	policies := cfg.Policies
+	if cfg.PoliciesFile != "" {
+		data, err := os.ReadFile(cfg.PoliciesFile)
+		if err != nil {
+			return err
+		}
+		var filePolicies []FolderPolicy
+		if err := json.Unmarshal(data, &filePolicies); err != nil {
+			return fmt.Errorf("invalid policies file %s: %w", cfg.PoliciesFile, err)
+		}
+		policies = append(slices.Clip(policies), filePolicies...)
+	}
+
+	configured := make([]*FolderPolicy, 0, len(policies))
+	seen := make(map[string]bool)
+	for _, policy := range policies {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		if seen[policy.Prefix] {
+			return fmt.Errorf("folder %q has more than one policy", policy.Prefix)
+		}
+		seen[policy.Prefix] = true
+		configured = append(configured, &policy)
+	}
+	folderPolicies = configured
+	return nil
+}
+
+func (p *FolderPolicy) validate() error {
+	prefix, err := cleanPrefix(p.Prefix)
+	if err != nil || prefix == "" {
+		return fmt.Errorf("invalid policy folder %q", p.Prefix)
+	}
+	p.Prefix = strings.TrimSuffix(prefix, "/")
+
+	if p.MaxSize < 0 {
+		return fmt.Errorf("policy for %q: maxSize must not be negative", p.Prefix)
+	}
+	for _, allowed := range p.AllowedTypes {
+		if mediaType, sub, ok := strings.Cut(allowed, "/"); !ok || mediaType == "" || sub == "" {
+			return fmt.Errorf("policy for %q: invalid media type %q", p.Prefix, allowed)
+		}
+	}
+	for _, pattern := range p.Filenames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("policy for %q: invalid filename pattern %q", p.Prefix, pattern)
+		}
+	}
+	return nil
+}
+
+// policyFor returns the policy of the innermost folder containing
+// objectname, or nil.
+func policyFor(objectname string) *FolderPolicy {
+	var match *FolderPolicy
+	for _, policy := range folderPolicies {
+		if strings.HasPrefix(objectname, policy.Prefix+"/") && (match == nil || len(policy.Prefix) > len(match.Prefix)) {
+			match = policy
+		}
+	}
+	return match
+}
+
+// checkUpload enforces the policy on an upload of objectname with the
+// declared size, or -1 if unknown. The returned reader must be used in place
+// of src: it enforces the size limit while streaming. A nil policy allows
+// everything.
+func (p *FolderPolicy) checkUpload(objectname string, size int64, src io.Reader, conds *Conditions) (io.Reader, error) {
+	if p == nil {
+		return src, nil
+	}
+
+	base := path.Base(objectname)
+	if err := p.checkFilename(base); err != nil {
+		return nil, err
+	}
+
+	if p.NoOverwrite {
+		if conds.GenerationMatch != 0 || conds.GenerationNotMatch != 0 {
+			return nil, newError(ErrConflict, "folder %q does not allow overwriting objects", p.Prefix)
+		}
+		conds.DoesNotExist = true
+	}
+
+	if p.MaxSize > 0 {
+		if size > p.MaxSize {
+			return nil, p.tooLarge()
+		}
+		src = &policyLimitReader{r: src, policy: p}
+	}
+
+	if len(p.AllowedTypes) > 0 {
+		buffered := bufio.NewReaderSize(src, sniffLen)
+		head, err := buffered.Peek(sniffLen)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err := p.checkType(base, head); err != nil {
+			return nil, err
+		}
+		src = buffered
+	}
+	return src, nil
+}
+
+func (p *FolderPolicy) checkFilename(base string) error {
+	if len(p.Filenames) > 0 && !matchesAny(p.Filenames, base) {
+		return newError(ErrInvalidArgument, "filename %q is not allowed in folder %q", base, p.Prefix)
+	}
+	return nil
+}
+
+func (p *FolderPolicy) checkType(filename string, head []byte) error {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !p.allowsType(sniffed) {
+		return newError(ErrUnsupportedMediaType, "content of type %s is not allowed in folder %q", sniffed, p.Prefix)
+	}
+	return p.checkExtension(filename)
+}
+
+func (p *FolderPolicy) checkExtension(filename string) error {
+	if byExtension := mime.TypeByExtension(path.Ext(filename)); byExtension != "" {
+		byExtension, _, _ = mime.ParseMediaType(byExtension)
+		if !p.allowsType(byExtension) {
+			return newError(ErrUnsupportedMediaType, "files of type %s are not allowed in folder %q", byExtension, p.Prefix)
+		}
+	}
+	return nil
+}
+
+// restrictsTypes reports whether the policy limits the content types at all.
+func (p *FolderPolicy) restrictsTypes() bool {
+	return len(p.AllowedTypes) > 0 && !slices.Contains(p.AllowedTypes, "*/*")
+}
+
+// pinnedType is the content type a signed upload is held to when the client
+// names none: the policy's only allowed type, if it has just one.
+func (p *FolderPolicy) pinnedType() string {
+	if len(p.AllowedTypes) == 1 {
+		return p.AllowedTypes[0]
+	}
+	return ""
+}
+
+// checkDeclaredType checks the content type a signed upload will be held to,
+// since the content itself is never seen. A "major/*" type is only accepted
+// if the policy allows all of it.
+func (p *FolderPolicy) checkDeclaredType(filename, contentType string) error {
+	if contentType == "" {
+		return newError(ErrInvalidArgument, "folder %q only accepts %s, so contentType is required", p.Prefix, strings.Join(p.AllowedTypes, ", "))
+	}
+	if strings.HasSuffix(contentType, "/*") {
+		if !slices.ContainsFunc(p.AllowedTypes, func(allowed string) bool { return strings.EqualFold(allowed, contentType) }) {
+			return newError(ErrUnsupportedMediaType, "content of type %s is not allowed in folder %q", contentType, p.Prefix)
+		}
+	} else {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return newError(ErrInvalidArgument, "invalid contentType %q", contentType)
+		}
+		if !p.allowsType(mediaType) {
+			return newError(ErrUnsupportedMediaType, "content of type %s is not allowed in folder %q", mediaType, p.Prefix)
+		}
+	}
+	return p.checkExtension(filename)
+}
+
+// checkSignedURL turns the policy into conditions of a signed upload of
+// objectname, which goes to the bucket without passing through the server.
+func (p *FolderPolicy) checkSignedURL(objectname string, opts *SignedURLOptions) error {
+	if p == nil {
+		return nil
+	}
+	base := path.Base(objectname)
+	if err := p.checkFilename(base); err != nil {
+		return err
+	}
+	if p.MaxSize > 0 && (opts.MaxSize == 0 || opts.MaxSize > p.MaxSize) {
+		opts.MaxSize = p.MaxSize
+	}
+	if p.restrictsTypes() {
+		if opts.ContentType == "" && !strings.HasSuffix(p.pinnedType(), "/*") {
+			opts.ContentType = p.pinnedType()
+		}
+		if strings.HasSuffix(opts.ContentType, "/*") {
+			return newError(ErrInvalidArgument, "signed urls need an exact contentType")
+		}
+		if err := p.checkDeclaredType(base, opts.ContentType); err != nil {
+			return err
+		}
+	}
+	opts.DoesNotExist = p.NoOverwrite
+	return nil
+}
+
+// checkPostPolicy turns the policy into conditions of a POST policy. A
+// folder that restricts filenames needs a fixed one, as the browser would
+// otherwise choose it. maxSize given by the client may not exceed the
+// policy's; the default is lowered to it.
+func (p *FolderPolicy) checkPostPolicy(opts *PostPolicyOptions, sizeGiven bool) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Filenames) > 0 {
+		if opts.Filename == "" {
+			return newError(ErrInvalidArgument, "folder %q restricts filenames, so a filename is required", p.Prefix)
+		}
+		if err := p.checkFilename(opts.Filename); err != nil {
+			return err
+		}
+	}
+	if p.MaxSize > 0 && (opts.MaxSize == 0 || opts.MaxSize > p.MaxSize) {
+		if sizeGiven {
+			return p.tooLarge()
+		}
+		opts.MaxSize = p.MaxSize
+	}
+	if p.restrictsTypes() {
+		if opts.ContentType == "" {
+			opts.ContentType = p.pinnedType()
+		}
+		if err := p.checkDeclaredType(opts.Filename, opts.ContentType); err != nil {
+			return err
+		}
+	}
+	opts.DoesNotExist = p.NoOverwrite
+	return nil
+}
+
+func (p *FolderPolicy) allowsType(mediaType string) bool {
+	for _, allowed := range p.AllowedTypes {
+		if allowed == "*/*" || strings.EqualFold(allowed, mediaType) {
+			return true
+		}
+		if major, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *FolderPolicy) tooLarge() error {
+	return newError(ErrTooLarge, "folder %q accepts objects of at most %d bytes", p.Prefix, p.MaxSize)
+}
+
+// checkCopy applies the policy of dstName's folder to writing it with the
+// content of an existing object, of which it reads only what the type check
+// needs. The policy is returned for uploadError.
+func checkCopy(ctx context.Context, dstName string, src objectSource, conds *Conditions) (*FolderPolicy, error) {
+	policy := policyFor(dstName)
+	if policy == nil {
+		return nil, nil
+	}
+
+	head, info, err := src.open(ctx, 0, 0, sniffLen)
+	if err != nil {
+		return nil, err
+	}
+	defer head.Close()
+
+	_, err = policy.checkUpload(dstName, info.Size, head, conds)
+	return policy, err
+}
+
+// uploadError explains a failed precondition that the policy added.
+func (p *FolderPolicy) uploadError(objectname string, err error) error {
+	if p != nil && p.NoOverwrite && errors.Is(err, ErrPreconditionFailed) {
+		return p.exists(objectname)
+	}
+	return err
+}
+
+func (p *FolderPolicy) exists(objectname string) error {
+	return newError(ErrConflict, "%q already exists and folder %q does not allow overwriting objects", objectname, p.Prefix)
+}
+
+// checkCreate applies what the policy can tell of an upload that is written
+// in parts before any of its content arrives: its name, declared size and
+// declared content type, and whether it would overwrite an object.
+func (p *FolderPolicy) checkCreate(ctx context.Context, objectname string, size int64, contentType string) error {
+	if p == nil {
+		return nil
+	}
+
+	base := path.Base(objectname)
+	if err := p.checkFilename(base); err != nil {
+		return err
+	}
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return p.tooLarge()
+	}
+	if len(p.AllowedTypes) > 0 {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && !p.allowsType(mediaType) {
+			return newError(ErrUnsupportedMediaType, "content of type %s is not allowed in folder %q", mediaType, p.Prefix)
+		}
+		if err := p.checkExtension(base); err != nil {
+			return err
+		}
+	}
+	if p.NoOverwrite {
+		_, err := uploader.StatObject(ctx, objectname)
+		if err == nil {
+			return p.exists(objectname)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejected reports whether err is the policy refusing an upload, which
+// retrying cannot change.
+func rejected(err error) bool {
+	return errors.Is(err, ErrInvalidArgument) || errors.Is(err, ErrTooLarge) ||
+		errors.Is(err, ErrUnsupportedMediaType) || errors.Is(err, ErrConflict)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// policyLimitReader fails an upload as soon as it grows past the policy's
+// maximum size, so the object is never committed.
+type policyLimitReader struct {
+	r      io.Reader
+	policy *FolderPolicy
+	read   int64
+}
+
+func (l *policyLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.policy.MaxSize {
+		return 0, l.policy.tooLarge()
+	}
+	return n, err
+}
@@ -0,0 +1,318 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func configurePolicies(t *testing.T, cfg handler.PolicyConfig) {
+	t.Helper()
+	if err := handler.ConfigurePolicies(cfg); err != nil {
+		t.Fatalf("ConfigurePolicies failed: %v", err)
+	}
+	t.Cleanup(func() { handler.ConfigurePolicies(handler.PolicyConfig{}) })
+}
+
+func uploadBuffer(t *testing.T, url, objectname string, body io.Reader) (int, apiResp) {
+	t.Helper()
+	res, err := http.Post(url+"/upload-buffer?objectname="+objectname, "application/octet-stream", body)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return res.StatusCode, parseResp(t, res)
+}
+
+func TestUploadPolicies(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+
+	configurePolicies(t, handler.PolicyConfig{Policies: []handler.FolderPolicy{
+		{Prefix: "firmware/", MaxSize: 16, AllowedTypes: []string{"application/octet-stream"}, Filenames: []string{"*.bin"}},
+		{Prefix: "firmware/release", NoOverwrite: true},
+		{Prefix: "images", AllowedTypes: []string{"image/*"}},
+	}})
+
+	tests := []struct {
+		name       string
+		objectname string
+		body       io.Reader
+		status     int
+		code       string
+	}{
+		{"allowed", "firmware/app.bin", bytes.NewReader([]byte{0, 1, 2, 3}), http.StatusCreated, ""},
+		{"declared size over limit", "firmware/big.bin", bytes.NewReader(make([]byte, 17)), http.StatusRequestEntityTooLarge, "TOO_LARGE"},
+		{"streamed size over limit", "firmware/big.bin", io.MultiReader(bytes.NewReader(make([]byte, 17))), http.StatusRequestEntityTooLarge, "TOO_LARGE"},
+		{"filename pattern", "firmware/app.exe", bytes.NewReader([]byte{0, 1}), http.StatusBadRequest, "INVALID_ARGUMENT"},
+		{"sniffed type", "firmware/logo.bin", bytes.NewReader(pngHeader), http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE"},
+		{"image", "images/logo.png", bytes.NewReader(pngHeader), http.StatusCreated, ""},
+		{"extension type", "images/logo.txt", bytes.NewReader(pngHeader), http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE"},
+		{"text content", "images/logo.png", strings.NewReader("not an image"), http.StatusUnsupportedMediaType, "UNSUPPORTED_MEDIA_TYPE"},
+		{"innermost folder wins", "firmware/release/app.exe", strings.NewReader(strings.Repeat("x", 64)), http.StatusCreated, ""},
+		{"no overwrite", "firmware/release/app.exe", strings.NewReader("again"), http.StatusConflict, "CONFLICT"},
+		{"unrestricted folder", "other/app.exe", strings.NewReader(strings.Repeat("x", 64)), http.StatusCreated, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, ar := uploadBuffer(t, srv.URL, tt.objectname, tt.body)
+			if status != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, status, ar.Error)
+			}
+			if tt.code != "" && ar.Code != tt.code {
+				t.Fatalf("expected %s, got %q", tt.code, ar.Code)
+			}
+		})
+	}
+
+	if _, ok := store.Object("firmware/big.bin"); ok {
+		t.Fatal("expected an oversized upload not to be stored")
+	}
+	if obj, ok := store.Object("firmware/release/app.exe"); !ok || len(obj.Data) != 64 {
+		t.Fatal("expected the original object to be kept")
+	}
+}
+
+func TestUploadFilePolicy(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+	configurePolicies(t, handler.PolicyConfig{Policies: []handler.FolderPolicy{
+		{Prefix: "firmware", MaxSize: 16, Filenames: []string{"*.bin"}, NoOverwrite: true},
+	}})
+
+	upload := func(filename string, content []byte) (int, apiResp) {
+		t.Helper()
+		body, contentType := multipartBody(t, map[string]string{"folder": "firmware"}, filename, content)
+		res, err := http.Post(srv.URL+"/upload-file", contentType, body)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return res.StatusCode, parseResp(t, res)
+	}
+
+	if status, ar := upload("app.bin", []byte("data")); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", status, ar.Error)
+	}
+	if status, _ := upload("app.bin", []byte("data")); status != http.StatusConflict {
+		t.Fatalf("expected 409 on overwrite, got %d", status)
+	}
+	if status, _ := upload("big.bin", make([]byte, 17)); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", status)
+	}
+	if status, _ := upload("app.img", []byte("data")); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for filename, got %d", status)
+	}
+}
+
+func TestConfigurePoliciesFile(t *testing.T) {
+	srv := newTestServer(t, handler.NewMemoryStore(testBucket))
+
+	file := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(file, []byte(`[{"prefix": "docs", "allowedTypes": ["text/plain"]}]`), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	configurePolicies(t, handler.PolicyConfig{PoliciesFile: file})
+
+	if status, ar := uploadBuffer(t, srv.URL, url.QueryEscape("docs/readme.txt"), strings.NewReader("hello")); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", status, ar.Error)
+	}
+	if status, _ := uploadBuffer(t, srv.URL, url.QueryEscape("docs/logo.png"), bytes.NewReader(pngHeader)); status != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d", status)
+	}
+}
+
+func TestConfigurePoliciesErrors(t *testing.T) {
+	tests := map[string]handler.PolicyConfig{
+		"empty prefix":    {Policies: []handler.FolderPolicy{{Prefix: " "}}},
+		"parent prefix":   {Policies: []handler.FolderPolicy{{Prefix: "../fw"}}},
+		"duplicate":       {Policies: []handler.FolderPolicy{{Prefix: "fw"}, {Prefix: "fw/"}}},
+		"negative size":   {Policies: []handler.FolderPolicy{{Prefix: "fw", MaxSize: -1}}},
+		"invalid type":    {Policies: []handler.FolderPolicy{{Prefix: "fw", AllowedTypes: []string{"image"}}}},
+		"invalid pattern": {Policies: []handler.FolderPolicy{{Prefix: "fw", Filenames: []string{"[a"}}}},
+		"missing file":    {PoliciesFile: filepath.Join(t.TempDir(), "policies.json")},
+	}
+	for name, cfg := range tests {
+		if err := handler.ConfigurePolicies(cfg); err == nil {
+			handler.ConfigurePolicies(handler.PolicyConfig{})
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPolicyCopyMoveRestore(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	for objectname, content := range map[string][]byte{
+		"staging/app.bin":  {0, 1, 2, 3},
+		"staging/new.bin":  {4, 5, 6, 7},
+		"staging/app.exe":  {8, 9},
+		"staging/logo.bin": pngHeader,
+		"release/app.bin":  {1},
+	} {
+		if _, err := store.UploadBuffer(t.Context(), content, objectname, 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+	}
+	first, _ := store.Object("release/app.bin")
+	if _, err := store.UploadBuffer(t.Context(), []byte{2}, "release/app.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+	srv := newTestServer(t, store)
+	configurePolicies(t, handler.PolicyConfig{Policies: []handler.FolderPolicy{
+		{Prefix: "release", NoOverwrite: true, Filenames: []string{"*.bin"}, AllowedTypes: []string{"application/octet-stream"}},
+	}})
+
+	post := func(path string) (int, apiResp) {
+		t.Helper()
+		res, ar := doRequest(t, http.MethodPost, srv.URL+path, nil, nil)
+		return res.StatusCode, ar
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"copy", "/copy?source=staging/new.bin&destination=release/new.bin", http.StatusOK},
+		{"copy over existing", "/copy?source=staging/app.bin&destination=release/app.bin", http.StatusConflict},
+		{"copy filename", "/copy?source=staging/app.exe&destination=release/app.exe", http.StatusBadRequest},
+		{"copy type", "/copy?source=staging/logo.bin&destination=release/logo.bin", http.StatusUnsupportedMediaType},
+		{"move over existing", "/move?source=staging/app.bin&destination=release/app.bin", http.StatusConflict},
+		{"restore over existing", "/versions/restore?objectname=release/app.bin&generation=" + strconv.FormatInt(first.Generation, 10), http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if status, ar := post(tt.path); status != tt.status {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.name, tt.status, status, ar.Error)
+		}
+	}
+	if obj, _ := store.Object("release/app.bin"); !bytes.Equal(obj.Data, []byte{2}) {
+		t.Fatalf("expected release/app.bin to be kept, got %v", obj.Data)
+	}
+	if _, ok := store.Object("staging/app.bin"); !ok {
+		t.Fatal("expected the source of a rejected move to be kept")
+	}
+
+	status, ar := post("/copy?recursive=true&source=staging&destination=release")
+	if status != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", status, ar.Error)
+	}
+	codes := map[string]string{"staging/app.bin": "CONFLICT", "staging/new.bin": "CONFLICT", "staging/app.exe": "INVALID_ARGUMENT", "staging/logo.bin": "UNSUPPORTED_MEDIA_TYPE"}
+	for name, result := range extractResults(t, ar) {
+		if result["code"] != codes[name] {
+			t.Fatalf("%s: expected %s, got %v", name, codes[name], result)
+		}
+	}
+}
+
+func TestSignedUploadPolicies(t *testing.T) {
+	srv := newTestServer(t, newUploader(t, newFakeGCS(t)))
+	configurePolicies(t, handler.PolicyConfig{Policies: []handler.FolderPolicy{
+		{Prefix: "firmware", MaxSize: 16, AllowedTypes: []string{"application/octet-stream"}, Filenames: []string{"*.bin"}, NoOverwrite: true},
+		{Prefix: "images", AllowedTypes: []string{"image/png", "image/jpeg"}},
+	}})
+	handler.ConfigurePostPolicies(handler.PostPolicyConfig{Folders: []string{"firmware", "images"}})
+	t.Cleanup(func() { handler.ConfigurePostPolicies(handler.PostPolicyConfig{}) })
+
+	signed := []struct {
+		name    string
+		query   string
+		status  int
+		headers map[string]string
+	}{
+		{
+			name:    "limits of the folder",
+			query:   "objectname=firmware/app.bin&method=PUT",
+			status:  http.StatusOK,
+			headers: map[string]string{"Content-Type": "application/octet-stream", "X-Goog-Content-Length-Range": "0,16", "X-Goog-If-Generation-Match": "0"},
+		},
+		{name: "filename", query: "objectname=firmware/app.exe&method=PUT", status: http.StatusBadRequest},
+		{name: "content type", query: "objectname=firmware/app.bin&method=PUT&contentType=text/plain", status: http.StatusUnsupportedMediaType},
+		{name: "missing content type", query: "objectname=images/logo.png&method=PUT", status: http.StatusBadRequest},
+		{
+			name:    "allowed content type",
+			query:   "objectname=images/logo.png&method=PUT&contentType=image/png",
+			status:  http.StatusOK,
+			headers: map[string]string{"Content-Type": "image/png"},
+		},
+		{name: "extension", query: "objectname=images/logo.txt&method=PUT&contentType=image/png", status: http.StatusUnsupportedMediaType},
+		{name: "downloads are unaffected", query: "objectname=firmware/app.exe", status: http.StatusOK, headers: map[string]string{}},
+	}
+	for _, tt := range signed {
+		res, ar := doRequest(t, http.MethodGet, srv.URL+"/object-url?"+tt.query, nil, nil)
+		if res.StatusCode != tt.status {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.name, tt.status, res.StatusCode, ar.Error)
+		}
+		if tt.headers == nil {
+			continue
+		}
+		headers, _ := getDataMap(t, ar)["headers"].(map[string]interface{})
+		if len(headers) != len(tt.headers) {
+			t.Fatalf("%s: headers = %v, want %v", tt.name, headers, tt.headers)
+		}
+		for k, v := range tt.headers {
+			if headers[k] != v {
+				t.Fatalf("%s: header %s = %v, want %q", tt.name, k, headers[k], v)
+			}
+		}
+	}
+
+	policies := []struct {
+		name       string
+		body       map[string]any
+		status     int
+		fields     map[string]string
+		conditions []string
+	}{
+		{
+			name:       "limits of the folder",
+			body:       map[string]any{"folder": "firmware", "filename": "app.bin"},
+			status:     http.StatusOK,
+			fields:     map[string]string{"key": "firmware/app.bin", "content-type": "application/octet-stream", "x-goog-if-generation-match": "0"},
+			conditions: []string{`["content-length-range",0,16]`, `["starts-with","$x-goog-if-generation-match","0"]`},
+		},
+		{name: "browser chosen filename", body: map[string]any{"folder": "firmware"}, status: http.StatusBadRequest},
+		{name: "filename", body: map[string]any{"folder": "firmware", "filename": "app.exe"}, status: http.StatusBadRequest},
+		{name: "size over limit", body: map[string]any{"folder": "firmware", "filename": "app.bin", "maxSize": 17}, status: http.StatusRequestEntityTooLarge},
+		{name: "content type", body: map[string]any{"folder": "images", "maxSize": 10, "contentType": "image/*"}, status: http.StatusUnsupportedMediaType},
+		{
+			name:   "allowed content type",
+			body:   map[string]any{"folder": "images", "maxSize": 10, "contentType": "image/jpeg"},
+			status: http.StatusOK,
+			fields: map[string]string{"key": "images/${filename}", "content-type": "image/jpeg"},
+		},
+	}
+	for _, tt := range policies {
+		res, ar := doRequest(t, http.MethodPost, srv.URL+"/post-policy", tt.body, nil)
+		if res.StatusCode != tt.status {
+			t.Fatalf("%s: expected %d, got %d: %s", tt.name, tt.status, res.StatusCode, ar.Error)
+		}
+		if tt.fields == nil {
+			continue
+		}
+		data := getDataMap(t, ar)
+		fields, _ := data["fields"].(map[string]interface{})
+		for k, v := range tt.fields {
+			if fields[k] != v {
+				t.Fatalf("%s: field %s = %v, want %q", tt.name, k, fields[k], v)
+			}
+		}
+		policy, err := base64.StdEncoding.DecodeString(fields["policy"].(string))
+		if err != nil {
+			t.Fatalf("invalid policy: %v", err)
+		}
+		for _, cond := range tt.conditions {
+			if !bytes.Contains(policy, []byte(cond)) {
+				t.Fatalf("%s: policy %s is missing condition %s", tt.name, policy, cond)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// postPolicyFolders restricts the folders browsers may upload into. An empty
+// list allows every folder.
+var postPolicyFolders []string
+
+type PostPolicyConfig struct {
+	Folders []string
+}
+
+func ConfigurePostPolicies(cfg PostPolicyConfig) {
+	postPolicyFolders = nil
+	for _, folder := range cfg.Folders {
+		if folder = strings.Trim(strings.TrimSpace(folder), "/"); folder != "" {
+			postPolicyFolders = append(postPolicyFolders, folder)
+		}
+	}
+}
+
+// PostPolicyOptions describe a policy for a browser form upload into Folder.
+// An empty Filename lets the browser choose the name. A ContentType ending in
+// "/*" only constrains the type's prefix.
+type PostPolicyOptions struct {
+	Folder      string
+	Filename    string
+	ContentType string
+	MinSize     int64
+	MaxSize     int64
+	Expiry      time.Duration
+
+	// DoesNotExist only lets the upload create the object.
+	DoesNotExist bool
+}
+
+// PostPolicy is the form action and the fields the browser must post along
+// with the file.
+type PostPolicy struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+type postPolicyRequest struct {
+	Folder      string `json:"folder"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	MinSize     int64  `json:"minSize"`
+	MaxSize     int64  `json:"maxSize"`
+	Expires     string `json:"expires"`
+}
+
+func GetPostPolicy(c *gin.Context) {
+	signer, ok := uploader.(PostPolicySigner)
+	if !ok {
+		respondError(c, newError(ErrNotSupported, "the configured storage backend does not support POST policies"))
+		return
+	}
+
+	var req postPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, newError(ErrInvalidArgument, "invalid request body: %v", err))
+		return
+	}
+
+	opts, err := postPolicyOptions(req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, OpSign, opts.Folder+"/"); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, OpUpload, opts.Folder+"/"); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	policy, err := signer.SignedPostPolicy(ctx, opts)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{Message: "Post policy", Data: map[string]any{
+		"url":     policy.URL,
+		"fields":  policy.Fields,
+		"expires": time.Now().Add(opts.Expiry).UTC().Format(time.RFC3339),
+	}})
+}
+
+func postPolicyOptions(req postPolicyRequest) (PostPolicyOptions, error) {
+	folder, err := cleanPrefix(req.Folder)
+	if err != nil {
+		return PostPolicyOptions{}, err
+	}
+
+	opts := PostPolicyOptions{
+		Folder:      strings.TrimSuffix(folder, "/"),
+		Filename:    req.Filename,
+		ContentType: strings.TrimSpace(req.ContentType),
+		MinSize:     req.MinSize,
+		MaxSize:     req.MaxSize,
+		Expiry:      signedURLExpiry,
+	}
+
+	if opts.Folder == "" {
+		return opts, newError(ErrInvalidArgument, "folder is required")
+	}
+	if !postPolicyFolderAllowed(opts.Folder) {
+		return opts, newError(ErrPermissionDenied, "uploads into folder %q are not allowed", opts.Folder)
+	}
+	if opts.Filename != "" {
+		if strings.Contains(opts.Filename, "/") {
+			return opts, newError(ErrInvalidArgument, "filename must not contain '/'")
+		}
+		if _, err := cleanObjectName(opts.Folder + "/" + opts.Filename); err != nil {
+			return opts, err
+		}
+	}
+	if opts.ContentType == "*/*" {
+		opts.ContentType = ""
+	}
+
+	sizeGiven := opts.MaxSize != 0
+	if !sizeGiven {
+		opts.MaxSize = maxUploadSize
+	}
+	// The upload goes straight to the bucket, so the folder's policy can
+	// only be enforced through the conditions of the signed policy.
+	if err := policyFor(opts.Folder+"/"+opts.Filename).checkPostPolicy(&opts, sizeGiven); err != nil {
+		return opts, err
+	}
+	switch {
+	case opts.MinSize < 0 || opts.MaxSize <= 0:
+		return opts, newError(ErrInvalidArgument, "minSize must be non-negative and maxSize positive")
+	case opts.MinSize > opts.MaxSize:
+		return opts, newError(ErrInvalidArgument, "minSize must not exceed maxSize")
+	case maxUploadSize > 0 && opts.MaxSize > maxUploadSize:
+		return opts, newError(ErrInvalidArgument, "maxSize must not exceed %d bytes", maxUploadSize)
+	}
+
+	if req.Expires != "" {
+		expiry, err := time.ParseDuration(req.Expires)
+		if err != nil || expiry <= 0 {
+			return opts, newError(ErrInvalidArgument, "expires must be a positive duration such as 15m")
+		}
+		if expiry > signedURLMaxExpiry {
+			return opts, newError(ErrInvalidArgument, "expires must not exceed %s", signedURLMaxExpiry)
+		}
+		opts.Expiry = expiry
+	}
+	return opts, nil
+}
+
+func postPolicyFolderAllowed(folder string) bool {
+	if len(postPolicyFolders) == 0 {
+		return true
+	}
+	for _, allowed := range postPolicyFolders {
+		if folder == allowed || strings.HasPrefix(folder, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
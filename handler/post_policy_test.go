@@ -0,0 +1,103 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func TestPostPolicy(t *testing.T) {
+	srv := newTestServer(t, newUploader(t, newFakeGCS(t)))
+
+	handler.ConfigurePostPolicies(handler.PostPolicyConfig{Folders: []string{"uploads/", " avatars"}})
+	t.Cleanup(func() { handler.ConfigurePostPolicies(handler.PostPolicyConfig{}) })
+
+	tests := []struct {
+		name       string
+		body       map[string]any
+		key        string
+		conditions []string
+		fields     map[string]string
+	}{
+		{
+			name:       "browser chosen filename",
+			body:       map[string]any{"folder": "uploads/2024", "maxSize": 1 << 20, "contentType": "image/*", "expires": "10m"},
+			key:        "uploads/2024/${filename}",
+			conditions: []string{`["content-length-range",0,1048576]`, `["starts-with","$Content-Type","image/"]`},
+		},
+		{
+			name:       "fixed filename and content type",
+			body:       map[string]any{"folder": "avatars/", "filename": "me.png", "contentType": "image/png", "minSize": 1, "maxSize": 4096},
+			key:        "avatars/me.png",
+			conditions: []string{`["content-length-range",1,4096]`, `{"content-type":"image/png"}`},
+			fields:     map[string]string{"content-type": "image/png"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, ar := doRequest(t, http.MethodPost, srv.URL+"/post-policy", tt.body, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", res.StatusCode, ar.Error)
+			}
+			data := getDataMap(t, ar)
+			if !strings.HasSuffix(data["url"].(string), "/"+testBucket+"/") {
+				t.Fatalf("unexpected form action %v", data["url"])
+			}
+
+			fields, _ := data["fields"].(map[string]interface{})
+			if fields["key"] != tt.key {
+				t.Fatalf("key = %v, want %q", fields["key"], tt.key)
+			}
+			if fields["x-goog-algorithm"] != "GOOG4-RSA-SHA256" || fields["x-goog-signature"] == nil {
+				t.Fatalf("expected signed V4 fields, got %v", fields)
+			}
+			for k, v := range tt.fields {
+				if fields[k] != v {
+					t.Fatalf("field %s = %v, want %q", k, fields[k], v)
+				}
+			}
+
+			policy, err := base64.StdEncoding.DecodeString(fields["policy"].(string))
+			if err != nil {
+				t.Fatalf("invalid policy: %v", err)
+			}
+			for _, cond := range tt.conditions {
+				if !bytes.Contains(policy, []byte(cond)) {
+					t.Fatalf("policy %s is missing condition %s", policy, cond)
+				}
+			}
+		})
+	}
+
+	failures := []struct {
+		body   map[string]any
+		status int
+	}{
+		{map[string]any{"maxSize": 10}, http.StatusBadRequest},
+		{map[string]any{"folder": "secrets", "maxSize": 10}, http.StatusForbidden},
+		{map[string]any{"folder": "uploadsx", "maxSize": 10}, http.StatusForbidden},
+		{map[string]any{"folder": "uploads"}, http.StatusBadRequest},
+		{map[string]any{"folder": "uploads", "minSize": 20, "maxSize": 10}, http.StatusBadRequest},
+		{map[string]any{"folder": "uploads", "filename": "a/b", "maxSize": 10}, http.StatusBadRequest},
+		{map[string]any{"folder": "uploads", "maxSize": 10, "expires": "720h"}, http.StatusBadRequest},
+	}
+	for _, f := range failures {
+		if res, ar := doRequest(t, http.MethodPost, srv.URL+"/post-policy", f.body, nil); res.StatusCode != f.status {
+			t.Fatalf("%v: expected %d, got %d: %s", f.body, f.status, res.StatusCode, ar.Error)
+		}
+	}
+}
+
+func TestPostPolicyUnsupported(t *testing.T) {
+	srv := newTestServer(t, newLocalStore(t, "http://localhost:8080"))
+
+	res, ar := doRequest(t, http.MethodPost, srv.URL+"/post-policy", map[string]any{"folder": "uploads", "maxSize": 10}, nil)
+	if res.StatusCode != http.StatusNotImplemented || ar.Code != "NOT_SUPPORTED" {
+		t.Fatalf("expected 501 NOT_SUPPORTED, got %d %s", res.StatusCode, ar.Code)
+	}
+}
@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxRanges = 16
+
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r byteRange) partHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+// parseRange parses a "bytes=" Range header against an object of the given
+// size. Ranges that start beyond the end of the object are dropped; if none
+// remain errUnsatisfiableRange is returned. Any other error means the header
+// is malformed and should be ignored.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, errors.New("unsupported range unit")
+	}
+
+	var ranges []byteRange
+	specs := strings.Split(spec, ",")
+	if len(specs) > maxRanges {
+		return nil, errors.New("too many ranges")
+	}
+
+	for _, ra := range specs {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the final n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errors.New("invalid range")
+				}
+				end = min(end, size-1)
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+func etagMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = textproto.TrimString(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func notModified(r *http.Request, info *ObjectInfo) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, info.ETag(), true)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || info.Updated.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !info.Updated.Truncate(time.Second).After(t)
+}
+
+func ifRangeMatches(r *http.Request, info *ObjectInfo) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagMatches(ir, info.ETag(), false)
+	}
+
+	t, err := http.ParseTime(ir)
+	if err != nil || info.Updated.IsZero() {
+		return false
+	}
+	return info.Updated.Truncate(time.Second).Equal(t)
+}
+
+func validatorHeaders(c *gin.Context, info *ObjectInfo) {
+	c.Header("ETag", info.ETag())
+	if !info.Updated.IsZero() {
+		c.Header("Last-Modified", info.Updated.UTC().Format(http.TimeFormat))
+	}
+	if info.CacheControl != "" {
+		c.Header("Cache-Control", info.CacheControl)
+	}
+}
+
+// objectSource is the object a download serves. stat describes it without
+// reading it; open reads a byte range, where a length of -1 reads to the end
+// of the object. A nonzero generation makes open fail with
+// ErrPreconditionFailed unless it reads that generation.
+type objectSource struct {
+	stat func(ctx context.Context) (*ObjectInfo, error)
+	open func(ctx context.Context, generation, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+}
+
+func liveObject(objectname string) objectSource {
+	return objectSource{
+		stat: func(ctx context.Context) (*ObjectInfo, error) {
+			return uploader.StatObject(ctx, objectname)
+		},
+		open: func(ctx context.Context, generation, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+			reader, info, err := uploader.NewRangeReader(ctx, objectname, offset, length)
+			if err != nil {
+				return nil, nil, err
+			}
+			if generation != 0 && info.Generation != generation {
+				reader.Close()
+				return nil, nil, newError(ErrPreconditionFailed, "object %q changed while it was being read", objectname)
+			}
+			return reader, info, nil
+		},
+	}
+}
+
+func serveObject(c *gin.Context, src objectSource) {
+	ctx := c.Request.Context()
+
+	rangeHeader := c.GetHeader("Range")
+	conditional := rangeHeader != "" || c.GetHeader("If-None-Match") != "" || c.GetHeader("If-Modified-Since") != ""
+	if !conditional {
+		serveFullObject(c, src)
+		return
+	}
+
+	info, err := src.stat(ctx)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if notModified(c.Request, info) {
+		validatorHeaders(c, info)
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	var ranges []byteRange
+	if rangeHeader != "" && ifRangeMatches(c.Request, info) {
+		ranges, err = parseRange(rangeHeader, info.Size)
+		if errors.Is(err, errUnsatisfiableRange) {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			respondError(c, err)
+			return
+		}
+	}
+
+	if len(ranges) == 0 {
+		serveFullObject(c, src)
+		return
+	}
+
+	// Every range is read from the generation the request was checked
+	// against. If the object has been overwritten since, the ranges no longer
+	// apply and the new object is sent in full.
+	first, _, err := src.open(ctx, info.Generation, ranges[0].start, ranges[0].length)
+	if errors.Is(err, ErrPreconditionFailed) {
+		serveFullObject(c, src)
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer first.Close()
+
+	if len(ranges) == 1 {
+		headers := downloadHeaders(info)
+		headers["Content-Range"] = ranges[0].contentRange(info.Size)
+		c.DataFromReader(http.StatusPartialContent, ranges[0].length, contentType(info), first, headers)
+		return
+	}
+	serveMultipleRanges(c, src, info, ranges, first)
+}
+
+func serveFullObject(c *gin.Context, src objectSource) {
+	ctx := c.Request.Context()
+	objectReader, info, err := src.open(ctx, 0, 0, -1)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	defer objectReader.Close()
+
+	// GCS readers carry only some of the attributes, without the stored
+	// Content-Disposition, so the headers come from a stat when it still
+	// describes the generation being read.
+	if stat, err := src.stat(ctx); err == nil && stat.Generation == info.Generation {
+		info = stat
+	}
+
+	// A failed check truncates the body, which the client sees as an
+	// incomplete response rather than a silently corrupted file.
+	var body io.Reader = objectReader
+	if info.CRC32C != "" {
+		body = newChecksumReader(objectReader, info.CRC32C)
+	}
+
+	c.DataFromReader(http.StatusOK, info.Size, contentType(info), body, downloadHeaders(info))
+}
+
+// serveMultipleRanges writes the ranges as multipart/byteranges, starting with
+// the already opened first one. An overwrite between parts ends the response
+// early, so parts from different generations are never mixed.
+func serveMultipleRanges(c *gin.Context, src objectSource, info *ObjectInfo, ranges []byteRange, first io.Reader) {
+	ctype := contentType(info)
+	mw := multipart.NewWriter(c.Writer)
+
+	for k, v := range downloadHeaders(info) {
+		c.Header(k, v)
+	}
+	c.Header("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	c.Header("Content-Length", strconv.FormatInt(multipartSize(ranges, ctype, info.Size, mw.Boundary()), 10))
+	c.Status(http.StatusPartialContent)
+
+	for i, r := range ranges {
+		var objectReader io.Reader = first
+		if i > 0 {
+			rc, _, err := src.open(c.Request.Context(), info.Generation, r.start, r.length)
+			if err != nil {
+				c.Error(err)
+				return
+			}
+			defer rc.Close()
+			objectReader = rc
+		}
+
+		part, err := mw.CreatePart(r.partHeader(ctype, info.Size))
+		if err == nil {
+			_, err = io.Copy(part, objectReader)
+		}
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+	mw.Close()
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func multipartSize(ranges []byteRange, contentType string, size int64, boundary string) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(r.partHeader(contentType, size))
+		w += countingWriter(r.length)
+	}
+	mw.Close()
+	return int64(w)
+}
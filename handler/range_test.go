@@ -0,0 +1,191 @@
+package handler_test
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gcsuploader/handler"
+)
+
+func doGet(t *testing.T, url string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	return res, body
+}
+
+func TestDownloadRanges(t *testing.T) {
+	const content = "0123456789abcdefghij"
+
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			if _, err := store.UploadBuffer(context.Background(), []byte(content), "fw/image.bin", 0, nil); err != nil {
+				t.Fatalf("UploadBuffer failed: %v", err)
+			}
+			srv := newTestServer(t, store)
+			url := srv.URL + "/download-file?objectname=fw/image.bin"
+
+			full, _ := doGet(t, url, nil)
+			etag := full.Header.Get("ETag")
+			lastModified := full.Header.Get("Last-Modified")
+			if full.Header.Get("Accept-Ranges") != "bytes" || etag == "" {
+				t.Fatalf("unexpected headers on full download: %v", full.Header)
+			}
+
+			singleCases := []struct {
+				rangeHeader  string
+				body         string
+				contentRange string
+			}{
+				{"bytes=0-4", "01234", "bytes 0-4/20"},
+				{"bytes=15-", "fghij", "bytes 15-19/20"},
+				{"bytes=-3", "hij", "bytes 17-19/20"},
+				{"bytes=18-100", "ij", "bytes 18-19/20"},
+			}
+			for _, tc := range singleCases {
+				res, body := doGet(t, url, map[string]string{"Range": tc.rangeHeader})
+				if res.StatusCode != http.StatusPartialContent {
+					t.Fatalf("%s: expected 206, got %d", tc.rangeHeader, res.StatusCode)
+				}
+				if string(body) != tc.body || res.Header.Get("Content-Range") != tc.contentRange {
+					t.Fatalf("%s: got %q with Content-Range %q", tc.rangeHeader, body, res.Header.Get("Content-Range"))
+				}
+			}
+
+			t.Run("MultiRange", func(t *testing.T) {
+				res, body := doGet(t, url, map[string]string{"Range": "bytes=0-1, 10-12"})
+				if res.StatusCode != http.StatusPartialContent {
+					t.Fatalf("expected 206, got %d", res.StatusCode)
+				}
+				mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+				if err != nil || mediaType != "multipart/byteranges" {
+					t.Fatalf("unexpected Content-Type %q", res.Header.Get("Content-Type"))
+				}
+				if res.ContentLength != int64(len(body)) {
+					t.Fatalf("Content-Length %d does not match body length %d", res.ContentLength, len(body))
+				}
+
+				mr := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+				var parts []string
+				for {
+					part, err := mr.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("reading part failed: %v", err)
+					}
+					data, _ := io.ReadAll(part)
+					parts = append(parts, part.Header.Get("Content-Range")+"="+string(data))
+				}
+				want := []string{"bytes 0-1/20=01", "bytes 10-12/20=abc"}
+				if strings.Join(parts, "|") != strings.Join(want, "|") {
+					t.Fatalf("got parts %v, want %v", parts, want)
+				}
+			})
+
+			t.Run("Unsatisfiable", func(t *testing.T) {
+				res, _ := doGet(t, url, map[string]string{"Range": "bytes=50-60"})
+				if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+					t.Fatalf("expected 416, got %d", res.StatusCode)
+				}
+				if res.Header.Get("Content-Range") != "bytes */20" {
+					t.Fatalf("unexpected Content-Range %q", res.Header.Get("Content-Range"))
+				}
+			})
+
+			t.Run("MalformedRangeIgnored", func(t *testing.T) {
+				res, body := doGet(t, url, map[string]string{"Range": "bytes=abc"})
+				if res.StatusCode != http.StatusOK || string(body) != content {
+					t.Fatalf("expected full body, got %d %q", res.StatusCode, body)
+				}
+			})
+
+			t.Run("IfNoneMatch", func(t *testing.T) {
+				res, body := doGet(t, url, map[string]string{"If-None-Match": etag})
+				if res.StatusCode != http.StatusNotModified || len(body) != 0 {
+					t.Fatalf("expected 304, got %d", res.StatusCode)
+				}
+				res, _ = doGet(t, url, map[string]string{"If-None-Match": `"other"`})
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("expected 200 for stale etag, got %d", res.StatusCode)
+				}
+			})
+
+			t.Run("IfModifiedSince", func(t *testing.T) {
+				res, _ := doGet(t, url, map[string]string{"If-Modified-Since": lastModified})
+				if res.StatusCode != http.StatusNotModified {
+					t.Fatalf("expected 304, got %d", res.StatusCode)
+				}
+				past := time.Now().Add(-48 * time.Hour).UTC().Format(http.TimeFormat)
+				res, _ = doGet(t, url, map[string]string{"If-Modified-Since": past})
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("expected 200, got %d", res.StatusCode)
+				}
+			})
+
+			t.Run("IfRange", func(t *testing.T) {
+				res, body := doGet(t, url, map[string]string{"Range": "bytes=0-4", "If-Range": etag})
+				if res.StatusCode != http.StatusPartialContent || string(body) != "01234" {
+					t.Fatalf("expected 206 for matching If-Range, got %d %q", res.StatusCode, body)
+				}
+				res, body = doGet(t, url, map[string]string{"Range": "bytes=0-4", "If-Range": `"stale"`})
+				if res.StatusCode != http.StatusOK || string(body) != content {
+					t.Fatalf("expected full 200 for stale If-Range, got %d %q", res.StatusCode, body)
+				}
+			})
+		})
+	}
+}
+
+// overwritingStore replaces an object with content right after it has been
+// stat'ed, as a concurrent upload would between the checks on a request and
+// its reads.
+type overwritingStore struct {
+	*handler.MemoryStore
+	content string
+}
+
+func (s overwritingStore) StatObject(ctx context.Context, objectname string) (*handler.ObjectInfo, error) {
+	info, err := s.MemoryStore.StatObject(ctx, objectname)
+	if obj, _ := s.Object(objectname); err == nil && string(obj.Data) != s.content {
+		_, err = s.UploadBuffer(ctx, []byte(s.content), objectname, 0, nil)
+	}
+	return info, err
+}
+
+func TestDownloadRangesOverwritten(t *testing.T) {
+	const replaced = "replaced content"
+
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, overwritingStore{MemoryStore: store, content: replaced})
+	url := srv.URL + "/download-file?objectname=fw/image.bin"
+
+	for _, rangeHeader := range []string{"bytes=0-4", "bytes=0-1,5-6"} {
+		if _, err := store.UploadBuffer(context.Background(), []byte("0123456789abcdefghij"), "fw/image.bin", 0, nil); err != nil {
+			t.Fatalf("UploadBuffer failed: %v", err)
+		}
+		res, body := doGet(t, url, map[string]string{"Range": rangeHeader})
+		if res.StatusCode != http.StatusOK || string(body) != replaced {
+			t.Fatalf("%s: expected the new object in full, got %d %q", rangeHeader, res.StatusCode, body)
+		}
+		if info, _ := store.StatObject(context.Background(), "fw/image.bin"); res.Header.Get("ETag") != info.ETag() {
+			t.Fatalf("%s: expected the ETag of the new object, got %s", rangeHeader, res.Header.Get("ETag"))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gcsuploader/handler"
+)
+
+func TestSignedURLs(t *testing.T) {
+	srv := newTestServer(t, newUploader(t, newFakeGCS(t)))
+
+	handler.ConfigureSignedURLs(handler.SignedURLConfig{DefaultExpiry: 15 * time.Minute, MaxExpiry: time.Hour})
+	t.Cleanup(func() {
+		handler.ConfigureSignedURLs(handler.SignedURLConfig{DefaultExpiry: 24 * time.Hour, MaxExpiry: 7 * 24 * time.Hour})
+	})
+
+	sign := func(query string) (*http.Response, apiResp) {
+		t.Helper()
+		res, err := http.Get(srv.URL + "/object-url?objectname=devices/fw.bin&" + query)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return res, parseResp(t, res)
+	}
+
+	tests := []struct {
+		name          string
+		query         string
+		expires       int
+		signedHeaders []string
+		params        map[string]string
+		headers       map[string]string
+	}{
+		{
+			name:    "default GET",
+			expires: 900,
+			headers: map[string]string{},
+		},
+		{
+			name:          "PUT with content headers",
+			query:         "method=put&expires=30m&contentType=application/octet-stream&contentMd5=" + url.QueryEscape(md5Base64([]byte("fw"))),
+			expires:       1800,
+			signedHeaders: []string{"content-md5", "content-type"},
+			headers:       map[string]string{"Content-Type": "application/octet-stream", "Content-MD5": md5Base64([]byte("fw"))},
+		},
+		{
+			name:          "resumable POST",
+			query:         "method=POST",
+			expires:       900,
+			signedHeaders: []string{"x-goog-resumable"},
+			headers:       map[string]string{"X-Goog-Resumable": "start"},
+		},
+		{
+			name:    "HEAD of a generation with a download name",
+			query:   "method=HEAD&generation=42&responseContentDisposition=" + url.QueryEscape(`attachment; filename="fw.bin"`),
+			expires: 900,
+			params:  map[string]string{"generation": "42", "response-content-disposition": `attachment; filename="fw.bin"`},
+			headers: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, ar := sign(tt.query)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", res.StatusCode, ar.Error)
+			}
+			data := getDataMap(t, ar)
+
+			u, err := url.Parse(data["url"].(string))
+			if err != nil {
+				t.Fatalf("invalid url: %v", err)
+			}
+			q := u.Query()
+			if q.Get("X-Goog-Algorithm") != "GOOG4-RSA-SHA256" || q.Get("X-Goog-Signature") == "" {
+				t.Fatalf("expected a V4 signed url, got %s", u)
+			}
+			// The expiry is measured from signing, a moment after the request.
+			if expires, _ := strconv.Atoi(q.Get("X-Goog-Expires")); expires > tt.expires || expires < tt.expires-5 {
+				t.Fatalf("X-Goog-Expires = %q, want about %d", q.Get("X-Goog-Expires"), tt.expires)
+			}
+			for _, h := range tt.signedHeaders {
+				if !strings.Contains(q.Get("X-Goog-SignedHeaders"), h) {
+					t.Fatalf("expected %q in signed headers %q", h, q.Get("X-Goog-SignedHeaders"))
+				}
+			}
+			for k, v := range tt.params {
+				if q.Get(k) != v {
+					t.Fatalf("query %s = %q, want %q", k, q.Get(k), v)
+				}
+			}
+
+			headers, _ := data["headers"].(map[string]interface{})
+			if len(headers) != len(tt.headers) {
+				t.Fatalf("headers = %v, want %v", headers, tt.headers)
+			}
+			for k, v := range tt.headers {
+				if headers[k] != v {
+					t.Fatalf("header %s = %v, want %q", k, headers[k], v)
+				}
+			}
+		})
+	}
+
+	for _, query := range []string{"method=DELETE", "expires=2h", "expires=-1m", "contentMd5=bogus", "generation=x"} {
+		if res, _ := sign(query); res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, res.StatusCode)
+		}
+	}
+}
+
+func TestSignedURLsLocalStore(t *testing.T) {
+	srv := newTestServer(t, newLocalStore(t, "http://localhost:8080"))
+
+	res, err := http.Get(srv.URL + "/object-url?objectname=devices/fw.bin&method=PUT")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", res.StatusCode)
+	}
+	res.Body.Close()
+}
@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type transferFunc func(ctx context.Context, srcName, dstName string, conds Conditions) (*ObjectInfo, error)
+
+func CopyObject(c *gin.Context) {
+	transfer(c, uploader.CopyObject, "copied", OpDownload)
+}
+
+func MoveObject(c *gin.Context) {
+	transfer(c, uploader.MoveObject, "moved", OpDownload, OpDelete)
+}
+
+// transfer needs sourceOps on the source and upload on the destination.
+func transfer(c *gin.Context, fn transferFunc, verb string, sourceOps ...string) {
+	recursive := c.Query("recursive") == "true"
+	clean := cleanObjectName
+	if recursive {
+		clean = cleanPrefix
+	}
+
+	source, err := clean(c.Query("source"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	destination, err := clean(c.Query("destination"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if source == "" || destination == "" {
+		respondError(c, newError(ErrInvalidArgument, "source and destination are required"))
+		return
+	}
+	if source == destination {
+		respondError(c, newError(ErrInvalidArgument, "source and destination must differ"))
+		return
+	}
+
+	if recursive {
+		source = strings.TrimSuffix(source, "/") + "/"
+		destination = strings.TrimSuffix(destination, "/") + "/"
+	}
+
+	for _, op := range sourceOps {
+		if err := authorize(c, op, source); err != nil {
+			respondError(c, err)
+			return
+		}
+	}
+	if err := authorize(c, OpUpload, destination); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if recursive {
+		transferFolder(c, fn, verb, source, destination)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
+	defer cancel()
+
+	conds, err := requestConditions(ctx, c, destination)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	policy, err := checkCopy(ctx, destination, liveObject(source), &conds)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	info, err := fn(ctx, source, destination, conds)
+	if err != nil {
+		respondError(c, policy.uploadError(destination, err))
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{Message: "Object " + verb + " successfully", Data: info})
+}
+
+// transferFolder copies or moves every object under the source prefix to the
+// same relative name under the destination prefix. If-None-Match: * skips
+// objects that already exist at the destination. The destination folder's
+// policy is checked for every object.
+func transferFolder(c *gin.Context, fn transferFunc, verb, source, destination string) {
+	if strings.HasPrefix(destination, source) || strings.HasPrefix(source, destination) {
+		respondError(c, newError(ErrInvalidArgument, "source and destination folders must not overlap"))
+		return
+	}
+
+	var conds Conditions
+	if c.GetHeader("If-None-Match") == "*" {
+		conds.DoesNotExist = true
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
+	defer cancel()
+
+	names, err := uploader.ListObjects(ctx, source)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if len(names) == 0 {
+		respondError(c, newError(ErrNotFound, "no objects found under %q", source))
+		return
+	}
+
+	results := make([]ObjectResult, len(names))
+	runBatch(len(names), func(i int) {
+		dst := destination + strings.TrimPrefix(names[i], source)
+		results[i] = ObjectResult{Name: names[i], Destination: dst}
+
+		conds := conds
+		policy, err := checkCopy(ctx, dst, liveObject(names[i]), &conds)
+		if err != nil {
+			results[i].setError(err)
+			return
+		}
+
+		info, err := fn(ctx, names[i], dst, conds)
+		if err != nil {
+			results[i].setError(policy.uploadError(dst, err))
+			return
+		}
+		results[i].Generation = info.Generation
+	})
+
+	status, failed := batchStatus(results)
+	c.JSON(status, ApiResponse{
+		Message: fmt.Sprintf("%d of %d objects %s", len(results)-failed, len(results), verb),
+		Data:    results,
+	})
+}
@@ -0,0 +1,147 @@
+package handler_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func TestCopyAndMove(t *testing.T) {
+	for name, newStore := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			for _, objectname := range []string{"rel/1.0/app.bin", "rel/1.0/boot/loader.bin"} {
+				if _, err := store.UploadBuffer(t.Context(), []byte(objectname), objectname, 0, nil); err != nil {
+					t.Fatalf("UploadBuffer failed: %v", err)
+				}
+			}
+			srv := newTestServer(t, store)
+
+			post := func(path string, headers map[string]string) (*http.Response, apiResp) {
+				t.Helper()
+				req, _ := http.NewRequest(http.MethodPost, srv.URL+path, nil)
+				for k, v := range headers {
+					req.Header.Set(k, v)
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				return res, parseResp(t, res)
+			}
+			content := func(objectname string) (int, string) {
+				t.Helper()
+				res, err := http.Get(srv.URL + "/download-file?objectname=" + objectname)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				defer res.Body.Close()
+				body, _ := io.ReadAll(res.Body)
+				return res.StatusCode, string(body)
+			}
+
+			res, _ := post("/copy?source=rel/1.0/app.bin&destination=staging/app.bin", nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("copy: expected 200, got %d", res.StatusCode)
+			}
+			if status, body := content("staging/app.bin"); status != http.StatusOK || body != "rel/1.0/app.bin" {
+				t.Fatalf("copied object = %d %q", status, body)
+			}
+			if status, _ := content("rel/1.0/app.bin"); status != http.StatusOK {
+				t.Fatalf("copy removed the source: %d", status)
+			}
+
+			res, ar := post("/copy?source=rel/1.0/missing.bin&destination=staging/missing.bin", nil)
+			if res.StatusCode != http.StatusNotFound || ar.Code != "NOT_FOUND" {
+				t.Fatalf("copy of a missing object: expected 404 NOT_FOUND, got %d %q", res.StatusCode, ar.Code)
+			}
+			res, _ = post("/copy?source=rel/1.0/app.bin&destination=staging/app.bin", map[string]string{"If-None-Match": "*"})
+			if res.StatusCode != http.StatusPreconditionFailed {
+				t.Fatalf("copy onto an existing object with If-None-Match *: expected 412, got %d", res.StatusCode)
+			}
+
+			res, _ = post("/move?source=staging/app.bin&destination=staging/renamed.bin", nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("move: expected 200, got %d", res.StatusCode)
+			}
+			if status, _ := content("staging/app.bin"); status != http.StatusNotFound {
+				t.Fatalf("move left the source behind: %d", status)
+			}
+			if status, body := content("staging/renamed.bin"); status != http.StatusOK || body != "rel/1.0/app.bin" {
+				t.Fatalf("moved object = %d %q", status, body)
+			}
+
+			res, ar = post("/copy?source=rel/1.0&destination=rel/1.1&recursive=true", nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("folder copy: expected 200, got %d (%v)", res.StatusCode, ar.Data)
+			}
+			if results := ar.Data.([]interface{}); len(results) != 2 {
+				t.Fatalf("folder copy: expected 2 results, got %v", results)
+			}
+			if status, body := content("rel/1.1/boot/loader.bin"); status != http.StatusOK || body != "rel/1.0/boot/loader.bin" {
+				t.Fatalf("folder copy of nested object = %d %q", status, body)
+			}
+
+			if _, err := store.UploadBuffer(t.Context(), []byte("existing"), "archive/1.1/app.bin", 0, nil); err != nil {
+				t.Fatalf("UploadBuffer failed: %v", err)
+			}
+			res, ar = post("/move?source=rel/1.1/&destination=archive/1.1/&recursive=true", map[string]string{"If-None-Match": "*"})
+			if res.StatusCode != http.StatusMultiStatus {
+				t.Fatalf("folder move with a conflict: expected 207, got %d", res.StatusCode)
+			}
+			for _, r := range ar.Data.([]interface{}) {
+				result := r.(map[string]interface{})
+				failed := result["code"] == "PRECONDITION_FAILED"
+				if failed != strings.HasSuffix(result["name"].(string), "app.bin") {
+					t.Fatalf("unexpected folder move result %v", result)
+				}
+			}
+			if status, body := content("archive/1.1/app.bin"); status != http.StatusOK || body != "existing" {
+				t.Fatalf("folder move overwrote an existing object: %d %q", status, body)
+			}
+			if status, _ := content("rel/1.1/boot/loader.bin"); status != http.StatusNotFound {
+				t.Fatalf("folder move left a moved source behind: %d", status)
+			}
+
+			res, _ = post("/copy?source=rel/&destination=rel/1.0/copy/&recursive=true", nil)
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("overlapping folder copy: expected 400, got %d", res.StatusCode)
+			}
+			res, _ = post("/move?source=empty/&destination=other/&recursive=true", nil)
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatalf("folder move of an empty prefix: expected 404, got %d", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCopyObjectMultiCallRewrite(t *testing.T) {
+	fake := newFakeGCS(t)
+	fake.SetRewriteChunkSize(4)
+	fake.PutObject(testBucket, "big/source.bin", []byte("0123456789"))
+	uploader := newUploader(t, fake)
+
+	info, err := uploader.CopyObject(t.Context(), "big/source.bin", "big/copy.bin", handler.Conditions{})
+	if err != nil {
+		t.Fatalf("CopyObject failed: %v", err)
+	}
+	if info.Size != 10 {
+		t.Fatalf("expected 10 bytes copied, got %d", info.Size)
+	}
+
+	rewrites := 0
+	for _, r := range fake.Requests() {
+		if strings.Contains(r, "/rewriteTo/") {
+			rewrites++
+		}
+	}
+	if rewrites != 3 {
+		t.Fatalf("expected 3 rewrite calls, got %d", rewrites)
+	}
+	if obj, ok := fake.Object(testBucket, "big/copy.bin"); !ok || string(obj.Data) != "0123456789" {
+		t.Fatalf("copy not stored: %#v", obj)
+	}
+}
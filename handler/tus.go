@@ -0,0 +1,548 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tusVersion       = "1.0.0"
+	tusExtensions    = "creation,creation-with-upload,termination,expiration"
+	tusOffsetContent = "application/offset+octet-stream"
+	tusInfoExt       = ".info"
+	tusDataExt       = ".bin"
+)
+
+var (
+	tusStore           *TusStore
+	tusFinalizeTimeout = 30 * time.Minute
+
+	errTusNotFound = newError(ErrNotFound, "upload not found")
+)
+
+type TusConfig struct {
+	Dir string
+	// MaxSize limits Upload-Length. It can only lower the limit of
+	// ConfigureUploads, which applies when it is zero.
+	MaxSize    int64
+	Expiration time.Duration
+}
+
+type tusUpload struct {
+	ID         string            `json:"id"`
+	Length     int64             `json:"length"`
+	ObjectName string            `json:"objectname"`
+	Metadata   string            `json:"metadata,omitempty"`
+	Created    time.Time         `json:"created"`
+	Expires    time.Time         `json:"expires"`
+	Fields     map[string]string `json:"fields,omitempty"`
+
+	offset int64
+}
+
+type TusStore struct {
+	dir        string
+	maxSize    int64
+	expiration time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*tusLock
+}
+
+// tusLock serializes the requests on one upload. It is dropped from the
+// store once nobody holds or waits for it.
+type tusLock struct {
+	sync.Mutex
+	holders int
+}
+
+func NewTusStore(cfg TusConfig) (*TusStore, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	maxSize := cfg.MaxSize
+	if maxUploadSize > 0 && (maxSize == 0 || maxSize > maxUploadSize) {
+		maxSize = maxUploadSize
+	}
+	return &TusStore{
+		dir:        cfg.Dir,
+		maxSize:    maxSize,
+		expiration: cfg.Expiration,
+		locks:      make(map[string]*tusLock),
+	}, nil
+}
+
+func SetTusStore(store *TusStore) {
+	tusStore = store
+}
+
+func (t *TusStore) lock(id string) func() {
+	t.mu.Lock()
+	l, ok := t.locks[id]
+	if !ok {
+		l = &tusLock{}
+		t.locks[id] = l
+	}
+	l.holders++
+	t.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		t.mu.Lock()
+		l.holders--
+		if l.holders == 0 {
+			delete(t.locks, id)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// validTusID reports whether id has the form create gives upload ids.
+func validTusID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
+
+func (t *TusStore) infoPath(id string) string {
+	return filepath.Join(t.dir, id+tusInfoExt)
+}
+
+func (t *TusStore) dataPath(id string) string {
+	return filepath.Join(t.dir, id+tusDataExt)
+}
+
+func (t *TusStore) create(upload *tusUpload) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	upload.ID = hex.EncodeToString(id)
+	upload.Created = time.Now().UTC()
+	if t.expiration > 0 {
+		upload.Expires = upload.Created.Add(t.expiration)
+	}
+
+	data, err := os.OpenFile(t.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	data.Close()
+
+	return t.save(upload)
+}
+
+func (t *TusStore) save(upload *tusUpload) error {
+	info, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	tmp := t.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, info, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.infoPath(upload.ID))
+}
+
+func (t *TusStore) get(id string) (*tusUpload, error) {
+	if !validTusID(id) {
+		return nil, errTusNotFound
+	}
+
+	info, err := os.ReadFile(t.infoPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errTusNotFound
+		}
+		return nil, err
+	}
+
+	var upload tusUpload
+	if err := json.Unmarshal(info, &upload); err != nil {
+		return nil, err
+	}
+
+	// The data file is the source of truth for the offset so that bytes
+	// written before a crash are not lost.
+	stat, err := os.Stat(t.dataPath(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errTusNotFound
+		}
+		return nil, err
+	}
+	upload.offset = stat.Size()
+
+	if upload.expired(time.Now()) {
+		return nil, errTusNotFound
+	}
+	return &upload, nil
+}
+
+func (t *TusStore) remove(id string) error {
+	errData := os.Remove(t.dataPath(id))
+	errInfo := os.Remove(t.infoPath(id))
+	if errors.Is(errData, fs.ErrNotExist) && errors.Is(errInfo, fs.ErrNotExist) {
+		return errTusNotFound
+	}
+	return nil
+}
+
+func (t *TusStore) write(upload *tusUpload, body io.Reader) (int64, error) {
+	data, err := os.OpenFile(t.dataPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(data, io.LimitReader(body, upload.Length-upload.offset))
+	upload.offset += n
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// finalize uploads a completed file into the object store, subject to the
+// folder's policy and with the attributes from its metadata, and drops the
+// local state. On failure the state is kept so the client can retry with an
+// empty PATCH at the final offset.
+func (t *TusStore) finalize(ctx context.Context, upload *tusUpload) error {
+	data, err := os.Open(t.dataPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	attrs, err := tusAttrs(upload.Fields)
+	if err != nil {
+		return err
+	}
+	opts := UploadOptions{ChunkSize: uploadChunkSize, Attrs: attrs}
+	policy := policyFor(upload.ObjectName)
+	reader, err := policy.checkUpload(upload.ObjectName, upload.Length, data, &opts.Conditions)
+	if err == nil {
+		reader, err = detectContentType(upload.ObjectName, &opts.Attrs, reader)
+	}
+	if err == nil {
+		_, err = uploader.UploadStream(ctx, reader, upload.ObjectName, opts)
+		err = policy.uploadError(upload.ObjectName, err)
+	}
+	if err != nil {
+		// An upload the policy rejects can never complete, so its data is
+		// dropped now instead of when it expires.
+		if rejected(err) {
+			t.remove(upload.ID)
+		}
+		return err
+	}
+	return t.remove(upload.ID)
+}
+
+func (t *TusStore) PurgeExpired() (int, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), tusInfoExt)
+		if !ok {
+			continue
+		}
+
+		unlock := t.lock(id)
+		info, err := os.ReadFile(t.infoPath(id))
+		var upload tusUpload
+		if err == nil && json.Unmarshal(info, &upload) == nil && upload.expired(now) {
+			if t.remove(id) == nil {
+				purged++
+			}
+		}
+		unlock()
+	}
+	return purged, nil
+}
+
+func (u *tusUpload) expired(now time.Time) bool {
+	return !u.Expires.IsZero() && now.After(u.Expires)
+}
+
+func parseTusMetadata(header string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, newError(ErrInvalidArgument, "invalid Upload-Metadata value for %q", key)
+		}
+		fields[key] = string(value)
+	}
+	return fields, nil
+}
+
+func tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+}
+
+func tusUploadHeaders(c *gin.Context, upload *tusUpload) {
+	c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if !upload.Expires.IsZero() {
+		c.Header("Upload-Expires", upload.Expires.Format(http.TimeFormat))
+	}
+}
+
+func tusPreflight(c *gin.Context) bool {
+	tusHeaders(c)
+
+	if tusStore == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, ApiResponse{Error: "resumable uploads are not enabled"})
+		return false
+	}
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, ApiResponse{Error: "unsupported Tus-Resumable version"})
+		return false
+	}
+	return true
+}
+
+func TusOptions(c *gin.Context) {
+	tusHeaders(c)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if tusStore != nil && tusStore.maxSize > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(tusStore.maxSize, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func TusCreate(c *gin.Context) {
+	if !tusPreflight(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		respondError(c, newError(ErrInvalidArgument, "Upload-Length is required"))
+		return
+	}
+	if tusStore.maxSize > 0 && length > tusStore.maxSize {
+		respondError(c, newError(ErrTooLarge, "upload exceeds maximum size"))
+		return
+	}
+
+	fields, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	var attrs ObjectAttrs
+	if err == nil {
+		attrs, err = tusAttrs(fields)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var objectname string
+	if name := fields["objectname"]; name != "" {
+		objectname, err = cleanObjectName(name)
+	} else {
+		folder := fields["folder"]
+		filename := strings.TrimSpace(fields["filename"])
+		if folder == "" || filename == "" {
+			respondError(c, newError(ErrInvalidArgument, "objectname or folder and filename metadata are required"))
+			return
+		}
+		objectname, err = uploadObjectName(folder, filename)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, OpUpload, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	err = policyFor(objectname).checkCreate(ctx, objectname, length, attrs.ContentType)
+	cancel()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	upload := &tusUpload{
+		Length:     length,
+		ObjectName: objectname,
+		Metadata:   c.GetHeader("Upload-Metadata"),
+		Fields:     fields,
+	}
+	if err := tusStore.create(upload); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+upload.ID)
+
+	if c.GetHeader("Content-Type") == tusOffsetContent {
+		unlock := tusStore.lock(upload.ID)
+		defer unlock()
+
+		if _, err := tusStore.write(upload, c.Request.Body); err != nil {
+			respondError(c, err)
+			return
+		}
+		if upload.offset == upload.Length && !tusComplete(c, upload) {
+			return
+		}
+	}
+
+	tusUploadHeaders(c, upload)
+	c.JSON(http.StatusCreated, ApiResponse{Message: "Upload created", Data: map[string]string{"id": upload.ID, "path": objectname}})
+}
+
+func TusHead(c *gin.Context) {
+	if !tusPreflight(c) {
+		return
+	}
+
+	upload, err := tusStore.get(c.Param("id"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, OpUpload, upload.ObjectName); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	tusUploadHeaders(c, upload)
+	if upload.Metadata != "" {
+		c.Header("Upload-Metadata", upload.Metadata)
+	}
+	c.Status(http.StatusOK)
+}
+
+func TusPatch(c *gin.Context) {
+	if !tusPreflight(c) {
+		return
+	}
+
+	if c.GetHeader("Content-Type") != tusOffsetContent {
+		respondError(c, newError(ErrUnsupportedMediaType, "Content-Type must be %s", tusOffsetContent))
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondError(c, newError(ErrInvalidArgument, "Upload-Offset is required"))
+		return
+	}
+
+	id := c.Param("id")
+	if !validTusID(id) {
+		respondError(c, errTusNotFound)
+		return
+	}
+	unlock := tusStore.lock(id)
+	defer unlock()
+
+	upload, err := tusStore.get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, OpUpload, upload.ObjectName); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if offset != upload.offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		respondError(c, newError(ErrConflict, "Upload-Offset does not match current offset"))
+		return
+	}
+	if c.Request.ContentLength > upload.Length-upload.offset {
+		respondError(c, newError(ErrTooLarge, "request body exceeds Upload-Length"))
+		return
+	}
+
+	if _, err := tusStore.write(upload, c.Request.Body); err != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		respondError(c, err)
+		return
+	}
+
+	if upload.offset == upload.Length && !tusComplete(c, upload) {
+		return
+	}
+
+	tusUploadHeaders(c, upload)
+	c.Status(http.StatusNoContent)
+}
+
+func TusDelete(c *gin.Context) {
+	if !tusPreflight(c) {
+		return
+	}
+
+	id := c.Param("id")
+	if !validTusID(id) {
+		respondError(c, errTusNotFound)
+		return
+	}
+	unlock := tusStore.lock(id)
+	defer unlock()
+
+	upload, err := tusStore.get(id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := authorize(c, OpUpload, upload.ObjectName); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := tusStore.remove(id); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func tusComplete(c *gin.Context, upload *tusUpload) bool {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), tusFinalizeTimeout)
+	defer cancel()
+
+	if err := tusStore.finalize(ctx, upload); err != nil {
+		tusUploadHeaders(c, upload)
+		respondError(c, fmt.Errorf("failed to finalize upload: %w", err))
+		return false
+	}
+	return true
+}
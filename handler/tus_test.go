@@ -0,0 +1,329 @@
+package handler_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gcsuploader/handler"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTusServer(t *testing.T, store handler.ObjectStore, cfg handler.TusConfig) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.OPTIONS("/tus", handler.TusOptions)
+	r.POST("/tus", handler.TusCreate)
+	r.HEAD("/tus/:id", handler.TusHead)
+	r.PATCH("/tus/:id", handler.TusPatch)
+	r.DELETE("/tus/:id", handler.TusDelete)
+
+	tus, err := handler.NewTusStore(cfg)
+	if err != nil {
+		t.Fatalf("NewTusStore failed: %v", err)
+	}
+	handler.SetObjectStore(store)
+	handler.SetTusStore(tus)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func tusRequest(t *testing.T, method, url string, headers map[string]string, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func tusMetadata(pairs ...string) string {
+	var parts []string
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+" "+base64.StdEncoding.EncodeToString([]byte(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+func createTusUpload(t *testing.T, srvURL string, length int, metadata string) string {
+	t.Helper()
+	res := tusRequest(t, http.MethodPost, srvURL+"/tus", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": metadata,
+	}, "")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", res.StatusCode)
+	}
+	location := res.Header.Get("Location")
+	if !strings.HasPrefix(location, "/tus/") {
+		t.Fatalf("unexpected Location %q", location)
+	}
+	return srvURL + location
+}
+
+func patchTus(t *testing.T, uploadURL string, offset int, chunk string) *http.Response {
+	t.Helper()
+	return tusRequest(t, http.MethodPatch, uploadURL, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": strconv.Itoa(offset),
+	}, chunk)
+}
+
+func TestTusUpload(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	dir := t.TempDir()
+	cfg := handler.TusConfig{Dir: dir, MaxSize: 1 << 20, Expiration: time.Hour}
+	srv := newTusServer(t, store, cfg)
+
+	res := tusRequest(t, http.MethodOptions, srv.URL+"/tus", nil, "")
+	if res.StatusCode != http.StatusNoContent || !strings.Contains(res.Header.Get("Tus-Extension"), "termination") {
+		t.Fatalf("unexpected OPTIONS response %d %v", res.StatusCode, res.Header)
+	}
+
+	content := "firmware-image-contents"
+	uploadURL := createTusUpload(t, srv.URL, len(content), tusMetadata("folder", "firmware", "filename", "image.bin"))
+
+	res = patchTus(t, uploadURL, 0, content[:10])
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "10" {
+		t.Fatalf("unexpected PATCH response %d offset %q", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+
+	res = patchTus(t, uploadURL, 5, content[5:])
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for wrong offset, got %d", res.StatusCode)
+	}
+
+	// A fresh store over the same directory simulates a server restart.
+	newTusServer(t, store, cfg)
+
+	res = tusRequest(t, http.MethodHead, uploadURL, nil, "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Upload-Offset") != "10" || res.Header.Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Fatalf("unexpected HEAD response %d %v", res.StatusCode, res.Header)
+	}
+	if res.Header.Get("Upload-Expires") == "" {
+		t.Fatal("expected Upload-Expires header")
+	}
+
+	res = patchTus(t, uploadURL, 10, content[10:])
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 on final PATCH, got %d", res.StatusCode)
+	}
+
+	obj, ok := store.Object("firmware/image.bin")
+	if !ok || string(obj.Data) != content {
+		t.Fatalf("expected finalized object, got %#v", obj)
+	}
+
+	res = tusRequest(t, http.MethodHead, uploadURL, nil, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after completion, got %d", res.StatusCode)
+	}
+}
+
+func TestTusCreationWithUpload(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTusServer(t, store, handler.TusConfig{Dir: t.TempDir()})
+
+	res := tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": tusMetadata("objectname", "docs/hello.txt"),
+		"Content-Type":    "application/offset+octet-stream",
+	}, "hello")
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Upload-Offset") != "5" {
+		t.Fatalf("unexpected response %d %v", res.StatusCode, res.Header)
+	}
+	obj, ok := store.Object("docs/hello.txt")
+	if !ok || string(obj.Data) != "hello" {
+		t.Fatal("expected object to be finalized")
+	}
+	if obj.ContentType != "text/plain; charset=utf-8" {
+		t.Fatalf("expected a detected content type, got %q", obj.ContentType)
+	}
+
+	res = tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": tusMetadata("objectname", "docs/hello", "filetype", "text/markdown", "cacheControl", "no-cache", "x-meta-build", "42"),
+		"Content-Type":    "application/offset+octet-stream",
+	}, "hello")
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", res.StatusCode)
+	}
+	obj, _ = store.Object("docs/hello")
+	if obj.ContentType != "text/markdown" || obj.CacheControl != "no-cache" || obj.Metadata["build"] != "42" {
+		t.Fatalf("expected the metadata attributes to be stored, got %+v", obj)
+	}
+}
+
+func TestTusRejections(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTusServer(t, store, handler.TusConfig{Dir: t.TempDir(), MaxSize: 10})
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/tus", nil)
+	req.Header.Set("Upload-Length", "5")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 without Tus-Resumable, got %d", res.StatusCode)
+	}
+
+	res = tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": tusMetadata("objectname", "big.bin"),
+	}, "")
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 above max size, got %d", res.StatusCode)
+	}
+
+	res = tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{"Upload-Length": "5"}, "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without object name metadata, got %d", res.StatusCode)
+	}
+
+	res = tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": tusMetadata("objectname", "a.bin", "contentType", "not a type"),
+	}, "")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid content type, got %d", res.StatusCode)
+	}
+
+	for _, id := range []string{"unknown", "0123456789abcdef0123456789abcdef"} {
+		if res := patchTus(t, srv.URL+"/tus/"+id, 0, "data"); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected 404, got %d", id, res.StatusCode)
+		}
+		if res := tusRequest(t, http.MethodDelete, srv.URL+"/tus/"+id, nil, ""); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected 404 on termination, got %d", id, res.StatusCode)
+		}
+	}
+
+	uploadURL := createTusUpload(t, srv.URL, 4, tusMetadata("objectname", "a.bin"))
+	res = patchTus(t, uploadURL, 0, "too long")
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for oversized PATCH, got %d", res.StatusCode)
+	}
+
+	res = tusRequest(t, http.MethodDelete, uploadURL, nil, "")
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 on termination, got %d", res.StatusCode)
+	}
+	res = tusRequest(t, http.MethodHead, uploadURL, nil, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 after termination, got %d", res.StatusCode)
+	}
+}
+
+func TestTusExpiration(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	cfg := handler.TusConfig{Dir: t.TempDir(), Expiration: time.Millisecond}
+	srv := newTusServer(t, store, cfg)
+
+	uploadURL := createTusUpload(t, srv.URL, 4, tusMetadata("objectname", "a.bin"))
+	time.Sleep(10 * time.Millisecond)
+
+	res := tusRequest(t, http.MethodHead, uploadURL, nil, "")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for expired upload, got %d", res.StatusCode)
+	}
+
+	tus, _ := handler.NewTusStore(cfg)
+	purged, err := tus.PurgeExpired()
+	if err != nil || purged != 1 {
+		t.Fatalf("expected one purged upload, got %d (%v)", purged, err)
+	}
+}
+
+func TestTusPolicy(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTusServer(t, store, handler.TusConfig{Dir: t.TempDir()})
+	configurePolicies(t, handler.PolicyConfig{Policies: []handler.FolderPolicy{
+		{Prefix: "firmware", NoOverwrite: true, MaxSize: 16, AllowedTypes: []string{"application/octet-stream"}, Filenames: []string{"*.bin"}},
+	}})
+
+	if _, err := store.UploadBuffer(t.Context(), []byte("original"), "firmware/app.bin", 0, nil); err != nil {
+		t.Fatalf("UploadBuffer failed: %v", err)
+	}
+
+	// Everything the policy can tell from the creation request is refused
+	// before any content is sent.
+	creations := []struct {
+		name     string
+		length   int
+		metadata string
+		status   int
+	}{
+		{"existing object", 3, tusMetadata("folder", "firmware", "filename", "app.bin"), http.StatusConflict},
+		{"size over limit", 17, tusMetadata("folder", "firmware", "filename", "big.bin"), http.StatusRequestEntityTooLarge},
+		{"filename", 3, tusMetadata("folder", "firmware", "filename", "app.exe"), http.StatusBadRequest},
+		{"declared type", 3, tusMetadata("folder", "firmware", "filename", "notes.bin", "filetype", "text/plain"), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range creations {
+		res := tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{
+			"Upload-Length":   strconv.Itoa(tt.length),
+			"Upload-Metadata": tt.metadata,
+		}, "")
+		if res.StatusCode != tt.status {
+			t.Fatalf("%s: expected %d, got %d", tt.name, tt.status, res.StatusCode)
+		}
+	}
+
+	tests := []struct {
+		filename string
+		content  string
+		status   int
+	}{
+		{"notes.bin", "plain text", http.StatusUnsupportedMediaType},
+		{"new.bin", "\x00\x01\x02", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		uploadURL := createTusUpload(t, srv.URL, len(tt.content), tusMetadata("folder", "firmware", "filename", tt.filename))
+		if res := patchTus(t, uploadURL, 0, tt.content); res.StatusCode != tt.status {
+			t.Fatalf("%s: expected %d, got %d", tt.filename, tt.status, res.StatusCode)
+		}
+		if res := tusRequest(t, http.MethodHead, uploadURL, nil, ""); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: expected the upload to be removed, got %d", tt.filename, res.StatusCode)
+		}
+	}
+	if obj, _ := store.Object("firmware/app.bin"); string(obj.Data) != "original" {
+		t.Fatalf("expected the existing object to be kept, got %q", obj.Data)
+	}
+	if _, ok := store.Object("firmware/notes.bin"); ok {
+		t.Fatal("expected a disallowed type not to be stored")
+	}
+}
+
+func TestTusDefaultMaxSize(t *testing.T) {
+	handler.ConfigureUploads(handler.UploadConfig{MaxSize: 10, ChunkSize: 8 << 20})
+	t.Cleanup(func() { handler.ConfigureUploads(handler.UploadConfig{ChunkSize: 8 << 20}) })
+
+	for _, maxSize := range []int64{0, 20} {
+		srv := newTusServer(t, handler.NewMemoryStore(testBucket), handler.TusConfig{Dir: t.TempDir(), MaxSize: maxSize})
+
+		if res := tusRequest(t, http.MethodOptions, srv.URL+"/tus", nil, ""); res.Header.Get("Tus-Max-Size") != "10" {
+			t.Fatalf("TUS_MAX_SIZE %d: expected Tus-Max-Size 10, got %q", maxSize, res.Header.Get("Tus-Max-Size"))
+		}
+		res := tusRequest(t, http.MethodPost, srv.URL+"/tus", map[string]string{
+			"Upload-Length":   "11",
+			"Upload-Metadata": tusMetadata("objectname", "big.bin"),
+		}, "")
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("TUS_MAX_SIZE %d: expected 413, got %d", maxSize, res.StatusCode)
+		}
+	}
+}
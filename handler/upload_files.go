@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadFiles writes several files of one form upload on up to
+// batchConcurrency goroutines. Each "file" part may be given a relative path
+// in the "paths" field at the same position, which keeps the directory
+// structure below folder; otherwise the base name of the file is used.
+//
+// With atomic=true the upload is all-or-nothing: once a file fails, the rest
+// are abandoned and the objects already written are deleted. Objects that a
+// file replaced are not restored.
+func uploadFiles(c *gin.Context, folder string, files []*multipart.FileHeader, attrs ObjectAttrs) {
+	paths := c.PostFormArray("paths")
+	if len(paths) > 0 && len(paths) != len(files) {
+		respondError(c, newError(ErrInvalidArgument, "got %d paths for %d files", len(paths), len(files)))
+		return
+	}
+	allOrNothing, err := strconv.ParseBool(c.DefaultPostForm("atomic", "false"))
+	if err != nil {
+		respondError(c, newError(ErrInvalidArgument, "atomic must be true or false"))
+		return
+	}
+
+	results := make([]ObjectResult, len(files))
+
+	// cause is the first failure, which aborts an atomic upload.
+	var cause error
+	var causeOnce sync.Once
+	fail := func(i int, err error) {
+		results[i].setError(err)
+		causeOnce.Do(func() { cause = fmt.Errorf("upload of %q failed: %w", results[i].Name, err) })
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
+	defer cancel()
+
+	// The request is read here, one file at a time, because a gin.Context
+	// must not be used from the upload goroutines.
+	conds := make([]Conditions, len(files))
+	seen := make(map[string]bool)
+	for i, file := range files {
+		results[i] = ObjectResult{Name: file.Filename}
+		objectname, err := uploadObjectName(folder, file.Filename)
+		if len(paths) > 0 {
+			results[i].Name = paths[i]
+			objectname, err = relativeObjectName(folder, paths[i])
+		}
+		if err == nil && seen[objectname] {
+			err = newError(ErrInvalidArgument, "%q is uploaded more than once", objectname)
+		}
+		if err == nil {
+			err = authorize(c, OpUpload, objectname)
+		}
+		if err == nil {
+			conds[i], err = requestConditions(ctx, c, objectname)
+		}
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		seen[objectname] = true
+		results[i].Destination = objectname
+	}
+
+	// Cancelling uploadCtx abandons the remaining files of an atomic upload.
+	uploadCtx, abort := context.WithCancel(ctx)
+	defer abort()
+	if allOrNothing && cause != nil {
+		abort()
+	}
+
+	runBatch(len(files), func(i int) {
+		if results[i].Error != "" {
+			return
+		}
+		if allOrNothing && uploadCtx.Err() != nil {
+			results[i].setError(errUploadAborted)
+			return
+		}
+		opts := UploadOptions{ChunkSize: uploadChunkSize, Attrs: attrs, Conditions: conds[i]}
+		info, err := uploadFormFile(uploadCtx, files[i], results[i].Destination, opts)
+		switch {
+		case err == nil:
+			results[i].Generation = info.Generation
+		case allOrNothing && uploadCtx.Err() != nil && ctx.Err() == nil:
+			results[i].setError(errUploadAborted)
+		default:
+			fail(i, err)
+			if allOrNothing {
+				abort()
+			}
+		}
+	})
+
+	if allOrNothing && cause != nil {
+		rolledBack := rollbackUploads(ctx, results)
+		status, code := errorStatus(cause)
+		c.JSON(status, ApiResponse{
+			Message: fmt.Sprintf("upload aborted: %d of %d files rolled back", rolledBack, len(results)),
+			Error:   cause.Error(),
+			Code:    code,
+			Data:    results,
+		})
+		return
+	}
+
+	status, failed := batchStatus(results)
+	if status == http.StatusOK {
+		status = http.StatusCreated
+	}
+	c.JSON(status, ApiResponse{
+		Message: fmt.Sprintf("%d of %d files uploaded", len(results)-failed, len(results)),
+		Data:    results,
+	})
+}
+
+var errUploadAborted = newError(ErrAborted, "not uploaded because another file failed")
+
+// relativeObjectName joins a folder and a client supplied relative path. The
+// path is checked on its own first so that it cannot climb out of folder.
+func relativeObjectName(folder, relpath string) (string, error) {
+	rel, err := cleanObjectName(strings.ReplaceAll(relpath, `\`, "/"))
+	if err != nil {
+		return "", err
+	}
+	return cleanObjectName(strings.TrimSuffix(folder, "/") + "/" + rel)
+}
+
+// rollbackUploads deletes the objects an aborted atomic upload wrote, unless
+// they have been overwritten since, and returns how many it deleted.
+func rollbackUploads(ctx context.Context, results []ObjectResult) int {
+	var rolledBack atomic.Int64
+	runBatch(len(results), func(i int) {
+		r := &results[i]
+		if r.Error != "" || r.Generation == 0 {
+			return
+		}
+		conds := Conditions{GenerationMatch: r.Generation}
+		if err := uploader.DeleteObjectIf(ctx, r.Destination, conds); err != nil {
+			r.setError(fmt.Errorf("failed to roll back after another file failed: %w", err))
+			return
+		}
+		r.Generation = 0
+		r.setError(newError(ErrAborted, "rolled back because another file failed"))
+		rolledBack.Add(1)
+	})
+	return int(rolledBack.Load())
+}
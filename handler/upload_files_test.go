@@ -0,0 +1,181 @@
+package handler_test
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+type formFile struct {
+	filename string
+	path     string
+	content  string
+}
+
+func uploadFiles(t *testing.T, url string, fields map[string]string, files []formFile) (int, apiResp) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for _, f := range files {
+		if f.path != "" {
+			mw.WriteField("paths", f.path)
+		}
+		fw, err := mw.CreateFormFile("file", f.filename)
+		if err != nil {
+			t.Fatalf("CreateFormFile failed: %v", err)
+		}
+		fw.Write([]byte(f.content))
+	}
+	mw.Close()
+
+	res, err := http.Post(url+"/upload-file", mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return res.StatusCode, parseResp(t, res)
+}
+
+func TestUploadMultipleFiles(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+
+	handler.ConfigureBatches(handler.BatchConfig{Concurrency: 2})
+	t.Cleanup(func() { handler.ConfigureBatches(handler.BatchConfig{Concurrency: 8}) })
+
+	files := []formFile{
+		{"app.bin", "app.bin", "application"},
+		{"fw.bin", "modem/fw.bin", "modem"},
+		{"fw.bin", `radio\fw.bin`, "radio"},
+		{"notes.txt", "docs/notes.txt", "release notes"},
+	}
+	status, ar := uploadFiles(t, srv.URL, map[string]string{"folder": "release/v1", "x-meta-build": "42"}, files)
+	if status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s %v", status, ar.Error, ar.Data)
+	}
+	if ar.Message != "4 of 4 files uploaded" {
+		t.Fatalf("unexpected message %q", ar.Message)
+	}
+	for object, content := range map[string]string{
+		"release/v1/app.bin":        "application",
+		"release/v1/modem/fw.bin":   "modem",
+		"release/v1/radio/fw.bin":   "radio",
+		"release/v1/docs/notes.txt": "release notes",
+	} {
+		obj, ok := store.Object(object)
+		if !ok || string(obj.Data) != content || obj.Metadata["build"] != "42" {
+			t.Fatalf("expected %s to be uploaded, got %+v", object, obj)
+		}
+	}
+
+	// Without paths files are named by their base name, so two files called
+	// fw.bin clash.
+	status, ar = uploadFiles(t, srv.URL, map[string]string{"folder": "release/v2"}, []formFile{
+		{filename: "fw.bin", content: "modem"},
+		{filename: "fw.bin", content: "radio"},
+		{filename: "app.bin", content: "application"},
+	})
+	if status != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", status, ar.Error)
+	}
+	results := extractResults(t, ar)
+	if results["app.bin"]["error"] != nil {
+		t.Fatalf("expected app.bin to be uploaded, got %v", results["app.bin"])
+	}
+	if _, ok := store.Object("release/v2/app.bin"); !ok {
+		t.Fatal("expected release/v2/app.bin to be uploaded")
+	}
+
+	status, ar = uploadFiles(t, srv.URL, map[string]string{"folder": "release/v3"}, []formFile{
+		{"a.bin", "../a.bin", "escape"},
+		{"b.bin", "b.bin", "b"},
+	})
+	if results := extractResults(t, ar); status != http.StatusMultiStatus || results["../a.bin"]["code"] != "INVALID_ARGUMENT" {
+		t.Fatalf("expected the parent path to be rejected, got %d: %v", status, ar.Data)
+	}
+	if _, ok := store.Object("release/a.bin"); ok {
+		t.Fatal("expected a path outside the folder not to be written")
+	}
+
+	failures := []struct {
+		name   string
+		fields map[string]string
+		files  []formFile
+	}{
+		{"path count", map[string]string{"folder": "release/v4", "paths": "a.bin"}, []formFile{{filename: "a.bin"}, {filename: "b.bin"}}},
+		{"atomic value", map[string]string{"folder": "release/v4", "atomic": "maybe"}, []formFile{{filename: "a.bin"}, {filename: "b.bin"}}},
+		{"checksums", map[string]string{"folder": "release/v4", "md5": "AAAAAAAAAAAAAAAAAAAAAA=="}, []formFile{{filename: "a.bin"}, {filename: "b.bin"}}},
+		{"extract", map[string]string{"folder": "release/v4", "mode": "extract"}, []formFile{{filename: "a.zip"}, {filename: "b.zip"}}},
+	}
+	for _, f := range failures {
+		if status, ar := uploadFiles(t, srv.URL, f.fields, f.files); status != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d: %s", f.name, status, ar.Error)
+		}
+	}
+}
+
+func TestUploadMultipleFilesAtomic(t *testing.T) {
+	store := handler.NewMemoryStore(testBucket)
+	srv := newTestServer(t, store)
+	configurePolicies(t, handler.PolicyConfig{Policies: []handler.FolderPolicy{
+		{Prefix: "release/v1/bin", Filenames: []string{"*.bin"}},
+	}})
+
+	// Uploads run one at a time, so the failing file comes after the others
+	// have been written.
+	handler.ConfigureBatches(handler.BatchConfig{Concurrency: 1})
+	t.Cleanup(func() { handler.ConfigureBatches(handler.BatchConfig{Concurrency: 8}) })
+
+	files := []formFile{
+		{"app.bin", "app.bin", "application"},
+		{"fw.bin", "modem/fw.bin", "modem"},
+		{"tool.exe", "bin/tool.exe", "tool"},
+		{"notes.txt", "notes.txt", "notes"},
+	}
+	status, ar := uploadFiles(t, srv.URL, map[string]string{"folder": "release/v1", "atomic": "true"}, files)
+	if status != http.StatusBadRequest || ar.Code != "INVALID_ARGUMENT" {
+		t.Fatalf("expected 400 INVALID_ARGUMENT, got %d %s: %s", status, ar.Code, ar.Error)
+	}
+	results := extractResults(t, ar)
+	for _, name := range []string{"app.bin", "modem/fw.bin", "notes.txt"} {
+		if results[name]["code"] != "ABORTED" {
+			t.Fatalf("%s: expected ABORTED, got %v", name, results[name])
+		}
+	}
+	for _, object := range []string{"release/v1/app.bin", "release/v1/modem/fw.bin", "release/v1/notes.txt"} {
+		if _, ok := store.Object(object); ok {
+			t.Fatalf("expected %s to be rolled back", object)
+		}
+	}
+
+	// A file that cannot be rolled back is reported.
+	store.InjectFailure("DeleteObject", errors.New("backend unavailable"), 1)
+	status, ar = uploadFiles(t, srv.URL, map[string]string{"folder": "release/v1", "atomic": "true"}, files)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", status, ar.Error)
+	}
+	if results := extractResults(t, ar); results["app.bin"]["code"] != "INTERNAL" {
+		t.Fatalf("expected the failed rollback to be reported, got %v", results["app.bin"])
+	}
+	if _, ok := store.Object("release/v1/app.bin"); !ok {
+		t.Fatal("expected the object that failed to roll back to remain")
+	}
+
+	// Names are checked before anything is written.
+	status, ar = uploadFiles(t, srv.URL, map[string]string{"folder": "release/v2", "atomic": "true"}, []formFile{
+		{"app.bin", "app.bin", "application"},
+		{"a.bin", "../a.bin", "escape"},
+	})
+	if status != http.StatusBadRequest || ar.Message != "upload aborted: 0 of 2 files rolled back" {
+		t.Fatalf("expected 400 with nothing written, got %d: %s", status, ar.Message)
+	}
+	if _, ok := store.Object("release/v2/app.bin"); ok {
+		t.Fatal("expected nothing to be uploaded")
+	}
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func versionedStore() (VersionedStore, error) {
+	versioned, ok := uploader.(VersionedStore)
+	if !ok {
+		return nil, newError(ErrNotSupported, "the configured storage backend does not support object versioning")
+	}
+	return versioned, nil
+}
+
+// generationRequest resolves the versioned store and the required generation
+// query parameter of a request.
+func generationRequest(c *gin.Context) (VersionedStore, int64, error) {
+	versioned, err := versionedStore()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	generation, err := strconv.ParseInt(c.Query("generation"), 10, 64)
+	if err != nil || generation <= 0 {
+		return nil, 0, newError(ErrInvalidArgument, "generation must be a positive integer")
+	}
+	return versioned, generation, nil
+}
+
+func objectGeneration(versioned VersionedStore, objectname string, generation int64) objectSource {
+	open := func(ctx context.Context, _, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+		return versioned.NewGenerationRangeReader(ctx, objectname, generation, offset, length)
+	}
+	return objectSource{
+		stat: func(ctx context.Context) (*ObjectInfo, error) {
+			probe, info, err := open(ctx, 0, 0, 0)
+			if err != nil {
+				return nil, err
+			}
+			probe.Close()
+			return info, nil
+		},
+		open: open,
+	}
+}
+
+func ListVersions(c *gin.Context) {
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := authorize(c, OpList, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	versioned, err := versionedStore()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	versions, err := versioned.ListVersions(ctx, objectname)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if len(versions) > 0 {
+		c.JSON(http.StatusOK, ApiResponse{Message: "Versions found", Data: versions})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{Message: "No versions found"})
+}
+
+func RestoreVersion(c *gin.Context) {
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := authorize(c, OpUpload, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	versioned, generation, err := generationRequest(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uploadTimeout)
+	defer cancel()
+
+	// The restored content must satisfy the folder's policy like any
+	// other write.
+	var conds Conditions
+	policy, err := checkCopy(ctx, objectname, objectGeneration(versioned, objectname, generation), &conds)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	info, err := versioned.RestoreVersion(ctx, objectname, generation, conds)
+	if err != nil {
+		respondError(c, policy.uploadError(objectname, err))
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{Message: "Version restored successfully", Data: info})
+}
+
+func DeleteVersion(c *gin.Context) {
+	objectname, err := objectNameParam(c, "objectname")
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := authorize(c, OpDelete, objectname); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	versioned, generation, err := generationRequest(c)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+
+	if err := versioned.DeleteVersion(ctx, objectname, generation); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{Message: "Version deleted successfully", Data: map[string]any{"path": objectname, "generation": generation}})
+}
@@ -0,0 +1,156 @@
+package handler_test
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gcsuploader/handler"
+)
+
+func TestVersions(t *testing.T) {
+	stores := map[string]func(t *testing.T) handler.ObjectStore{
+		"memory": func(t *testing.T) handler.ObjectStore {
+			return handler.NewMemoryStore(testBucket)
+		},
+		"fakegcs": func(t *testing.T) handler.ObjectStore {
+			fake := newFakeGCS(t)
+			fake.SetVersioning(true)
+			return newUploader(t, fake)
+		},
+	}
+
+	const objectname = "fw/app.bin"
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			for _, content := range []string{"version one", "version two"} {
+				if _, err := store.UploadBuffer(t.Context(), []byte(content), objectname, 0, nil); err != nil {
+					t.Fatalf("UploadBuffer failed: %v", err)
+				}
+			}
+			srv := newTestServer(t, store)
+
+			do := func(method, path string) *http.Response {
+				t.Helper()
+				req, _ := http.NewRequest(method, srv.URL+path, nil)
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				return res
+			}
+
+			listVersions := func() []string {
+				t.Helper()
+				res := do(http.MethodGet, "/versions?objectname="+objectname)
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("expected 200 listing versions, got %d", res.StatusCode)
+				}
+				versions, _ := parseResp(t, res).Data.([]interface{})
+				var generations []string
+				for _, v := range versions {
+					generations = append(generations, strconv.FormatFloat(v.(map[string]interface{})["generation"].(float64), 'f', -1, 64))
+				}
+				return generations
+			}
+
+			generations := listVersions()
+			if len(generations) != 2 {
+				t.Fatalf("expected 2 versions, got %v", generations)
+			}
+			first, second := generations[0], generations[1]
+
+			res := do(http.MethodGet, "/download-file?objectname="+objectname+"&generation="+first)
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || string(body) != "version one" {
+				t.Fatalf("download of first generation = %d %q", res.StatusCode, body)
+			}
+			if res.Header.Get("ETag") != strconv.Quote(first) {
+				t.Fatalf("expected ETag of first generation, got %q", res.Header.Get("ETag"))
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/download-file?objectname="+objectname+"&generation="+first, nil)
+			req.Header.Set("Range", "bytes=8-")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, _ = io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusPartialContent || string(body) != "one" {
+				t.Fatalf("ranged download of first generation = %d %q", res.StatusCode, body)
+			}
+
+			res = do(http.MethodGet, "/object-url?objectname="+objectname+"&generation="+first)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200 signing generation, got %d", res.StatusCode)
+			}
+			if url := getDataMap(t, parseResp(t, res))["url"].(string); !strings.Contains(url, "generation="+first) {
+				t.Fatalf("expected generation in url, got %q", url)
+			}
+
+			res = do(http.MethodPost, "/versions/restore?objectname="+objectname+"&generation="+first)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200 restoring, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+
+			res = do(http.MethodGet, "/download-file?objectname="+objectname)
+			body, _ = io.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != "version one" {
+				t.Fatalf("expected restored content, got %q", body)
+			}
+			if generations := listVersions(); len(generations) != 3 {
+				t.Fatalf("expected 3 versions after restore, got %v", generations)
+			}
+
+			res = do(http.MethodDelete, "/versions?objectname="+objectname+"&generation="+second)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200 deleting generation, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+			if generations := listVersions(); len(generations) != 2 || generations[0] != first {
+				t.Fatalf("expected second generation to be gone, got %v", generations)
+			}
+
+			res = do(http.MethodDelete, "/versions?objectname="+objectname+"&generation="+second)
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404 deleting a missing generation, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+
+			res = do(http.MethodGet, "/download-file?objectname="+objectname+"&generation="+second)
+			if res.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404 downloading a deleted generation, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+
+			res = do(http.MethodGet, "/download-file?objectname="+objectname+"&generation=abc")
+			if res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected 400 for an invalid generation, got %d", res.StatusCode)
+			}
+			res.Body.Close()
+		})
+	}
+}
+
+func TestVersionsUnsupported(t *testing.T) {
+	srv := newTestServer(t, newLocalStore(t, "http://localhost:8080"))
+
+	res, err := http.Get(srv.URL + "/versions?objectname=fw/app.bin")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", res.StatusCode)
+	}
+	if ar := parseResp(t, res); ar.Code != "NOT_SUPPORTED" {
+		t.Fatalf("expected NOT_SUPPORTED code, got %q", ar.Code)
+	}
+}
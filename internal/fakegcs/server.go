@@ -0,0 +1,961 @@
+// Package fakegcs is an in-process stand-in for the subset of the Google Cloud
+// Storage JSON and XML APIs used by the storage client, for hermetic tests.
+package fakegcs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type Object struct {
+	Bucket             string
+	Name               string
+	Data               []byte
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+	Generation         int64
+	Metageneration     int64
+	Created            time.Time
+	Updated            time.Time
+	Deleted            time.Time
+}
+
+func (o *Object) MD5() []byte {
+	sum := md5.Sum(o.Data)
+	return sum[:]
+}
+
+func (o *Object) CRC32C() uint32 {
+	return crc32.Checksum(o.Data, castagnoli)
+}
+
+type pendingUpload struct {
+	bucket string
+	meta   objectResource
+	query  url.Values
+	data   []byte
+}
+
+type Server struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu         sync.Mutex
+	live       map[string]*Object
+	noncurrent map[string][]*Object
+	uploads    map[string]*pendingUpload
+	versioning bool
+	rewriteMax int64
+	nextGen    int64
+	nextID     int
+	requests   []string
+}
+
+func New() *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("fakegcs: generating key: %v", err))
+	}
+
+	s := &Server{
+		key:        key,
+		live:       make(map[string]*Object),
+		noncurrent: make(map[string][]*Object),
+		uploads:    make(map[string]*pendingUpload),
+		nextGen:    time.Now().UnixMicro(),
+	}
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Endpoint is the JSON API base path to pass to option.WithEndpoint.
+func (s *Server) Endpoint() string {
+	return s.srv.URL + "/storage/v1/"
+}
+
+// CredentialsJSON returns a service account key whose token_uri points at
+// this server, so clients authenticate and sign URLs without network access.
+func (s *Server) CredentialsJSON() []byte {
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(s.key),
+	})
+
+	creds, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "fake-project",
+		"private_key_id": "fake-key",
+		"private_key":    string(keyPEM),
+		"client_email":   "uploader@fake-project.iam.gserviceaccount.com",
+		"client_id":      "1",
+		"token_uri":      s.srv.URL + "/token",
+	})
+	return creds
+}
+
+func (s *Server) PublicKey() *rsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *Server) SetVersioning(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versioning = enabled
+}
+
+// SetRewriteChunkSize caps how many bytes each rewrite call copies, so that
+// copies larger than n take several calls as they do for large objects in GCS.
+func (s *Server) SetRewriteChunkSize(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rewriteMax = n
+}
+
+func (s *Server) PutObject(bucket, name string, data []byte) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store(&Object{Bucket: bucket, Name: name, Data: data})
+}
+
+func (s *Server) Object(bucket, name string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.live[key(bucket, name)]
+	if !ok {
+		return nil, false
+	}
+	c := *obj
+	return &c, true
+}
+
+// Requests returns "METHOD path" for every request served so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func key(bucket, name string) string {
+	return bucket + "\x00" + name
+}
+
+func (s *Server) store(obj *Object) *Object {
+	now := time.Now().UTC()
+	s.nextGen++
+	obj.Generation = s.nextGen
+	obj.Metageneration = 1
+	obj.Created = now
+	obj.Updated = now
+	if obj.ContentType == "" {
+		obj.ContentType = "application/octet-stream"
+	}
+
+	k := key(obj.Bucket, obj.Name)
+	if prev, ok := s.live[k]; ok {
+		s.archive(prev)
+	}
+	s.live[k] = obj
+	return obj
+}
+
+func (s *Server) archive(obj *Object) {
+	if !s.versioning {
+		return
+	}
+	obj.Deleted = time.Now().UTC()
+	k := key(obj.Bucket, obj.Name)
+	s.noncurrent[k] = append(s.noncurrent[k], obj)
+}
+
+func (s *Server) lookup(bucket, name string, generation int64) *Object {
+	k := key(bucket, name)
+	if obj, ok := s.live[k]; ok && (generation == 0 || obj.Generation == generation) {
+		return obj
+	}
+	if generation == 0 {
+		return nil
+	}
+	for _, obj := range s.noncurrent[k] {
+		if obj.Generation == generation {
+			return obj
+		}
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	s.mu.Unlock()
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i, seg := range segments {
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			segments[i] = unescaped
+		}
+	}
+
+	switch {
+	case r.URL.Path == "/token":
+		writeJSON(w, http.StatusOK, map[string]any{"access_token": "fake-token", "token_type": "Bearer", "expires_in": 3600})
+	case len(segments) == 6 && segments[0] == "upload" && segments[1] == "storage" && segments[3] == "b" && segments[5] == "o":
+		s.handleUpload(w, r, segments[4])
+	case len(segments) == 5 && segments[0] == "storage" && segments[2] == "b" && segments[4] == "o" && r.Method == http.MethodGet:
+		s.handleList(w, r, segments[3])
+	case len(segments) == 11 && segments[0] == "storage" && segments[6] == "rewriteTo" && r.Method == http.MethodPost:
+		s.handleRewrite(w, r, segments[3], segments[5], segments[8], segments[10])
+	case len(segments) >= 6 && segments[0] == "storage" && segments[2] == "b" && segments[4] == "o":
+		s.handleObject(w, r, segments[3], strings.Join(segments[5:], "/"))
+	case len(segments) >= 2 && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.handleXMLRead(w, r, segments[0], strings.Join(segments[1:], "/"))
+	default:
+		writeError(w, http.StatusNotFound, "no such route "+r.Method+" "+r.URL.Path)
+	}
+}
+
+type objectResource struct {
+	Kind               string            `json:"kind,omitempty"`
+	ID                 string            `json:"id,omitempty"`
+	Bucket             string            `json:"bucket,omitempty"`
+	Name               string            `json:"name,omitempty"`
+	Size               string            `json:"size,omitempty"`
+	ContentType        string            `json:"contentType,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Generation         string            `json:"generation,omitempty"`
+	Metageneration     string            `json:"metageneration,omitempty"`
+	Md5Hash            string            `json:"md5Hash,omitempty"`
+	Crc32c             string            `json:"crc32c,omitempty"`
+	Etag               string            `json:"etag,omitempty"`
+	StorageClass       string            `json:"storageClass,omitempty"`
+	TimeCreated        string            `json:"timeCreated,omitempty"`
+	Updated            string            `json:"updated,omitempty"`
+	TimeDeleted        string            `json:"timeDeleted,omitempty"`
+}
+
+func resource(obj *Object) objectResource {
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, obj.CRC32C())
+
+	res := objectResource{
+		Kind:               "storage#object",
+		ID:                 fmt.Sprintf("%s/%s/%d", obj.Bucket, obj.Name, obj.Generation),
+		Bucket:             obj.Bucket,
+		Name:               obj.Name,
+		Size:               strconv.Itoa(len(obj.Data)),
+		ContentType:        obj.ContentType,
+		ContentEncoding:    obj.ContentEncoding,
+		CacheControl:       obj.CacheControl,
+		ContentDisposition: obj.ContentDisposition,
+		Metadata:           obj.Metadata,
+		Generation:         strconv.FormatInt(obj.Generation, 10),
+		Metageneration:     strconv.FormatInt(obj.Metageneration, 10),
+		Md5Hash:            base64.StdEncoding.EncodeToString(obj.MD5()),
+		Crc32c:             base64.StdEncoding.EncodeToString(crc),
+		Etag:               etag(obj),
+		StorageClass:       "STANDARD",
+		TimeCreated:        obj.Created.Format(time.RFC3339Nano),
+		Updated:            obj.Updated.Format(time.RFC3339Nano),
+	}
+	if !obj.Deleted.IsZero() {
+		res.TimeDeleted = obj.Deleted.Format(time.RFC3339Nano)
+	}
+	return res
+}
+
+func etag(obj *Object) string {
+	return fmt.Sprintf("%d/%d", obj.Generation, obj.Metageneration)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	reason := map[int]string{
+		http.StatusBadRequest:         "invalid",
+		http.StatusNotFound:           "notFound",
+		http.StatusPreconditionFailed: "conditionNotMet",
+	}[status]
+
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"code":    status,
+			"message": message,
+			"errors":  []map[string]string{{"reason": reason, "message": message}},
+		},
+	})
+}
+
+func int64Param(v string) (int64, bool) {
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+type preconditions struct {
+	generationMatch        string
+	generationNotMatch     string
+	metagenerationMatch    string
+	metagenerationNotMatch string
+}
+
+func queryPreconditions(q url.Values) preconditions {
+	return preconditions{
+		generationMatch:        q.Get("ifGenerationMatch"),
+		generationNotMatch:     q.Get("ifGenerationNotMatch"),
+		metagenerationMatch:    q.Get("ifMetagenerationMatch"),
+		metagenerationNotMatch: q.Get("ifMetagenerationNotMatch"),
+	}
+}
+
+func headerPreconditions(h http.Header) preconditions {
+	return preconditions{
+		generationMatch:        h.Get("X-Goog-If-Generation-Match"),
+		generationNotMatch:     h.Get("X-Goog-If-Generation-Not-Match"),
+		metagenerationMatch:    h.Get("X-Goog-If-Metageneration-Match"),
+		metagenerationNotMatch: h.Get("X-Goog-If-Metageneration-Not-Match"),
+	}
+}
+
+// check reports whether the preconditions hold against obj, which is nil when
+// the object does not exist.
+func (p preconditions) check(obj *Object) bool {
+	var gen, metagen int64
+	if obj != nil {
+		gen, metagen = obj.Generation, obj.Metageneration
+	}
+
+	if v, ok := int64Param(p.generationMatch); ok && v != gen {
+		return false
+	}
+	if v, ok := int64Param(p.generationNotMatch); ok && v == gen {
+		return false
+	}
+	if v, ok := int64Param(p.metagenerationMatch); ok && (obj == nil || v != metagen) {
+		return false
+	}
+	if v, ok := int64Param(p.metagenerationNotMatch); ok && obj != nil && v == metagen {
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+
+	switch {
+	case q.Get("upload_id") != "" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		s.handleResumableChunk(w, r, q.Get("upload_id"))
+	case r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/"):
+		meta, data, err := readMultipartUpload(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if meta.Name == "" {
+			meta.Name = q.Get("name")
+		}
+		s.finishUpload(w, bucket, meta, q, data)
+	case r.Method == http.MethodPost:
+		var meta objectResource
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if meta.Name == "" {
+			meta.Name = q.Get("name")
+		}
+		if meta.ContentType == "" {
+			meta.ContentType = r.Header.Get("X-Upload-Content-Type")
+		}
+
+		s.mu.Lock()
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &pendingUpload{bucket: bucket, meta: meta, query: q}
+		s.mu.Unlock()
+
+		location := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&upload_id=%s", s.srv.URL, url.PathEscape(bucket), id)
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported upload request")
+	}
+}
+
+func readMultipartUpload(r *http.Request) (objectResource, []byte, error) {
+	var meta objectResource
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return meta, nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	metaPart, err := mr.NextPart()
+	if err != nil {
+		return meta, nil, err
+	}
+	if err := json.NewDecoder(metaPart).Decode(&meta); err != nil {
+		return meta, nil, err
+	}
+
+	mediaPart, err := mr.NextPart()
+	if err != nil {
+		return meta, nil, err
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = mediaPart.Header.Get("Content-Type")
+	}
+	data, err := io.ReadAll(mediaPart)
+	return meta, data, err
+}
+
+func (s *Server) handleResumableChunk(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	up, ok := s.uploads[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such upload")
+		return
+	}
+
+	chunk, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Content-Range is "bytes first-last/total", "bytes first-last/*" or
+	// "bytes */total" for the final empty request.
+	contentRange := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	rangePart, totalPart, _ := strings.Cut(contentRange, "/")
+	if rangePart != "*" {
+		first, _, _ := strings.Cut(rangePart, "-")
+		if start, err := strconv.Atoi(first); err != nil || start != len(up.data) {
+			writeError(w, http.StatusBadRequest, "unexpected chunk offset "+rangePart)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	up.data = append(up.data, chunk...)
+	received := len(up.data)
+	s.mu.Unlock()
+
+	if totalPart == "*" || totalPart == "" {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	if total, err := strconv.Atoi(totalPart); err != nil || total != received {
+		writeError(w, http.StatusBadRequest, "upload size mismatch")
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	s.finishUpload(w, up.bucket, up.meta, up.query, up.data)
+}
+
+func (s *Server) finishUpload(w http.ResponseWriter, bucket string, meta objectResource, q url.Values, data []byte) {
+	if meta.Name == "" {
+		writeError(w, http.StatusBadRequest, "object name is required")
+		return
+	}
+
+	obj := &Object{
+		Bucket:             bucket,
+		Name:               meta.Name,
+		Data:               data,
+		ContentType:        meta.ContentType,
+		ContentEncoding:    meta.ContentEncoding,
+		CacheControl:       meta.CacheControl,
+		ContentDisposition: meta.ContentDisposition,
+		Metadata:           maps.Clone(meta.Metadata),
+	}
+
+	if meta.Md5Hash != "" && meta.Md5Hash != base64.StdEncoding.EncodeToString(obj.MD5()) {
+		writeError(w, http.StatusBadRequest, "Provided MD5 hash does not match calculated MD5 hash")
+		return
+	}
+	if meta.Crc32c != "" {
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, obj.CRC32C())
+		if meta.Crc32c != base64.StdEncoding.EncodeToString(crc) {
+			writeError(w, http.StatusBadRequest, "Provided CRC32C does not match calculated CRC32C")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !queryPreconditions(q).check(s.live[key(bucket, meta.Name)]) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	writeJSON(w, http.StatusOK, resource(s.store(obj)))
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	versions := q.Get("versions") == "true"
+
+	maxResults := 1000
+	if n, err := strconv.Atoi(q.Get("maxResults")); err == nil && n > 0 && n < maxResults {
+		maxResults = n
+	}
+
+	var after string
+	if token := q.Get("pageToken"); token != "" {
+		decoded, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid page token")
+			return
+		}
+		after = string(decoded)
+	}
+
+	s.mu.Lock()
+	var candidates []*Object
+	for _, obj := range s.live {
+		if obj.Bucket == bucket {
+			candidates = append(candidates, obj)
+		}
+	}
+	if versions {
+		for _, objs := range s.noncurrent {
+			for _, obj := range objs {
+				if obj.Bucket == bucket {
+					candidates = append(candidates, obj)
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Name != candidates[j].Name {
+			return candidates[i].Name < candidates[j].Name
+		}
+		return candidates[i].Generation < candidates[j].Generation
+	})
+
+	// Entries are keyed by name (plus generation when listing versions) so
+	// that page tokens sort the same way the listing does.
+	entryKey := func(obj *Object) string {
+		if versions {
+			return fmt.Sprintf("%s\x00%020d", obj.Name, obj.Generation)
+		}
+		return obj.Name
+	}
+
+	var items []objectResource
+	var prefixes []string
+	seenPrefixes := make(map[string]bool)
+	nextPageToken := ""
+	count := 0
+
+	for _, obj := range candidates {
+		if !strings.HasPrefix(obj.Name, prefix) {
+			continue
+		}
+
+		k := entryKey(obj)
+		if delimiter != "" {
+			if i := strings.Index(obj.Name[len(prefix):], delimiter); i >= 0 {
+				k = obj.Name[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if after != "" && k <= after {
+			continue
+		}
+
+		if count == maxResults {
+			nextPageToken = base64.URLEncoding.EncodeToString([]byte(after))
+			break
+		}
+
+		if delimiter != "" && k != entryKey(obj) {
+			if !seenPrefixes[k] {
+				seenPrefixes[k] = true
+				prefixes = append(prefixes, k)
+				count++
+			}
+			after = k
+			continue
+		}
+
+		items = append(items, resource(obj))
+		count++
+		after = k
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"kind":          "storage#objects",
+		"items":         items,
+		"prefixes":      prefixes,
+		"nextPageToken": nextPageToken,
+	})
+}
+
+func (s *Server) handleObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	q := r.URL.Query()
+	generation, _ := int64Param(q.Get("generation"))
+
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		obj := s.lookup(bucket, name, generation)
+		s.mu.Unlock()
+		if obj == nil {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+			return
+		}
+		if !queryPreconditions(q).check(obj) {
+			writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+		if q.Get("alt") == "media" {
+			serveMedia(w, r, obj)
+			return
+		}
+		writeJSON(w, http.StatusOK, resource(obj))
+	case http.MethodDelete:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		obj := s.lookup(bucket, name, generation)
+		if obj == nil {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+			return
+		}
+		if !queryPreconditions(q).check(obj) {
+			writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+			return
+		}
+
+		k := key(bucket, name)
+		if live, ok := s.live[k]; ok && live == obj {
+			delete(s.live, k)
+			if generation == 0 {
+				s.archive(obj)
+			}
+		} else {
+			versions := s.noncurrent[k]
+			for i, v := range versions {
+				if v == obj {
+					s.noncurrent[k] = append(versions[:i:i], versions[i+1:]...)
+					break
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		s.handlePatch(w, r, bucket, name, generation)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "unsupported method "+r.Method)
+	}
+}
+
+// handlePatch updates object metadata with the JSON API's patch semantics: a
+// null field is cleared and metadata keys are merged, with null removing one.
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, bucket, name string, generation int64) {
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid object metadata: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := s.lookup(bucket, name, generation)
+	if obj == nil {
+		writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+		return
+	}
+	if !queryPreconditions(r.URL.Query()).check(obj) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+
+	fields := map[string]*string{
+		"contentType":        &obj.ContentType,
+		"contentEncoding":    &obj.ContentEncoding,
+		"cacheControl":       &obj.CacheControl,
+		"contentDisposition": &obj.ContentDisposition,
+	}
+	for field, raw := range patch {
+		if target, ok := fields[field]; ok {
+			var value *string
+			json.Unmarshal(raw, &value)
+			*target = ""
+			if value != nil {
+				*target = *value
+			}
+			continue
+		}
+		if field != "metadata" {
+			continue
+		}
+
+		var metadata map[string]*string
+		json.Unmarshal(raw, &metadata)
+		if metadata == nil {
+			obj.Metadata = nil
+			continue
+		}
+		if obj.Metadata == nil {
+			obj.Metadata = make(map[string]string)
+		}
+		for k, v := range metadata {
+			if v == nil {
+				delete(obj.Metadata, k)
+			} else {
+				obj.Metadata[k] = *v
+			}
+		}
+	}
+
+	obj.Metageneration++
+	obj.Updated = time.Now().UTC()
+	writeJSON(w, http.StatusOK, resource(obj))
+}
+
+func (s *Server) handleRewrite(w http.ResponseWriter, r *http.Request, srcBucket, srcName, dstBucket, dstName string) {
+	q := r.URL.Query()
+	sourceGeneration, _ := int64Param(q.Get("sourceGeneration"))
+
+	var meta objectResource
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid object metadata: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src := s.lookup(srcBucket, srcName, sourceGeneration)
+	if src == nil {
+		writeError(w, http.StatusNotFound, "No such object: "+srcBucket+"/"+srcName)
+		return
+	}
+	if !queryPreconditions(q).check(s.live[key(dstBucket, dstName)]) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+
+	total := int64(len(src.Data))
+	perCall := s.rewriteMax
+	if v, ok := int64Param(q.Get("maxBytesRewrittenPerCall")); ok && v > 0 && (perCall == 0 || v < perCall) {
+		perCall = v
+	}
+	if perCall > 0 {
+		var done int64
+		if token := q.Get("rewriteToken"); token != "" {
+			done, _ = strconv.ParseInt(token, 10, 64)
+		}
+		if done += perCall; done < total {
+			writeJSON(w, http.StatusOK, map[string]any{
+				"kind":                "storage#rewriteResponse",
+				"totalBytesRewritten": strconv.FormatInt(done, 10),
+				"objectSize":          strconv.FormatInt(total, 10),
+				"done":                false,
+				"rewriteToken":        strconv.FormatInt(done, 10),
+			})
+			return
+		}
+	}
+
+	obj := &Object{
+		Bucket:             dstBucket,
+		Name:               dstName,
+		Data:               bytes.Clone(src.Data),
+		ContentType:        src.ContentType,
+		ContentEncoding:    src.ContentEncoding,
+		CacheControl:       src.CacheControl,
+		ContentDisposition: src.ContentDisposition,
+		Metadata:           maps.Clone(src.Metadata),
+	}
+	if meta.ContentType != "" {
+		obj.ContentType = meta.ContentType
+	}
+	if meta.ContentEncoding != "" {
+		obj.ContentEncoding = meta.ContentEncoding
+	}
+	if meta.CacheControl != "" {
+		obj.CacheControl = meta.CacheControl
+	}
+	if meta.ContentDisposition != "" {
+		obj.ContentDisposition = meta.ContentDisposition
+	}
+	if meta.Metadata != nil {
+		obj.Metadata = meta.Metadata
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"kind":                "storage#rewriteResponse",
+		"totalBytesRewritten": strconv.FormatInt(total, 10),
+		"objectSize":          strconv.FormatInt(total, 10),
+		"done":                true,
+		"resource":            resource(s.store(obj)),
+	})
+}
+
+func (s *Server) handleXMLRead(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	generation, _ := int64Param(r.URL.Query().Get("generation"))
+
+	s.mu.Lock()
+	obj := s.lookup(bucket, name, generation)
+	s.mu.Unlock()
+
+	if obj == nil {
+		http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+		return
+	}
+	if !headerPreconditions(r.Header).check(obj) {
+		http.Error(w, "<Error><Code>PreconditionFailed</Code></Error>", http.StatusPreconditionFailed)
+		return
+	}
+	serveMedia(w, r, obj)
+}
+
+func serveMedia(w http.ResponseWriter, r *http.Request, obj *Object) {
+	h := w.Header()
+	h.Set("Content-Type", obj.ContentType)
+	if obj.ContentEncoding != "" {
+		h.Set("Content-Encoding", obj.ContentEncoding)
+	}
+	if obj.CacheControl != "" {
+		h.Set("Cache-Control", obj.CacheControl)
+	}
+	if obj.ContentDisposition != "" {
+		h.Set("Content-Disposition", obj.ContentDisposition)
+	}
+	for k, v := range obj.Metadata {
+		h.Set("X-Goog-Meta-"+k, v)
+	}
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, obj.CRC32C())
+	h.Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(obj.Metageneration, 10))
+	h.Add("X-Goog-Hash", "crc32c="+base64.StdEncoding.EncodeToString(crc))
+	h.Add("X-Goog-Hash", "md5="+base64.StdEncoding.EncodeToString(obj.MD5()))
+	h.Set("X-Goog-Stored-Content-Length", strconv.Itoa(len(obj.Data)))
+	h.Set("Last-Modified", obj.Updated.Format(http.TimeFormat))
+	h.Set("ETag", `"`+etag(obj)+`"`)
+
+	size := int64(len(obj.Data))
+	start, end, partial, ok := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	h.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method != http.MethodHead {
+		w.Write(obj.Data[start:end])
+	}
+}
+
+// parseRange handles the single byte ranges the storage client sends:
+// "bytes=a-b", "bytes=a-" and "bytes=-n".
+func parseRange(header string, size int64) (start, end int64, partial, ok bool) {
+	if header == "" {
+		return 0, size, false, true
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, size, false, true
+	}
+	first, last, _ := strings.Cut(spec, "-")
+
+	switch {
+	case first == "":
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return 0, 0, false, false
+		}
+		start = max(size-n, 0)
+		end = size
+	default:
+		var err error
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil || start >= size && size > 0 {
+			return 0, 0, false, false
+		}
+		end = size
+		if last != "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < start {
+				return 0, 0, false, false
+			}
+			end = min(n+1, size)
+		}
+	}
+	return start, end, true, true
+}
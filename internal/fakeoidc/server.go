@@ -0,0 +1,128 @@
+// Package fakeoidc is an in-process stand-in for an OIDC token issuer. It
+// publishes a JWKS and signs tokens with the current key, for hermetic tests.
+package fakeoidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const jwksPath = "/.well-known/jwks.json"
+
+type Server struct {
+	srv *httptest.Server
+
+	mu           sync.Mutex
+	key          jose.JSONWebKey
+	nextKeyID    int
+	jwksRequests int
+	held         chan struct{}
+}
+
+func New() *Server {
+	s := &Server{}
+	s.Rotate()
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Issuer is the URL tokens are expected to carry in "iss".
+func (s *Server) Issuer() string {
+	return s.srv.URL
+}
+
+func (s *Server) JWKSURL() string {
+	return s.srv.URL + jwksPath
+}
+
+// Rotate replaces the signing key. Only the new key is published, so tokens
+// signed before the rotation stop verifying once the JWKS is fetched again.
+func (s *Server) Rotate() string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("fakeoidc: generating key: %v", err))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextKeyID++
+	s.key = jose.JSONWebKey{Key: key, KeyID: fmt.Sprintf("key-%d", s.nextKeyID), Algorithm: string(jose.RS256), Use: "sig"}
+	return s.key.KeyID
+}
+
+// JWKS returns the published key set.
+func (s *Server) JWKS() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{s.key.Public()}})
+	return data
+}
+
+// JWKSRequests is the number of times the JWKS has been fetched.
+func (s *Server) JWKSRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksRequests
+}
+
+// Hold stalls JWKS responses until the returned release function is called,
+// to stand in for a slow issuer. Requests are counted as they arrive.
+func (s *Server) Hold() (release func()) {
+	held := make(chan struct{})
+	s.mu.Lock()
+	s.held = held
+	s.mu.Unlock()
+	return sync.OnceFunc(func() {
+		s.mu.Lock()
+		s.held = nil
+		s.mu.Unlock()
+		close(held)
+	})
+}
+
+// Token signs claims with the current key.
+func (s *Server) Token(claims map[string]any) string {
+	s.mu.Lock()
+	key := s.key
+	s.mu.Unlock()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		panic(fmt.Sprintf("fakeoidc: creating signer: %v", err))
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		panic(fmt.Sprintf("fakeoidc: signing token: %v", err))
+	}
+	return token
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.URL.Path != jwksPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.jwksRequests++
+	held := s.held
+	s.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.JWKS())
+}
@@ -7,13 +7,39 @@ import (
 )
 
 func GCSRouter(r *gin.Engine) {
-	api := r.Group("/api/v1/gcs")
+	public := r.Group("/api/v1/gcs")
+	{
+		// Signed local urls and CORS preflights carry no API key.
+		public.GET("/local-object", gcs.ServeLocalObject)
+		public.OPTIONS("/tus", gcs.TusOptions)
+		public.OPTIONS("/tus/:id", gcs.TusOptions)
+	}
+
+	api := r.Group("/api/v1/gcs", gcs.Authenticate)
 	{
 		api.GET("/list", gcs.ListFiles)
 		api.POST("/upload", gcs.UploadFile)
 		api.GET("/download", gcs.DownloadFile)
+		api.HEAD("/download", gcs.HeadObject)
+		api.GET("/stat", gcs.StatObject)
+		api.GET("/download-archive", gcs.DownloadArchive)
 		api.DELETE("/delete", gcs.DeleteObject)
+		api.POST("/delete-batch", gcs.BatchDelete)
 		api.POST("/upload-buffer", gcs.UploadBuffer)
 		api.GET("/object-url", gcs.GetObjectUrl)
+		api.POST("/post-policy", gcs.GetPostPolicy)
+		api.POST("/copy", gcs.CopyObject)
+		api.POST("/move", gcs.MoveObject)
+		api.GET("/object-attrs", gcs.StatObject)
+		api.PATCH("/object-attrs", gcs.UpdateObjectAttrs)
+
+		api.GET("/versions", gcs.ListVersions)
+		api.POST("/versions/restore", gcs.RestoreVersion)
+		api.DELETE("/versions", gcs.DeleteVersion)
+
+		api.POST("/tus", gcs.TusCreate)
+		api.HEAD("/tus/:id", gcs.TusHead)
+		api.PATCH("/tus/:id", gcs.TusPatch)
+		api.DELETE("/tus/:id", gcs.TusDelete)
 	}
 }
@@ -5,6 +5,8 @@ import (
 	"gcsuploader/routes"
 	"gcsuploader/utils"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,14 +17,101 @@ func Start() {
 	port := utils.GetEnv("PORT", "8080")
 	credentialsPath := utils.GetEnv("CREDENTIALS", "credentials.json")
 	bucketName := utils.GetEnv("BUCKET_NAME", "dmtfota")
+	backend := utils.GetEnv("STORAGE_BACKEND", handler.BackendGCS)
 
-	if err := handler.ConnectGCS(credentialsPath, bucketName); err != nil {
-		log.Fatalf("Failed to connect to GCS: %v", err)
+	storeConfig := handler.StoreConfig{
+		Backend:         backend,
+		CredentialsPath: credentialsPath,
+		BucketName:      bucketName,
+		Endpoint:        utils.GetEnv("GCS_ENDPOINT", ""),
+
+		LocalRoot:       utils.GetEnv("LOCAL_ROOT", "data"),
+		LocalSigningKey: utils.GetEnv("LOCAL_SIGNING_KEY", ""),
+		PublicURL:       utils.GetEnv("PUBLIC_URL", "http://localhost:"+port),
+	}
+	if err := handler.ConnectStore(storeConfig); err != nil {
+		log.Fatalf("Failed to connect to %s storage backend: %v", backend, err)
 	}
 
+	handler.ConfigureUploads(handler.UploadConfig{
+		MaxSize:   utils.GetEnvInt64("UPLOAD_MAX_SIZE", 5<<30),
+		ChunkSize: int(utils.GetEnvInt64("UPLOAD_CHUNK_SIZE", 8<<20)),
+		Timeout:   utils.GetEnvDuration("UPLOAD_TIMEOUT", 30*time.Minute),
+	})
+	handler.ConfigureExtraction(handler.ExtractConfig{
+		MaxEntries:   int(utils.GetEnvInt64("EXTRACT_MAX_ENTRIES", 10000)),
+		MaxEntrySize: utils.GetEnvInt64("EXTRACT_MAX_ENTRY_SIZE", 1<<30),
+		MaxTotalSize: utils.GetEnvInt64("EXTRACT_MAX_TOTAL_SIZE", 10<<30),
+	})
+	if err := handler.ConfigurePolicies(handler.PolicyConfig{PoliciesFile: utils.GetEnv("UPLOAD_POLICIES_FILE", "")}); err != nil {
+		log.Fatalf("Failed to configure upload policies: %v", err)
+	}
+	// Server-side downloads write to the host, so they stay disabled until
+	// DOWNLOAD_ROOT names the directory they may write to.
+	if err := handler.ConfigureDownloads(handler.DownloadConfig{Root: utils.GetEnv("DOWNLOAD_ROOT", "")}); err != nil {
+		log.Fatalf("Failed to create download root: %v", err)
+	}
+	handler.ConfigureSignedURLs(handler.SignedURLConfig{
+		DefaultExpiry: utils.GetEnvDuration("SIGNED_URL_EXPIRY", 24*time.Hour),
+		MaxExpiry:     utils.GetEnvDuration("SIGNED_URL_MAX_EXPIRY", 7*24*time.Hour),
+	})
+	handler.ConfigurePostPolicies(handler.PostPolicyConfig{
+		Folders: strings.Split(utils.GetEnv("POST_POLICY_FOLDERS", ""), ","),
+	})
+	if err := handler.ConfigureAuth(handler.AuthConfig{APIKeysFile: utils.GetEnv("API_KEYS_FILE", "")}); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	jwtConfig := handler.JWTConfig{
+		JWKSFile: utils.GetEnv("JWT_JWKS_FILE", ""),
+		JWKSURL:  utils.GetEnv("JWT_JWKS_URL", ""),
+		Issuer:   utils.GetEnv("JWT_ISSUER", ""),
+		Audience: utils.GetEnv("JWT_AUDIENCE", ""),
+		CacheTTL: utils.GetEnvDuration("JWT_JWKS_CACHE_TTL", time.Hour),
+	}
+	if err := handler.ConfigureJWT(jwtConfig); err != nil {
+		log.Fatalf("Failed to configure JWT authentication: %v", err)
+	}
+	if !handler.AuthEnabled() {
+		if utils.GetEnv("AUTH_DISABLED", "") != "true" {
+			log.Fatalf("No API keys or JWT issuer configured: set API_KEYS_FILE or JWT_ISSUER, or AUTH_DISABLED=true to serve without authentication")
+		}
+		log.Printf("Authentication is disabled: every route is open")
+	}
+	handler.ConfigureBatches(handler.BatchConfig{
+		Concurrency: int(utils.GetEnvInt64("BATCH_CONCURRENCY", 8)),
+	})
+
+	// TUS_MAX_SIZE can only lower UPLOAD_MAX_SIZE, which it defaults to.
+	tusStore, err := handler.NewTusStore(handler.TusConfig{
+		Dir:        utils.GetEnv("TUS_DIR", "tus-uploads"),
+		MaxSize:    utils.GetEnvInt64("TUS_MAX_SIZE", 0),
+		Expiration: utils.GetEnvDuration("TUS_EXPIRATION", 24*time.Hour),
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize resumable upload store: %v", err)
+	}
+	handler.SetTusStore(tusStore)
+	go purgeExpiredUploads(tusStore, time.Hour)
+
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
 	routes.GCSRouter(router)
 	log.Printf("Server started on port %s", port)
 	router.Run(":" + port)
 }
+
+func purgeExpiredUploads(store *handler.TusStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := store.PurgeExpired()
+		if err != nil {
+			log.Printf("Failed to purge expired uploads: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired uploads", purged)
+		}
+	}
+}